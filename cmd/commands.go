@@ -6,12 +6,19 @@ package cmd
 import (
 	"context"
 	"errors"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/joho/godotenv"
 	"github.com/spf13/cobra"
 
+	"github.com/akakream/MultiPlatform2IPFS/internal/ipfs"
 	registry "github.com/akakream/MultiPlatform2IPFS/internal/registry"
+	"github.com/akakream/MultiPlatform2IPFS/internal/store"
 	"github.com/akakream/MultiPlatform2IPFS/server"
 	"github.com/akakream/MultiPlatform2IPFS/utils"
 )
@@ -21,8 +28,30 @@ var (
 	ErrImageRequired = errors.New("image is required")
 	// ErrOnlyOneArgumentRequired is error for when one argument only is required
 	ErrOnlyOneArgumentRequired = errors.New("only one argument is required")
+	// ErrUsernameRequired is error for when the password is given without a username
+	ErrUsernameRequired = errors.New("--password-stdin requires --username")
+	// ErrPasswordStdinRequired is error for when the username is given without a password
+	ErrPasswordStdinRequired = errors.New("--username requires --password-stdin")
+	// ErrInvalidConcurrency is error for when the concurrency is negative
+	ErrInvalidConcurrency = errors.New("--concurrency must not be negative")
+	// ErrInvalidWorkers is error for when the worker count is not a positive number
+	ErrInvalidWorkers = errors.New("--workers and JOB_WORKERS must be a positive number")
+	// ErrInvalidGracePeriod is error for when the shutdown grace period is not a duration
+	ErrInvalidGracePeriod = errors.New("SHUTDOWN_GRACE_PERIOD must be a duration such as 25s or 0")
+	// ErrInvalidPinTimeout is error for when the pin timeout is not a duration
+	ErrInvalidPinTimeout = errors.New("PIN_TIMEOUT must be a duration such as 10m or 0")
+	// ErrInvalidImageRetention is error for when the image retention is not a duration
+	ErrInvalidImageRetention = errors.New("IMAGE_RETENTION must be a duration such as 720h or 0")
 )
 
+// defaultShutdownGracePeriod leaves the server time to clean up within the
+// default termination grace period of Kubernetes.
+const defaultShutdownGracePeriod = 25 * time.Second
+
+// defaultPinTimeout limits a pin of the pin API, which may have to fetch the
+// content from the network.
+const defaultPinTimeout = 10 * time.Minute
+
 var serverCmd = &cobra.Command{
 	Use:   "server",
 	Short: "Start server",
@@ -30,17 +59,54 @@ var serverCmd = &cobra.Command{
 	Args: func(cmd *cobra.Command, args []string) error {
 		return nil
 	},
-	Run: func(cmd *cobra.Command, args []string) {
-		if err := godotenv.Load(); err != nil {
-			panic(err)
-		}
+	RunE: func(cmd *cobra.Command, args []string) error {
 		baseURL, err := utils.GetEnv("BASE_URL", "localhost:3000")
 		if err != nil {
-			panic(err)
+			return err
+		}
+		keepStaging, err := cmd.Flags().GetBool("keep-staging")
+		if err != nil {
+			return err
+		}
+		workers, err := jobWorkers(cmd)
+		if err != nil {
+			return err
+		}
+		gracePeriod, err := shutdownGracePeriod()
+		if err != nil {
+			return err
+		}
+		pinLimit, err := pinTimeout()
+		if err != nil {
+			return err
+		}
+		imageLimit, err := imageRetention()
+		if err != nil {
+			return err
+		}
+		if _, err := registry.CleanStagingDirs(); err != nil {
+			return err
+		}
+		jobStore, err := openStore()
+		if err != nil {
+			return err
+		}
+		client, err := newIPFSClient()
+		if err != nil {
+			return err
 		}
 
-		s := server.NewServer(baseURL)
+		s := server.NewServer(baseURL, server.Options{
+			KeepStaging:         keepStaging,
+			Workers:             workers,
+			Store:               jobStore,
+			IPFS:                client,
+			PinTimeout:          pinLimit,
+			ShutdownGracePeriod: gracePeriod,
+			ImageRetention:      imageLimit,
+		})
 		s.Start()
+		return nil
 	},
 }
 
@@ -49,7 +115,9 @@ var copyCmd = &cobra.Command{
 	Use:   "copy",
 	Short: "A brief description of your command",
 	Long: `copy multi-platform image to IPFS. For example:
-MultiPlatform2IPFS copy busybox:latest .`,
+MultiPlatform2IPFS copy busybox:latest
+MultiPlatform2IPFS copy ghcr.io/org/app:1.2
+MultiPlatform2IPFS copy localhost:5000/team/svc@sha256:...`,
 	Args: func(cmd *cobra.Command, args []string) error {
 		if len(args) == 0 {
 			return ErrImageRequired
@@ -60,14 +128,303 @@ MultiPlatform2IPFS copy busybox:latest .`,
 
 		return nil
 	},
-	Run: func(cmd *cobra.Command, args []string) {
-		imageNameTag := strings.Split(args[0], ":")
-		registry.CopyImage(context.TODO(), imageNameTag[0], imageNameTag[1])
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ref, err := registry.ParseReference(args[0])
+		if err != nil {
+			return err
+		}
+		creds, err := credentialsFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+		platformFlags, err := cmd.Flags().GetStringSlice("platform")
+		if err != nil {
+			return err
+		}
+		platforms, err := registry.ParsePlatforms(platformFlags)
+		if err != nil {
+			return err
+		}
+		formatFlag, err := cmd.Flags().GetString("format")
+		if err != nil {
+			return err
+		}
+		format, err := registry.ParseExportFormat(formatFlag)
+		if err != nil {
+			return err
+		}
+		concurrency, err := cmd.Flags().GetInt("concurrency")
+		if err != nil {
+			return err
+		}
+		if concurrency < 0 {
+			return ErrInvalidConcurrency
+		}
+		keepStaging, err := cmd.Flags().GetBool("keep-staging")
+		if err != nil {
+			return err
+		}
+		force, err := cmd.Flags().GetBool("force")
+		if err != nil {
+			return err
+		}
+		outputFlag, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return err
+		}
+		onlyHash, err := cmd.Flags().GetBool("only-hash")
+		if err != nil {
+			return err
+		}
+		overrides, err := addOverridesFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+		if _, err := registry.CleanStagingDirs(); err != nil {
+			return err
+		}
+		jobStore, err := openStore()
+		if err != nil {
+			return err
+		}
+		client, err := newIPFSClient()
+		if err != nil {
+			return err
+		}
+		add, err := client.AddOptions().With(overrides)
+		if err != nil {
+			return err
+		}
+
+		opts := registry.CopyOptions{
+			Credentials: creds,
+			Platforms:   platforms,
+			Format:      format,
+			Concurrency: concurrency,
+			KeepStaging: keepStaging,
+			Force:       force,
+			Add:         &add,
+			OnlyHash:    onlyHash,
+		}
+		opts.Lookup = jobStore.Lookup(store.NewJobOptions(opts))
+
+		output, err := newProgressOutput(outputFlag)
+		if err != nil {
+			return err
+		}
+		defer output.close()
+		opts.Progress = output.update
+		opts.Output = output.messages()
+		// Ctrl-C aborts the transfers and removes the staging directory
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		result, err := registry.CopyImage(ctx, client, ref, opts)
+		if err != nil {
+			return err
+		}
+		image := store.NewImage(ref, opts, result, "", time.Now().UTC())
+		// An image that was only hashed is not published
+		if !onlyHash {
+			if err := jobStore.PutImage(image); err != nil {
+				return err
+			}
+		}
+		output.result(image)
+		return nil
 	},
 }
 
+// openStore opens the store at STORE_PATH or the default path, which keeps
+// finished jobs for JOB_RETENTION.
+func openStore() (*store.Store, error) {
+	path, err := store.DefaultPath()
+	if err != nil {
+		return nil, err
+	}
+	retention, err := store.DefaultRetention()
+	if err != nil {
+		return nil, err
+	}
+	return store.Open(path, retention)
+}
+
+// newIPFSClient returns the client of the IPFS API configured with the
+// IPFS_* settings.
+func newIPFSClient() (*ipfs.Client, error) {
+	config, err := ipfs.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return ipfs.NewClient(config)
+}
+
+// jobWorkers returns the number of copies the server runs at the same time,
+// given with --workers or JOB_WORKERS. It returns 0 for the default.
+func jobWorkers(cmd *cobra.Command) (int, error) {
+	workers, err := cmd.Flags().GetInt("workers")
+	if err != nil {
+		return 0, err
+	}
+	if workers == 0 {
+		value, err := utils.GetEnv("JOB_WORKERS", "")
+		if err != nil || value == "" {
+			return 0, err
+		}
+		workers, err = strconv.Atoi(value)
+		if err != nil {
+			return 0, ErrInvalidWorkers
+		}
+	}
+	if workers < 0 {
+		return 0, ErrInvalidWorkers
+	}
+	return workers, nil
+}
+
+// shutdownGracePeriod returns how long the running copies may take to finish
+// when the server shuts down, given with SHUTDOWN_GRACE_PERIOD.
+func shutdownGracePeriod() (time.Duration, error) {
+	value, err := utils.GetEnv("SHUTDOWN_GRACE_PERIOD", "")
+	if err != nil || value == "" {
+		return defaultShutdownGracePeriod, err
+	}
+	gracePeriod, err := time.ParseDuration(value)
+	if err != nil || gracePeriod < 0 {
+		return 0, ErrInvalidGracePeriod
+	}
+	return gracePeriod, nil
+}
+
+// pinTimeout returns the limit of a pin of the pin API, given with
+// PIN_TIMEOUT.
+func pinTimeout() (time.Duration, error) {
+	value, err := utils.GetEnv("PIN_TIMEOUT", "")
+	if err != nil || value == "" {
+		return defaultPinTimeout, err
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		return 0, ErrInvalidPinTimeout
+	}
+	return timeout, nil
+}
+
+// imageRetention returns how long an image stays in the catalog of the
+// server after its last copy, given with IMAGE_RETENTION. 0 keeps it.
+func imageRetention() (time.Duration, error) {
+	value, err := utils.GetEnv("IMAGE_RETENTION", "")
+	if err != nil || value == "" {
+		return 0, err
+	}
+	retention, err := time.ParseDuration(value)
+	if err != nil || retention < 0 {
+		return 0, ErrInvalidImageRetention
+	}
+	return retention, nil
+}
+
+// addOverridesFromFlags returns the add options given with --cid-version,
+// --raw-leaves, --chunker, --hash, --inline and --inline-limit. Options whose
+// flag is not given keep the ones of the IPFS_* settings.
+func addOverridesFromFlags(cmd *cobra.Command) (ipfs.AddOverrides, error) {
+	var overrides ipfs.AddOverrides
+	flags := cmd.Flags()
+	if flags.Changed("cid-version") {
+		value, err := flags.GetInt("cid-version")
+		if err != nil {
+			return overrides, err
+		}
+		overrides.CidVersion = &value
+	}
+	if flags.Changed("raw-leaves") {
+		value, err := flags.GetBool("raw-leaves")
+		if err != nil {
+			return overrides, err
+		}
+		overrides.RawLeaves = &value
+	}
+	if flags.Changed("chunker") {
+		value, err := flags.GetString("chunker")
+		if err != nil {
+			return overrides, err
+		}
+		overrides.Chunker = &value
+	}
+	if flags.Changed("hash") {
+		value, err := flags.GetString("hash")
+		if err != nil {
+			return overrides, err
+		}
+		overrides.Hash = &value
+	}
+	if flags.Changed("inline") {
+		value, err := flags.GetBool("inline")
+		if err != nil {
+			return overrides, err
+		}
+		overrides.Inline = &value
+	}
+	if flags.Changed("inline-limit") {
+		value, err := flags.GetInt("inline-limit")
+		if err != nil {
+			return overrides, err
+		}
+		overrides.InlineLimit = &value
+	}
+	return overrides, nil
+}
+
+// credentialsFromFlags returns the credentials given with --username and --password-stdin.
+// It returns nil if no username is given, so the docker config.json is used instead.
+func credentialsFromFlags(cmd *cobra.Command) (*registry.Credentials, error) {
+	username, err := cmd.Flags().GetString("username")
+	if err != nil {
+		return nil, err
+	}
+	passwordStdin, err := cmd.Flags().GetBool("password-stdin")
+	if err != nil {
+		return nil, err
+	}
+
+	if username == "" {
+		if passwordStdin {
+			return nil, ErrUsernameRequired
+		}
+		return nil, nil
+	}
+	if !passwordStdin {
+		return nil, ErrPasswordStdinRequired
+	}
+
+	password, err := io.ReadAll(cmd.InOrStdin())
+	if err != nil {
+		return nil, err
+	}
+	return &registry.Credentials{
+		Username: username,
+		Password: strings.TrimRight(string(password), "\r\n"),
+	}, nil
+}
+
 func init() {
 	serverCmd.PersistentFlags().StringP("port", "p", "3002", "give the port where the server runs")
+	serverCmd.Flags().Bool("keep-staging", false, "keep the staging directories of the copies for debugging (default KEEP_STAGING_DIRS)")
+	serverCmd.Flags().Int("workers", 0, "number of copies that run at the same time (default JOB_WORKERS or 2)")
 	rootCmd.AddCommand(serverCmd)
+	copyCmd.Flags().StringP("username", "u", "", "username for the registry")
+	copyCmd.Flags().Bool("password-stdin", false, "read the password for the registry from stdin")
+	copyCmd.Flags().String("format", "", "export format, flat or platform (default EXPORT_FORMAT or flat)")
+	copyCmd.Flags().Int("concurrency", 0, "maximum number of concurrent downloads (default MAX_CONCURRENT_DOWNLOADS)")
+	copyCmd.Flags().Bool("keep-staging", false, "keep the staging directory of the copy for debugging (default KEEP_STAGING_DIRS)")
+	copyCmd.Flags().StringP("output", "o", outputText, "progress output, text or json")
+	copyCmd.Flags().Bool("force", false, "copy the image even if it was published before")
+	copyCmd.Flags().Bool("only-hash", false, "print the CID the image would have without storing or recording it")
+	copyCmd.Flags().Int("cid-version", 0, "CID version of the added image, 0 or 1 (default IPFS_CID_VERSION or 1)")
+	copyCmd.Flags().Bool("raw-leaves", false, "store the file contents in raw blocks (default IPFS_RAW_LEAVES, or true for CIDv1)")
+	copyCmd.Flags().String("chunker", "", "chunker of the files, e.g. size-262144, rabin or buzhash (default IPFS_CHUNKER or size-262144)")
+	copyCmd.Flags().String("hash", "", "hash function of the CIDs, e.g. sha2-256 or blake3 (default IPFS_HASH or sha2-256)")
+	copyCmd.Flags().Bool("inline", false, "inline small blocks into their CIDs (default IPFS_INLINE)")
+	copyCmd.Flags().Int("inline-limit", 0, "maximum size of an inlined block in bytes (default IPFS_INLINE_LIMIT or 32)")
+	copyCmd.Flags().StringSlice("platform", nil, "copy only the given platforms, e.g. linux/amd64 or linux/arm* (repeatable)")
 	rootCmd.AddCommand(copyCmd)
 }
@@ -0,0 +1,231 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	registry "github.com/akakream/MultiPlatform2IPFS/internal/registry"
+	"github.com/akakream/MultiPlatform2IPFS/internal/store"
+)
+
+const (
+	// outputText shows the progress of a copy as a progress bar.
+	outputText = "text"
+	// outputJSON writes the progress events of a copy as JSON lines.
+	outputJSON = "json"
+
+	// barWidth is the number of characters of a progress bar.
+	barWidth = 30
+	// redrawInterval limits how often the progress bar is drawn.
+	redrawInterval = 100 * time.Millisecond
+)
+
+// ErrInvalidOutput is error for when the output format is unknown
+var ErrInvalidOutput = errors.New("--output must be text or json")
+
+// progressOutput shows the progress, the messages and the result of a copy.
+type progressOutput interface {
+	update(progress registry.Progress)
+	// messages returns the writer of the messages of the copy.
+	messages() io.Writer
+	result(image store.Image)
+	close()
+}
+
+// newProgressOutput returns the output of the format. The text output only
+// draws a progress bar when stderr is a terminal.
+func newProgressOutput(format string) (progressOutput, error) {
+	switch format {
+	case outputText:
+		if !isTerminal(os.Stderr) {
+			return noOutput{}, nil
+		}
+		return &barOutput{}, nil
+	case outputJSON:
+		return newJSONOutput(), nil
+	}
+	return nil, ErrInvalidOutput
+}
+
+// isTerminal reports whether the file is a terminal.
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// noOutput shows nothing besides the messages of the copy on stdout.
+type noOutput struct{}
+
+func (noOutput) update(registry.Progress) {}
+func (noOutput) messages() io.Writer      { return os.Stdout }
+func (noOutput) result(store.Image)       {}
+func (noOutput) close()                   {}
+
+// outputEvent is a line of the JSON output.
+type outputEvent struct {
+	Event string `json:"event"`
+	Data  any    `json:"data"`
+}
+
+// jsonOutput writes every progress event and the result as a JSON line to
+// stdout. The messages of the copy go to stderr, so stdout only has the
+// events.
+type jsonOutput struct {
+	encoder *json.Encoder
+}
+
+func newJSONOutput() *jsonOutput {
+	return &jsonOutput{encoder: json.NewEncoder(os.Stdout)}
+}
+
+func (o *jsonOutput) update(progress registry.Progress) {
+	o.encoder.Encode(outputEvent{Event: string(progress.Event), Data: progress})
+}
+
+func (o *jsonOutput) messages() io.Writer { return os.Stderr }
+
+func (o *jsonOutput) result(image store.Image) {
+	o.encoder.Encode(outputEvent{Event: "result", Data: image})
+}
+
+func (o *jsonOutput) close() {}
+
+// barOutput draws the progress as a bar on the last line of the terminal.
+// The messages of the copy are printed above the bar.
+type barOutput struct {
+	mu    sync.Mutex
+	line  string
+	drawn bool
+	last  time.Time
+	blob  *registry.BlobProgress
+}
+
+func (o *barOutput) update(progress registry.Progress) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if progress.Blob != nil {
+		o.blob = progress.Blob
+	}
+	o.line = renderProgress(progress, o.blob)
+	if progress.Event != registry.EventPhase && time.Since(o.last) < redrawInterval {
+		return
+	}
+	o.last = time.Now()
+	o.clear()
+	o.draw()
+}
+
+func (o *barOutput) messages() io.Writer { return barMessageWriter{o} }
+
+func (o *barOutput) result(store.Image) {}
+
+// close keeps the last state of the bar.
+func (o *barOutput) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.clear()
+	if o.line != "" {
+		fmt.Fprintln(os.Stderr, o.line)
+	}
+}
+
+// clear removes the bar. The caller holds o.mu.
+func (o *barOutput) clear() {
+	if o.drawn {
+		fmt.Fprint(os.Stderr, "\r\x1b[2K")
+		o.drawn = false
+	}
+}
+
+// draw draws the bar. The caller holds o.mu.
+func (o *barOutput) draw() {
+	if o.line != "" {
+		fmt.Fprint(os.Stderr, o.line)
+		o.drawn = true
+	}
+}
+
+// barMessageWriter prints the messages of the copy above the bar.
+type barMessageWriter struct {
+	output *barOutput
+}
+
+func (w barMessageWriter) Write(p []byte) (int, error) {
+	w.output.mu.Lock()
+	defer w.output.mu.Unlock()
+	w.output.clear()
+	os.Stderr.Write(p)
+	w.output.draw()
+	return len(p), nil
+}
+
+// renderProgress returns the progress bar line of the progress. blob is the
+// blob that was downloaded last, or nil.
+func renderProgress(progress registry.Progress, blob *registry.BlobProgress) string {
+	switch progress.Phase {
+	case registry.PhaseDownloading:
+		line := fmt.Sprintf(
+			"downloading %s %s / %s, %d/%d downloads",
+			renderBar(progress.DownloadedBytes, progress.DownloadTotalBytes),
+			formatBytes(progress.DownloadedBytes),
+			formatBytes(progress.DownloadTotalBytes),
+			progress.Completed,
+			progress.Total,
+		)
+		if blob != nil && blob.Downloaded < blob.Total {
+			digest := blob.Digest
+			if i := strings.Index(digest, ":"); i != -1 && len(digest) > i+13 {
+				digest = digest[i+1 : i+13]
+			}
+			line += fmt.Sprintf(", %s %s / %s", digest, formatBytes(blob.Downloaded), formatBytes(blob.Total))
+		}
+		return line
+	case registry.PhaseUploading:
+		return fmt.Sprintf(
+			"uploading   %s %s / %s",
+			renderBar(progress.UploadedBytes, progress.UploadTotalBytes),
+			formatBytes(progress.UploadedBytes),
+			formatBytes(progress.UploadTotalBytes),
+		)
+	case registry.PhasePinning:
+		return "pinning..."
+	}
+	return ""
+}
+
+// renderBar returns a bar such as [=======>      ]  50%.
+func renderBar(done int64, total int64) string {
+	percent := 0
+	if total > 0 {
+		percent = int(done * 100 / total)
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	filled := percent * barWidth / 100
+	bar := strings.Repeat("=", filled)
+	if filled < barWidth {
+		bar += ">" + strings.Repeat(" ", barWidth-filled-1)
+	}
+	return fmt.Sprintf("[%s] %3d%%", bar, percent)
+}
+
+// formatBytes returns a size such as 12.3 MB.
+func formatBytes(size int64) string {
+	const unit = 1000
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value, exponent := float64(size)/unit, 0
+	for value >= unit && exponent < 3 {
+		value /= unit
+		exponent++
+	}
+	return fmt.Sprintf("%.1f %cB", value, "kMGT"[exponent])
+}
@@ -4,9 +4,29 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"context"
+	"errors"
+	"net"
 	"os"
 
 	"github.com/spf13/cobra"
+
+	registry "github.com/akakream/MultiPlatform2IPFS/internal/registry"
+	"github.com/akakream/MultiPlatform2IPFS/utils"
+)
+
+// Exit codes of the CLI. They let scripts tell a wrong image name apart from
+// a registry outage.
+const (
+	exitFailure         = 1
+	exitUnauthorized    = 3
+	exitDenied          = 4
+	exitNotFound        = 5
+	exitTooManyRequests = 6
+	exitUnavailable     = 7
+	// exitInterrupted is the exit code of a copy cancelled with Ctrl-C, as
+	// shells report a process ended by SIGINT.
+	exitInterrupted = 130
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -18,6 +38,9 @@ to IPFS.`,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	// Run: func(cmd *cobra.Command, args []string) { },
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return utils.LoadEnv()
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -25,8 +48,33 @@ to IPFS.`,
 func Execute() {
 	err := rootCmd.Execute()
 	if err != nil {
-		os.Exit(1)
+		os.Exit(exitCode(err))
+	}
+}
+
+// exitCode returns the exit code of the error.
+func exitCode(err error) int {
+	var statusErr *registry.StatusError
+	var verificationErr *registry.VerificationError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted
+	case errors.Is(err, registry.ErrUnauthorized):
+		return exitUnauthorized
+	case errors.Is(err, registry.ErrDenied):
+		return exitDenied
+	case errors.Is(err, registry.ErrNameUnknown),
+		errors.Is(err, registry.ErrManifestUnknown),
+		errors.Is(err, registry.ErrBlobUnknown),
+		errors.Is(err, registry.ErrNoMatchingPlatform):
+		return exitNotFound
+	case errors.Is(err, registry.ErrTooManyRequests):
+		return exitTooManyRequests
+	case errors.As(err, &statusErr), errors.As(err, &verificationErr), errors.As(err, &netErr):
+		return exitUnavailable
 	}
+	return exitFailure
 }
 
 func init() {
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	registry "github.com/akakream/MultiPlatform2IPFS/internal/registry"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"unauthorized", &registry.StatusError{StatusCode: 401}, exitUnauthorized},
+		{"denied", &registry.StatusError{StatusCode: 403, Errors: []registry.ErrorDetail{{Code: "DENIED"}}}, exitDenied},
+		{"manifest unknown", &registry.StatusError{URL: "https://r/v2/a/manifests/x", StatusCode: 404}, exitNotFound},
+		{"blob unknown", &registry.StatusError{URL: "https://r/v2/a/blobs/sha256:a", StatusCode: 404}, exitNotFound},
+		{"no matching platform", fmt.Errorf("%w: windows", registry.ErrNoMatchingPlatform), exitNotFound},
+		{"too many requests", &registry.StatusError{StatusCode: 429}, exitTooManyRequests},
+		{"registry outage", &registry.StatusError{StatusCode: 502}, exitUnavailable},
+		{"corrupt download", &registry.VerificationError{}, exitUnavailable},
+		{"network error", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, exitUnavailable},
+		{"interrupted", fmt.Errorf("copy: %w", context.Canceled), exitInterrupted},
+		{"other", errors.New("disk full"), exitFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
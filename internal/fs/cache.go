@@ -2,164 +2,204 @@ package fs
 
 import (
 	"encoding/json"
-	"errors"
-	"fmt"
-	"log"
-	"net/http"
 	"os"
-	"strings"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/akakream/MultiPlatform2IPFS/utils"
+)
+
+const (
+	// appName is the name of the directories under $XDG_CACHE_HOME and $XDG_DATA_HOME.
+	appName = "multiplatform2ipfs"
+	// defaultTokenLifetime is the lifetime of tokens whose response has no expires_in, as in the token spec.
+	defaultTokenLifetime = 60 * time.Second
+	// tokenExpiryMargin keeps a token from being used right before it expires.
+	tokenExpiryMargin = 10 * time.Second
 )
 
+// TokenStore is the content of the token cache file.
 type TokenStore struct {
-	Tokens []TokenItem
+	Tokens []TokenItem `json:"tokens"`
+}
+
+// TokenKey identifies a token. Tokens are only valid for the registry,
+// repository and scope they were issued for. Account keeps the tokens of
+// different users of the same repository apart.
+type TokenKey struct {
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+	Scope      string `json:"scope"`
+	Account    string `json:"account,omitempty"`
 }
 
 type TokenItem struct {
-	Repository string
-	Token      string
+	TokenKey
+	Token     string    `json:"token"`
+	ExpiresIn int       `json:"expires_in"`
+	IssuedAt  time.Time `json:"issued_at"`
 }
 
-const tokenPath = "cache/tokens.json"
+// TokenCache keeps registry tokens in memory and in a file shared by all
+// processes. Valid tokens are served from memory.
+type TokenCache struct {
+	path   string
+	mu     sync.Mutex
+	tokens map[TokenKey]TokenItem
+}
 
-func GetCachedToken(imageName string, imageTag string) (bool, string, error) {
-	if pathExists(tokenPath) {
-		token, err := getTokenFromCache(imageName)
-		if err != nil {
-			return false, "", nil
-		}
-		if isTokenValid(imageName, imageTag, token) {
-			return true, token, nil
-		}
-	} else {
-		if err := createTokenFile(); err != nil {
-			log.Fatalln(err)
-		}
+// NewTokenCache returns a cache backed by the file at path.
+func NewTokenCache(path string) *TokenCache {
+	return &TokenCache{
+		path:   path,
+		tokens: map[TokenKey]TokenItem{},
 	}
-
-	return false, "", nil
 }
 
-func FillCache(imageName string, token string) error {
-	if !pathExists(tokenPath) {
-		if err := createTokenFile(); err != nil {
-			log.Fatalln(err)
-		}
+// TokenCachePath returns the path of the token cache file. It is TOKEN_CACHE_PATH
+// if set, otherwise tokens.json in the cache directory.
+func TokenCachePath() (string, error) {
+	path, err := utils.GetEnv("TOKEN_CACHE_PATH", "")
+	if err != nil {
+		return "", err
 	}
-
-	tokens, err := readTokensFromCache()
+	if path != "" {
+		return path, nil
+	}
+	dir, err := CacheDir()
 	if err != nil {
-		return err
+		return "", err
 	}
+	return filepath.Join(dir, "tokens.json"), nil
+}
 
-	repoExists, repoIndex := repositoryIsInCache(imageName, tokens)
-	if repoExists {
-		tokens.Tokens[repoIndex].Token = token // renew the token
-	} else {
-		addTokenToCache(imageName, token, tokens)
+// CacheDir returns the cache directory of the tool, $XDG_CACHE_HOME/multiplatform2ipfs
+// or ~/.cache/multiplatform2ipfs if XDG_CACHE_HOME is not set.
+func CacheDir() (string, error) {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, appName), nil
 	}
-	writeTokensToCache(*tokens)
-	return nil
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".cache", appName), nil
 }
 
-func addTokenToCache(imageName string, token string, tokens *TokenStore) {
-	// create the repository in the file and save token
-	newToken := TokenItem{Repository: imageName, Token: token}
-	updatedTokens := append(tokens.Tokens, newToken)
-	tokens.Tokens = updatedTokens
+// DataDir returns the data directory of the tool, $XDG_DATA_HOME/multiplatform2ipfs
+// or ~/.local/share/multiplatform2ipfs if XDG_DATA_HOME is not set.
+func DataDir() (string, error) {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, appName), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "share", appName), nil
 }
 
-func repositoryIsInCache(imageName string, tokens *TokenStore) (bool, int) {
-	if len(tokens.Tokens) > 0 {
-		for index, repo := range tokens.Tokens {
-			if imageName == repo.Repository {
-				return true, index
-			}
-		}
+// Get returns a token for the key that is not expired. The cache file is
+// only read when there is no valid token in memory.
+func (c *TokenCache) Get(key TokenKey) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if item, ok := c.tokens[key]; ok && item.valid() {
+		return item.Token, true
 	}
-	return false, -1
-}
 
-func pathExists(path string) bool {
-	_, err := os.Stat(path)
-	if os.IsNotExist(err) {
-		fmt.Printf("File does not exist\n")
-		return false
+	// Another process may have fetched the token in the meantime
+	tokens, err := c.read()
+	if err != nil {
+		return "", false
+	}
+	c.merge(tokens)
+	if item, ok := c.tokens[key]; ok && item.valid() {
+		return item.Token, true
 	}
-	fmt.Printf("File exists\n")
-	return true
+	return "", false
 }
 
-func createTokenFile() error {
-	_, err := os.Create(tokenPath)
+// Put stores the token in memory and in the cache file. expiresIn is in seconds.
+func (c *TokenCache) Put(key TokenKey, token string, expiresIn int, issuedAt time.Time) error {
+	if issuedAt.IsZero() {
+		issuedAt = time.Now()
+	}
+	item := TokenItem{TokenKey: key, Token: token, ExpiresIn: expiresIn, IssuedAt: issuedAt}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokens[key] = item
+
+	if err := CreateDir(filepath.Dir(c.path)); err != nil {
+		return err
+	}
+	unlock, err := LockFile(c.path)
 	if err != nil {
 		return err
 	}
-	return nil
-}
+	defer unlock()
 
-func getTokenFromCache(imageNameTag string) (string, error) {
-	tokens, err := readTokensFromCache()
+	tokens, err := c.read()
 	if err != nil {
-		return "", err
+		return err
 	}
-	repoExists, repoIndex := repositoryIsInCache(imageNameTag, tokens)
-	if repoExists {
-		return tokens.Tokens[repoIndex].Token, nil
+	c.merge(tokens)
+	c.tokens[key] = item
+
+	var store TokenStore
+	for _, item := range c.tokens {
+		if !item.expired() {
+			store.Tokens = append(store.Tokens, item)
+		}
+	}
+	data, err := json.Marshal(store)
+	if err != nil {
+		return err
 	}
-	return "", errors.New("token could not be fetched from the cache")
+	return WriteFileAtomic(c.path, data, 0600)
 }
 
-func readTokensFromCache() (*TokenStore, error) {
-	// read File
-	file, err := os.ReadFile(tokenPath)
+// read returns the tokens of the cache file. A missing or corrupt file is an empty cache.
+func (c *TokenCache) read() ([]TokenItem, error) {
+	file, err := os.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	var tokens TokenStore
-	// If error, the file is empty
-	if err := json.Unmarshal(file, &tokens); err != nil {
-		return &tokens, nil
+	var store TokenStore
+	if err := json.Unmarshal(file, &store); err != nil {
+		return nil, nil
 	}
-
-	return &tokens, nil
+	return store.Tokens, nil
 }
 
-func writeTokensToCache(tokens TokenStore) {
-	tokenStoreMarshalled, err := json.Marshal(tokens)
-	if err != nil {
-		log.Fatalln("The token could not updated.")
-	}
-	if err := os.WriteFile(tokenPath, tokenStoreMarshalled, 0644); err != nil {
-		log.Fatalln("Could not write to cache/tokens.json")
+// merge adds the tokens to the memory cache unless it holds a newer token for the same key.
+func (c *TokenCache) merge(tokens []TokenItem) {
+	for _, item := range tokens {
+		if existing, ok := c.tokens[item.TokenKey]; !ok || item.IssuedAt.After(existing.IssuedAt) {
+			c.tokens[item.TokenKey] = item
+		}
 	}
 }
 
-func isTokenValid(imageName string, imageTag string, token string) bool {
-	acceptList := [7]string{
-		"application/vnd.docker.distribution.manifest.v1+json",
-		"application/vnd.docker.distribution.manifest.v2+json",
-		"application/vnd.docker.distribution.manifest.list.v2+json",
-		"application/vnd.docker.container.image.v1+json",
-		"application/vnd.docker.image.rootfs.diff.tar.gzip",
-		"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip",
-		"application/vnd.docker.plugin.v1+json",
+func (i TokenItem) expiresAt() time.Time {
+	lifetime := time.Duration(i.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		lifetime = defaultTokenLifetime
 	}
+	return i.IssuedAt.Add(lifetime)
+}
 
-	url := "https://registry-1.docker.io/v2/library/" + imageName + "/manifests/" + imageTag
-
-	client := &http.Client{}
-	req, _ := http.NewRequest("HEAD", url, nil)
-	req.Header.Set("Accept", strings.Join(acceptList[:], ", "))
-	req.Header.Set("Authorization", "Bearer "+token)
-
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Fatalln(err)
-	}
+func (i TokenItem) expired() bool {
+	return !time.Now().Before(i.expiresAt())
+}
 
-	if resp.StatusCode != http.StatusOK {
-		fmt.Println("Non-OK HTTP status:", resp.StatusCode)
-		return false
-	}
-	return true
+// valid reports whether the token can still be used for a request.
+func (i TokenItem) valid() bool {
+	return time.Now().Add(tokenExpiryMargin).Before(i.expiresAt())
 }
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"io"
 	"os"
+	"path/filepath"
 )
 
 func SaveJson(data any, filename string) error {
@@ -38,6 +39,49 @@ func CreateDirs(paths []string) error {
 	return nil
 }
 
+// LinkFile hard links destination to source. The file is copied if it can not be linked.
+func LinkFile(source string, destination string) error {
+	if err := os.Link(source, destination); err == nil || os.IsExist(err) {
+		return nil
+	}
+	return copyFile(source, destination)
+}
+
+func copyFile(source string, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// MoveFile renames source to destination. The file is copied if it can not
+// be renamed, e.g. because they are on different file systems.
+func MoveFile(source string, destination string) error {
+	if err := os.Rename(source, destination); err == nil {
+		return nil
+	}
+	tmp := destination + ".tmp"
+	if err := copyFile(source, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, destination); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(source)
+}
+
 func Sha256izeString(input string) string {
 	h := sha256.New()
 	h.Write([]byte(input))
@@ -59,3 +103,18 @@ func Sha256File(path string) (string, error) {
 
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
+
+// DirSize returns the total size of the regular files under path.
+func DirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
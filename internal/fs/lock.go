@@ -0,0 +1,110 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrLockTimeout is error for when a file lock could not be acquired in time
+var ErrLockTimeout = errors.New("timed out waiting for the file lock")
+
+const (
+	lockRetryInterval = 20 * time.Millisecond
+	lockTimeout       = 10 * time.Second
+)
+
+// LockFile acquires an exclusive lock for path, the advisory lock of
+// path.lock that TryLockFile takes. It waits up to lockTimeout for the lock.
+// The lock is shared between processes and held until the returned function
+// is called or its process dies, however long a write under it takes.
+func LockFile(path string) (func(), error) {
+	if err := CreateDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		unlock, locked, err := TryLockFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if locked {
+			return unlock, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w: %s.lock", ErrLockTimeout, path)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// WriteFileAtomic writes data to a temporary file next to filename and
+// renames it into place, so readers never see a partially written file.
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// TryLockFile acquires the lock of path like LockFile but does not wait for
+// it. It reports false if another running process holds the lock. The lock
+// is an advisory lock of path.lock, which the kernel releases when its
+// process dies, so the lock of a crashed process is never held, even if a
+// new process got its pid, as in a restarted container.
+func TryLockFile(path string) (func(), bool, error) {
+	lockPath := path + ".lock"
+	for {
+		file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil {
+			return nil, false, err
+		}
+		locked, err := lockFile(file)
+		if err != nil || !locked {
+			file.Close()
+			return nil, false, err
+		}
+
+		// The holder removes the lock file before it releases the lock, so
+		// the file we locked may be gone by now. Its lock does not count.
+		opened, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, false, err
+		}
+		current, err := os.Stat(lockPath)
+		if err == nil && os.SameFile(opened, current) {
+			// The pid is only written for debugging
+			file.Truncate(0)
+			fmt.Fprintf(file, "%d", os.Getpid())
+			return func() {
+				os.Remove(lockPath)
+				file.Close()
+			}, true, nil
+		}
+		file.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, false, err
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package fs
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTryLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+
+	unlock, locked, err := TryLockFile(path)
+	if err != nil || !locked {
+		t.Fatalf("TryLockFile() = %v, %v, want the lock", locked, err)
+	}
+	if _, locked, err := TryLockFile(path); err != nil || locked {
+		t.Fatalf("TryLockFile() of a held lock = %v, %v, want false", locked, err)
+	}
+
+	unlock()
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("unlock() left the lock file behind: %v", err)
+	}
+	unlock, locked, err = TryLockFile(path)
+	if err != nil || !locked {
+		t.Fatalf("TryLockFile() after unlock() = %v, %v, want the lock", locked, err)
+	}
+	unlock()
+}
+
+func TestLockFileExcludes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dir", "store.json")
+
+	var mu sync.Mutex
+	holders, maxHolders := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := LockFile(path)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			holders++
+			if holders > maxHolders {
+				maxHolders = holders
+			}
+			mu.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			mu.Lock()
+			holders--
+			mu.Unlock()
+			unlock()
+		}()
+	}
+	wg.Wait()
+	if maxHolders != 1 {
+		t.Errorf("LockFile() was held %d times at once, want 1", maxHolders)
+	}
+}
+
+// TestLockHelperProcess is not a test. It holds the lock of LOCK_HELPER_PATH
+// for TestTryLockFileOfDeadProcess until it is killed.
+func TestLockHelperProcess(t *testing.T) {
+	path := os.Getenv("LOCK_HELPER_PATH")
+	if path == "" {
+		return
+	}
+	if _, locked, err := TryLockFile(path); err != nil || !locked {
+		os.Exit(1)
+	}
+	os.Stdout.WriteString("locked\n")
+	time.Sleep(time.Minute)
+	os.Exit(0)
+}
+
+func TestTryLockFileOfDeadProcess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLockHelperProcess$")
+	cmd.Env = append(os.Environ(), "LOCK_HELPER_PATH="+path)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != "locked\n" {
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Fatalf("helper process did not take the lock: %q, %v", line, err)
+	}
+
+	if _, locked, err := TryLockFile(path); err != nil || locked {
+		t.Fatalf("TryLockFile() of a lock of a live process = %v, %v, want false", locked, err)
+	}
+
+	// The process dies without unlocking, its lock file stays behind
+	cmd.Process.Kill()
+	cmd.Wait()
+	unlock, locked, err := TryLockFile(path)
+	if err != nil || !locked {
+		t.Fatalf("TryLockFile() of a lock of a dead process = %v, %v, want the lock", locked, err)
+	}
+	unlock()
+}
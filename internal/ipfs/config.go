@@ -0,0 +1,294 @@
+package ipfs
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+
+	"github.com/akakream/MultiPlatform2IPFS/utils"
+)
+
+// ErrInvalidAddOptions is error for when the add options are not supported
+var ErrInvalidAddOptions = errors.New("invalid add options")
+
+// DefaultAPI is the address of the API of a local IPFS node.
+const DefaultAPI = "/ip4/127.0.0.1/tcp/5001"
+
+// defaultTimeout limits the short requests of the API, such as the check of
+// a pin.
+const defaultTimeout = 30 * time.Second
+
+// Config configures the client of the API of an IPFS node.
+type Config struct {
+	// API is the multiaddr of the API, e.g. /ip4/127.0.0.1/tcp/5001 or
+	// /unix/run/ipfs.sock, or its URL, e.g. https://ipfs.example.com:5001.
+	// It defaults to DefaultAPI.
+	API string
+	// Headers are sent with every request, e.g. an Authorization header.
+	Headers map[string]string
+	// Username and Password authenticate every request with basic auth if
+	// Username is set.
+	Username string
+	Password string
+	// Timeout limits every request but adding and pinning, which may take
+	// long for large images. 0 means no limit.
+	Timeout time.Duration
+	// Add configures how images are added.
+	Add AddOptions
+}
+
+// AddOptions configure how a directory is added to IPFS. The same content
+// added with different options has a different CID.
+type AddOptions struct {
+	// CidVersion is the version of the CIDs, 0 or 1.
+	CidVersion int `json:"cidVersion"`
+	// RawLeaves stores the content of the files in raw blocks instead of
+	// UnixFS leaves.
+	RawLeaves bool `json:"rawLeaves"`
+	// Chunker splits the files into blocks, e.g. size-262144, rabin,
+	// rabin-min-avg-max or buzhash.
+	Chunker string `json:"chunker"`
+	// Hash is the hash function of the CIDs, e.g. sha2-256 or blake3.
+	Hash string `json:"hash"`
+	// Inline stores blocks up to InlineLimit bytes in their CID.
+	Inline      bool `json:"inline"`
+	InlineLimit int  `json:"inlineLimit"`
+}
+
+// DefaultAddOptions are the add options when none are configured. They are
+// the defaults of Kubo for CIDv1.
+var DefaultAddOptions = AddOptions{
+	CidVersion:  1,
+	RawLeaves:   true,
+	Chunker:     "size-262144",
+	Hash:        "sha2-256",
+	InlineLimit: 32,
+}
+
+// AddOverrides change some of the AddOptions. Nil fields keep the option.
+type AddOverrides struct {
+	CidVersion  *int    `json:"cidVersion,omitempty"`
+	RawLeaves   *bool   `json:"rawLeaves,omitempty"`
+	Chunker     *string `json:"chunker,omitempty"`
+	Hash        *string `json:"hash,omitempty"`
+	Inline      *bool   `json:"inline,omitempty"`
+	InlineLimit *int    `json:"inlineLimit,omitempty"`
+}
+
+// With returns the options changed by the overrides. Like Kubo, a CID
+// version without raw leaves uses raw leaves for CIDv1 only.
+func (o AddOptions) With(overrides AddOverrides) (AddOptions, error) {
+	if overrides.CidVersion != nil {
+		o.CidVersion = *overrides.CidVersion
+		o.RawLeaves = o.CidVersion == 1
+	}
+	if overrides.RawLeaves != nil {
+		o.RawLeaves = *overrides.RawLeaves
+	}
+	if overrides.Chunker != nil {
+		o.Chunker = *overrides.Chunker
+	}
+	if overrides.Hash != nil {
+		o.Hash = *overrides.Hash
+	}
+	if overrides.Inline != nil {
+		o.Inline = *overrides.Inline
+	}
+	if overrides.InlineLimit != nil {
+		o.InlineLimit = *overrides.InlineLimit
+	}
+	return o, o.Validate()
+}
+
+// Validate checks the options.
+func (o AddOptions) Validate() error {
+	if o.CidVersion != 0 && o.CidVersion != 1 {
+		return fmt.Errorf("%w: the CID version must be 0 or 1, got %d", ErrInvalidAddOptions, o.CidVersion)
+	}
+	if err := validateChunker(o.Chunker); err != nil {
+		return err
+	}
+	if _, ok := multihash.Names[o.Hash]; !ok {
+		return fmt.Errorf("%w: unknown hash function %q", ErrInvalidAddOptions, o.Hash)
+	}
+	if o.CidVersion == 0 && o.Hash != "sha2-256" {
+		return fmt.Errorf("%w: CIDv0 only supports sha2-256, got %q", ErrInvalidAddOptions, o.Hash)
+	}
+	if o.InlineLimit <= 0 {
+		return fmt.Errorf("%w: the inline limit must be positive, got %d", ErrInvalidAddOptions, o.InlineLimit)
+	}
+	return nil
+}
+
+// validateChunker checks a chunker such as size-262144, rabin,
+// rabin-262144, rabin-min-avg-max or buzhash.
+func validateChunker(chunker string) error {
+	invalid := fmt.Errorf("%w: the chunker must be size-<bytes>, rabin, rabin-<avg>, rabin-<min>-<avg>-<max> or buzhash, got %q", ErrInvalidAddOptions, chunker)
+	parts := strings.Split(chunker, "-")
+	sizes := parts[1:]
+	switch parts[0] {
+	case "size":
+		if len(sizes) != 1 {
+			return invalid
+		}
+	case "rabin":
+		if len(sizes) != 0 && len(sizes) != 1 && len(sizes) != 3 {
+			return invalid
+		}
+	case "buzhash":
+		if len(sizes) != 0 {
+			return invalid
+		}
+	default:
+		return invalid
+	}
+	for _, size := range sizes {
+		if n, err := strconv.Atoi(size); err != nil || n <= 0 {
+			return invalid
+		}
+	}
+	return nil
+}
+
+// LoadConfig returns the configuration of the client, read from IPFS_API,
+// IPFS_API_HEADERS, IPFS_USERNAME, IPFS_PASSWORD and IPFS_TIMEOUT, with the
+// add options of IPFS_CID_VERSION, IPFS_RAW_LEAVES, IPFS_CHUNKER, IPFS_HASH,
+// IPFS_INLINE and IPFS_INLINE_LIMIT.
+func LoadConfig() (Config, error) {
+	config := Config{API: DefaultAPI, Timeout: defaultTimeout, Add: DefaultAddOptions}
+
+	settings := []struct {
+		name  string
+		value *string
+	}{
+		{"IPFS_API", &config.API},
+		{"IPFS_USERNAME", &config.Username},
+		{"IPFS_PASSWORD", &config.Password},
+	}
+	for _, setting := range settings {
+		value, err := utils.GetEnv(setting.name, "")
+		if err != nil {
+			return Config{}, err
+		}
+		if value != "" {
+			*setting.value = value
+		}
+	}
+
+	headers, err := utils.GetEnv("IPFS_API_HEADERS", "")
+	if err != nil {
+		return Config{}, err
+	}
+	config.Headers, err = parseHeaders(headers)
+	if err != nil {
+		return Config{}, err
+	}
+
+	timeout, err := utils.GetEnv("IPFS_TIMEOUT", "")
+	if err != nil {
+		return Config{}, err
+	}
+	if timeout != "" {
+		config.Timeout, err = time.ParseDuration(timeout)
+		if err != nil || config.Timeout < 0 {
+			return Config{}, fmt.Errorf("IPFS_TIMEOUT must be a duration such as 30s or 0, got %q", timeout)
+		}
+	}
+
+	overrides, err := loadAddOverrides()
+	if err != nil {
+		return Config{}, err
+	}
+	config.Add, err = config.Add.With(overrides)
+	if err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// loadAddOverrides reads the add options that are set in the environment.
+func loadAddOverrides() (AddOverrides, error) {
+	var overrides AddOverrides
+	ints := []struct {
+		name  string
+		value **int
+	}{
+		{"IPFS_CID_VERSION", &overrides.CidVersion},
+		{"IPFS_INLINE_LIMIT", &overrides.InlineLimit},
+	}
+	for _, setting := range ints {
+		value, err := utils.GetEnv(setting.name, "")
+		if err != nil {
+			return AddOverrides{}, err
+		}
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return AddOverrides{}, fmt.Errorf("%s must be a number, got %q", setting.name, value)
+		}
+		*setting.value = &n
+	}
+
+	bools := []struct {
+		name  string
+		value **bool
+	}{
+		{"IPFS_RAW_LEAVES", &overrides.RawLeaves},
+		{"IPFS_INLINE", &overrides.Inline},
+	}
+	for _, setting := range bools {
+		value, err := utils.GetEnv(setting.name, "")
+		if err != nil {
+			return AddOverrides{}, err
+		}
+		if value == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return AddOverrides{}, fmt.Errorf("%s must be true or false, got %q", setting.name, value)
+		}
+		*setting.value = &b
+	}
+
+	strs := []struct {
+		name  string
+		value **string
+	}{
+		{"IPFS_CHUNKER", &overrides.Chunker},
+		{"IPFS_HASH", &overrides.Hash},
+	}
+	for _, setting := range strs {
+		value, err := utils.GetEnv(setting.name, "")
+		if err != nil {
+			return AddOverrides{}, err
+		}
+		if value != "" {
+			*setting.value = &value
+		}
+	}
+	return overrides, nil
+}
+
+// parseHeaders parses headers such as "X-Api-Key: abc, X-Team: ops".
+func parseHeaders(value string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, header := range strings.Split(value, ",") {
+		if strings.TrimSpace(header) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(header, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("IPFS_API_HEADERS must be a list such as \"Name: value, Other: value\", got %q", header)
+		}
+		headers[name] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
@@ -0,0 +1,99 @@
+package ipfs
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAddOptionsWith(t *testing.T) {
+	intPtr := func(v int) *int { return &v }
+	boolPtr := func(v bool) *bool { return &v }
+	stringPtr := func(v string) *string { return &v }
+
+	tests := []struct {
+		name      string
+		overrides AddOverrides
+		want      AddOptions
+		wantErr   bool
+	}{
+		{name: "no overrides", want: DefaultAddOptions},
+		{
+			name:      "CIDv0 turns raw leaves off",
+			overrides: AddOverrides{CidVersion: intPtr(0)},
+			want:      AddOptions{CidVersion: 0, RawLeaves: false, Chunker: "size-262144", Hash: "sha2-256", InlineLimit: 32},
+		},
+		{
+			name:      "CIDv0 with raw leaves",
+			overrides: AddOverrides{CidVersion: intPtr(0), RawLeaves: boolPtr(true)},
+			want:      AddOptions{CidVersion: 0, RawLeaves: true, Chunker: "size-262144", Hash: "sha2-256", InlineLimit: 32},
+		},
+		{
+			name:      "CIDv1 without raw leaves",
+			overrides: AddOverrides{RawLeaves: boolPtr(false)},
+			want:      AddOptions{CidVersion: 1, RawLeaves: false, Chunker: "size-262144", Hash: "sha2-256", InlineLimit: 32},
+		},
+		{
+			name:      "every option",
+			overrides: AddOverrides{Chunker: stringPtr("buzhash"), Hash: stringPtr("blake3"), Inline: boolPtr(true), InlineLimit: intPtr(64)},
+			want:      AddOptions{CidVersion: 1, RawLeaves: true, Chunker: "buzhash", Hash: "blake3", Inline: true, InlineLimit: 64},
+		},
+		{name: "CIDv2", overrides: AddOverrides{CidVersion: intPtr(2)}, wantErr: true},
+		{name: "CIDv0 with another hash", overrides: AddOverrides{CidVersion: intPtr(0), Hash: stringPtr("blake3")}, wantErr: true},
+		{name: "unknown hash", overrides: AddOverrides{Hash: stringPtr("md4000")}, wantErr: true},
+		{name: "invalid chunker", overrides: AddOverrides{Chunker: stringPtr("size")}, wantErr: true},
+		{name: "zero inline limit", overrides: AddOverrides{InlineLimit: intPtr(0)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DefaultAddOptions.With(tt.overrides)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidAddOptions) {
+					t.Errorf("With() error = %v, want ErrInvalidAddOptions", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("With() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("With() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddOptionsValidateChunker(t *testing.T) {
+	tests := []struct {
+		chunker string
+		valid   bool
+	}{
+		{"size-262144", true},
+		{"size-1", true},
+		{"rabin", true},
+		{"rabin-262144", true},
+		{"rabin-131072-262144-524288", true},
+		{"buzhash", true},
+		{"", false},
+		{"size", false},
+		{"size-0", false},
+		{"size--1", false},
+		{"size-abc", false},
+		{"size-1-2", false},
+		{"rabin-1-2", false},
+		{"buzhash-1", false},
+		{"fixed-1024", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.chunker, func(t *testing.T) {
+			opts := DefaultAddOptions
+			opts.Chunker = tt.chunker
+			err := opts.Validate()
+			if tt.valid && err != nil {
+				t.Errorf("Validate() of chunker %q error = %v", tt.chunker, err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidAddOptions) {
+				t.Errorf("Validate() of chunker %q error = %v, want ErrInvalidAddOptions", tt.chunker, err)
+			}
+		})
+	}
+}
@@ -1,35 +1,266 @@
 package ipfs
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
+	gocid "github.com/ipfs/go-cid"
 	shell "github.com/ipfs/go-ipfs-api"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
 )
 
-// Add adds a directory to IPFS. If willPin is true, the added item is pinned.
-func Add(dirPath string, willPin bool) (string, error) {
-	// Where your local node is running on localhost:5001
-	sh := shell.NewShell("localhost:5001")
-	cid, err := sh.AddDir(dirPath, shell.CidVersion(1), shell.Pin(willPin))
+var (
+	// ErrNotPinned is error for when a CID that is not pinned is unpinned
+	ErrNotPinned = errors.New("not pinned")
+	// ErrInvalidCid is error for when a CID can not be parsed
+	ErrInvalidCid = errors.New("invalid CID")
+	// ErrInvalidAPI is error for when the address of the API can not be parsed
+	ErrInvalidAPI = errors.New("the IPFS API must be a multiaddr or a http(s) URL")
+)
+
+// Client talks to the API of an IPFS node. It is built once from a Config and
+// can be used concurrently.
+type Client struct {
+	// api is the URL of the API without the /api/v0 path.
+	api       string
+	transport http.RoundTripper
+	timeout   time.Duration
+	add       AddOptions
+}
+
+// NewClient returns a client of the API the config points to.
+func NewClient(config Config) (*Client, error) {
+	api := config.API
+	if api == "" {
+		api = DefaultAPI
+	}
+	base := &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		DisableKeepAlives: true,
+	}
+	api, err := resolveAPI(api, base)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := http.Header{}
+	for name, value := range config.Headers {
+		headers.Set(name, value)
+	}
+	var transport http.RoundTripper = base
+	if len(headers) > 0 || config.Username != "" {
+		transport = &authTransport{
+			base:     base,
+			headers:  headers,
+			username: config.Username,
+			password: config.Password,
+		}
+	}
+	return &Client{api: api, transport: transport, timeout: config.Timeout, add: config.Add}, nil
+}
+
+// resolveAPI returns the URL of the API at the multiaddr or URL. The
+// transport dials unix sockets for /unix multiaddrs.
+func resolveAPI(api string, transport *http.Transport) (string, error) {
+	if strings.HasPrefix(api, "/") {
+		addr, err := ma.NewMultiaddr(api)
+		if err != nil {
+			return "", fmt.Errorf("%w, got %q: %v", ErrInvalidAPI, api, err)
+		}
+		network, host, err := manet.DialArgs(addr)
+		if err != nil {
+			return "", fmt.Errorf("%w, got %q: %v", ErrInvalidAPI, api, err)
+		}
+		if network == "unix" {
+			transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", host)
+			}
+			return "http://unix", nil
+		}
+		if !strings.HasPrefix(network, "tcp") {
+			return "", fmt.Errorf("%w, got %q: it has no tcp port", ErrInvalidAPI, api)
+		}
+		scheme := "http"
+		if _, err := addr.ValueForProtocol(ma.P_HTTPS); err == nil {
+			scheme = "https"
+		}
+		return scheme + "://" + host, nil
+	}
+
+	if !strings.Contains(api, "://") {
+		api = "http://" + api
+	}
+	parsed, err := url.Parse(api)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", fmt.Errorf("%w, got %q", ErrInvalidAPI, api)
+	}
+	return strings.TrimSuffix(parsed.String(), "/"), nil
+}
+
+// authTransport adds the configured headers and basic auth to every request.
+type authTransport struct {
+	base     http.RoundTripper
+	headers  http.Header
+	username string
+	password string
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, values := range t.headers {
+		req.Header[name] = values
+	}
+	if t.username != "" {
+		req.SetBasicAuth(t.username, t.password)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// contextTransport sends every request of the shell with its context. The
+// shell itself sends some requests, such as the one of AddDir, without one.
+// If sent is set, it is called with the bytes of the request bodies sent so far.
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+	sent func(int64)
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.WithContext(t.ctx)
+	if t.sent != nil && req.Body != nil {
+		req.Body = &countingReader{ReadCloser: req.Body, report: t.sent}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// countingReader reports the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	read   int64
+	report func(int64)
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.read += int64(n)
+		r.report(r.read)
+	}
+	return n, err
+}
+
+// shell returns a shell whose requests are cancelled with ctx and that
+// reports the bytes it sent to sent, which may be nil.
+func (c *Client) shell(ctx context.Context, sent func(int64)) *shell.Shell {
+	client := &http.Client{
+		Transport: &contextTransport{ctx: ctx, base: c.transport, sent: sent},
+	}
+	return shell.NewShellWithClient(c.api, client)
+}
+
+// withTimeout limits ctx with the timeout of the client.
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.timeout)
+}
+
+// ParseCid checks that value is a CID and returns it in its string form.
+func ParseCid(value string) (string, error) {
+	parsed, err := gocid.Decode(value)
+	if err != nil {
+		return "", fmt.Errorf("%w %q: %v", ErrInvalidCid, value, err)
+	}
+	return parsed.String(), nil
+}
+
+// AddOptions returns the configured add options.
+func (c *Client) AddOptions() AddOptions {
+	return c.add
+}
+
+// Add adds a directory to IPFS with the options and pins it recursively in
+// the same request, so the garbage collection of the node can not remove the
+// added blocks before they are pinned. If onlyHash is true, the CID is
+// computed but nothing is stored or pinned. Cancelling ctx stops the upload.
+// sent is called with the bytes sent to the daemon so far and may be nil.
+func (c *Client) Add(ctx context.Context, dirPath string, options AddOptions, onlyHash bool, sent func(int64)) (string, error) {
+	sh := c.shell(ctx, sent)
+	cid, err := sh.AddDir(
+		dirPath,
+		shell.Pin(!onlyHash),
+		shell.OnlyHash(onlyHash),
+		shell.CidVersion(options.CidVersion),
+		shell.RawLeaves(options.RawLeaves),
+		shell.Hash(options.Hash),
+		func(rb *shell.RequestBuilder) error {
+			rb.Option("chunker", options.Chunker)
+			rb.Option("inline", options.Inline)
+			rb.Option("inline-limit", options.InlineLimit)
+			return nil
+		},
+	)
 	if err != nil {
 		return "", err
 	}
-	fmt.Printf("added %s \n", cid)
 	return cid, nil
 }
 
-func Pin(cid string) error {
-	// Where your local node is running on localhost:5001
-	sh := shell.NewShell("localhost:5001")
-	err := sh.Pin(cid)
+// Pin pins cid. If recursive is false, only the block of cid is pinned and
+// not the blocks it links to.
+func (c *Client) Pin(ctx context.Context, cid string, recursive bool) error {
+	sh := c.shell(ctx, nil)
+	err := sh.Request("pin/add", cid).Option("recursive", recursive).Exec(ctx, nil)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// IsPinned reports whether cid is pinned recursively.
+func (c *Client) IsPinned(ctx context.Context, cid string) (bool, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	sh := c.shell(ctx, nil)
+	var pins struct{ Keys map[string]shell.PinInfo }
+	err := sh.Request("pin/ls", cid).Option("type", shell.RecursivePin).Exec(ctx, &pins)
 	if err != nil {
+		if strings.Contains(err.Error(), "not pinned") {
+			return false, nil
+		}
+		return false, err
+	}
+	return len(pins.Keys) > 0, nil
+}
+
+// Unpin removes the pin of cid. It returns ErrNotPinned if cid is not pinned.
+func (c *Client) Unpin(ctx context.Context, cid string) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	sh := c.shell(ctx, nil)
+	if err := sh.Request("pin/rm", cid).Option("recursive", true).Exec(ctx, nil); err != nil {
+		if strings.Contains(err.Error(), "not pinned") {
+			return fmt.Errorf("%w: %s", ErrNotPinned, cid)
+		}
 		return err
 	}
 	return nil
 }
 
-func DeamonIsUp() bool {
-	sh := shell.NewShell("localhost:5001")
-	deamonIsUp := sh.IsUp()
-	return deamonIsUp
+// IsUp reports whether the API answers.
+func (c *Client) IsUp(ctx context.Context) bool {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	_, _, err := c.shell(ctx, nil).Version()
+	return err == nil
 }
@@ -0,0 +1,217 @@
+package ipfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestClientAddPins(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.json"), []byte(`{"schemaVersion":2}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		onlyHash bool
+		wantPin  string
+	}{
+		{onlyHash: false, wantPin: "true"},
+		{onlyHash: true, wantPin: "false"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("onlyHash=%v", tt.onlyHash), func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if r.URL.Path != "/api/v0/add" {
+					t.Errorf("request to %s, want only /api/v0/add", r.URL.Path)
+				}
+				query := r.URL.Query()
+				if query.Get("pin") != tt.wantPin || query.Get("only-hash") != fmt.Sprint(tt.onlyHash) {
+					t.Errorf("add with pin=%q only-hash=%q, want pin=%s", query.Get("pin"), query.Get("only-hash"), tt.wantPin)
+				}
+				io.Copy(io.Discard, r.Body)
+				fmt.Fprintln(w, `{"Name":"dir/index.json","Hash":"bafyfile"}`)
+				fmt.Fprintln(w, `{"Name":"dir","Hash":"bafydir"}`)
+			}))
+			defer server.Close()
+
+			client, err := NewClient(Config{API: server.URL, Add: DefaultAddOptions})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sent int64
+			cid, err := client.Add(context.Background(), dir, DefaultAddOptions, tt.onlyHash, func(n int64) { sent = n })
+			if err != nil {
+				t.Fatalf("Add() error = %v", err)
+			}
+			if cid != "bafydir" {
+				t.Errorf("Add() = %q, want the CID of the directory", cid)
+			}
+			if requests != 1 {
+				t.Errorf("Add() sent %d requests, want 1", requests)
+			}
+			if sent == 0 {
+				t.Error("Add() did not report the sent bytes")
+			}
+		})
+	}
+}
+
+func TestResolveAPI(t *testing.T) {
+	tests := []struct {
+		api      string
+		want     string
+		wantUnix bool
+		wantErr  bool
+	}{
+		{api: "/ip4/127.0.0.1/tcp/5001", want: "http://127.0.0.1:5001"},
+		{api: "/ip6/::1/tcp/5001", want: "http://[::1]:5001"},
+		{api: "/dns4/ipfs.example.com/tcp/443/https", want: "https://ipfs.example.com:443"},
+		{api: "/dns/ipfs/tcp/5001/http", want: "http://ipfs:5001"},
+		{api: "/unix/run/ipfs.sock", want: "http://unix", wantUnix: true},
+		{api: "http://127.0.0.1:5001", want: "http://127.0.0.1:5001"},
+		{api: "https://ipfs.example.com:5001/", want: "https://ipfs.example.com:5001"},
+		{api: "https://ipfs.example.com/proxy", want: "https://ipfs.example.com/proxy"},
+		{api: "ipfs:5001", want: "http://ipfs:5001"},
+		{api: "/ip4/127.0.0.1/udp/5001", wantErr: true},
+		{api: "/ip4/127.0.0.1", wantErr: true},
+		{api: "/not/a/multiaddr", wantErr: true},
+		{api: "ftp://ipfs.example.com", wantErr: true},
+		{api: "http://", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.api, func(t *testing.T) {
+			transport := &http.Transport{}
+			got, err := resolveAPI(tt.api, transport)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveAPI() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, ErrInvalidAPI) {
+					t.Errorf("resolveAPI() error = %v, want ErrInvalidAPI", err)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("resolveAPI() = %q, want %q", got, tt.want)
+			}
+			if unix := transport.DialContext != nil; unix != tt.wantUnix {
+				t.Errorf("resolveAPI() dials a unix socket = %v, want %v", unix, tt.wantUnix)
+			}
+		})
+	}
+}
+
+func TestNewClientAuthentication(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     Config
+		wantHeader string
+		wantUser   string
+		wantPass   string
+	}{
+		{name: "no authentication"},
+		{name: "header", config: Config{Headers: map[string]string{"Authorization": "Bearer token"}}, wantHeader: "Bearer token"},
+		{name: "basic auth", config: Config{Username: "alice", Password: "s3cret"}, wantUser: "alice", wantPass: "s3cret"},
+		// Basic auth replaces a configured Authorization header
+		{
+			name:     "basic auth and header",
+			config:   Config{Headers: map[string]string{"authorization": "Bearer token"}, Username: "alice", Password: "s3cret"},
+			wantUser: "alice", wantPass: "s3cret",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *http.Request
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r
+				fmt.Fprintln(w, `{"Version":"0.20.0"}`)
+			}))
+			defer server.Close()
+
+			config := tt.config
+			config.API = server.URL
+			client, err := NewClient(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !client.IsUp(context.Background()) {
+				t.Fatal("IsUp() = false, want true")
+			}
+			user, pass, ok := got.BasicAuth()
+			if tt.wantUser != "" {
+				if !ok || user != tt.wantUser || pass != tt.wantPass {
+					t.Errorf("request basic auth = %q, %q, %v, want %q, %q", user, pass, ok, tt.wantUser, tt.wantPass)
+				}
+				return
+			}
+			if header := got.Header.Get("Authorization"); header != tt.wantHeader {
+				t.Errorf("request Authorization = %q, want %q", header, tt.wantHeader)
+			}
+		})
+	}
+}
+
+func TestNewClientTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient(Config{API: server.URL, Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if client.IsUp(context.Background()) {
+		t.Fatal("IsUp() of a node that does not answer = true")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("IsUp() returned after %s, want it to stop after the timeout", elapsed)
+	}
+}
+
+func TestNewClientUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the API listens on a unix socket")
+	}
+	// The path of a unix socket is short, t.TempDir() may be too long for it
+	dir, err := os.MkdirTemp("", "ipfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "api.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"Version":"0.20.0"}`)
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	client, err := NewClient(Config{API: "/unix" + socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !client.IsUp(context.Background()) {
+		t.Error("IsUp() of the API on a unix socket = false, want true")
+	}
+}
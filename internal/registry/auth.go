@@ -0,0 +1,138 @@
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrUnsupportedChallenge is error for when the registry asks for an authentication scheme we do not speak
+var ErrUnsupportedChallenge = errors.New("unsupported authentication challenge")
+
+// Credentials are used to authenticate against a registry.
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// IdentityToken is an OAuth2 refresh token as stored by docker login.
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// challenge is a single challenge of a WWW-Authenticate header, e.g.
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+type challenge struct {
+	Scheme string
+	Params map[string]string
+}
+
+// getChallenge makes an anonymous request for the manifest of the reference
+// and returns the challenge of the registry. It returns nil if the registry
+// allows anonymous access, that is if it answers with a 2xx status. Any other
+// status than 401 is returned as a *StatusError, so an outage of the registry
+// is not mistaken for anonymous access.
+func getChallenge(ctx context.Context, ref Reference) (*challenge, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", ref.manifestURL(ref.Reference()), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(acceptList[:], ", "))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return nil, newStatusError(resp)
+	}
+
+	challenges := parseChallenges(resp.Header.Values("WWW-Authenticate"))
+	for _, scheme := range []string{"bearer", "basic"} {
+		for _, c := range challenges {
+			if c.Scheme == scheme {
+				return &c, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedChallenge, resp.Header.Get("WWW-Authenticate"))
+}
+
+// parseChallenges parses WWW-Authenticate header values as described in RFC 7235.
+// A header value may hold several challenges separated by commas.
+func parseChallenges(headers []string) []challenge {
+	var challenges []challenge
+	for _, header := range headers {
+		s := header
+		for {
+			s = strings.TrimLeft(s, " ,")
+			if s == "" {
+				break
+			}
+
+			var token string
+			token, s = splitToken(s)
+			s = strings.TrimLeft(s, " ")
+			if !strings.HasPrefix(s, "=") && token != "" {
+				// A token not followed by "=" starts a new challenge
+				challenges = append(challenges, challenge{
+					Scheme: strings.ToLower(token),
+					Params: map[string]string{},
+				})
+				continue
+			}
+			if token == "" || len(challenges) == 0 {
+				// Malformed header, skip the rest of it
+				break
+			}
+
+			var value string
+			value, s = splitValue(strings.TrimLeft(s[1:], " "))
+			challenges[len(challenges)-1].Params[strings.ToLower(token)] = value
+		}
+	}
+	return challenges
+}
+
+// splitToken splits the leading token off s.
+func splitToken(s string) (string, string) {
+	i := strings.IndexAny(s, " ,=\"")
+	if i == -1 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+// splitValue splits the leading token or quoted string off s.
+func splitValue(s string) (string, string) {
+	if !strings.HasPrefix(s, "\"") {
+		return splitToken(s)
+	}
+
+	var value strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				value.WriteByte(s[i])
+			}
+		case '"':
+			return value.String(), s[i+1:]
+		default:
+			value.WriteByte(s[i])
+		}
+	}
+	return value.String(), ""
+}
+
+// basicAuthorization returns the value of the Authorization header for basic authentication.
+func basicAuthorization(creds *Credentials) string {
+	auth := creds.Username + ":" + creds.Password
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
+}
@@ -0,0 +1,137 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseChallenges(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+		want    []challenge
+	}{
+		{
+			name:    "bearer",
+			headers: []string{`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/busybox:pull"`},
+			want: []challenge{{Scheme: "bearer", Params: map[string]string{
+				"realm":   "https://auth.docker.io/token",
+				"service": "registry.docker.io",
+				"scope":   "repository:library/busybox:pull",
+			}}},
+		},
+		{
+			name:    "basic",
+			headers: []string{`Basic realm="Registry Realm"`},
+			want:    []challenge{{Scheme: "basic", Params: map[string]string{"realm": "Registry Realm"}}},
+		},
+		{
+			name:    "scheme and parameter names are case insensitive",
+			headers: []string{`BEARER Realm="https://ghcr.io/token"`},
+			want:    []challenge{{Scheme: "bearer", Params: map[string]string{"realm": "https://ghcr.io/token"}}},
+		},
+		{
+			name:    "several challenges in one header",
+			headers: []string{`Basic realm="r", Bearer realm="https://auth/token", service=registry`},
+			want: []challenge{
+				{Scheme: "basic", Params: map[string]string{"realm": "r"}},
+				{Scheme: "bearer", Params: map[string]string{"realm": "https://auth/token", "service": "registry"}},
+			},
+		},
+		{
+			name:    "several headers",
+			headers: []string{`Basic realm="r"`, `Bearer realm="t"`},
+			want: []challenge{
+				{Scheme: "basic", Params: map[string]string{"realm": "r"}},
+				{Scheme: "bearer", Params: map[string]string{"realm": "t"}},
+			},
+		},
+		{
+			name:    "escaped quotes and commas in quoted strings",
+			headers: []string{`Bearer realm="a \"b\", c"`},
+			want:    []challenge{{Scheme: "bearer", Params: map[string]string{"realm": `a "b", c`}}},
+		},
+		{
+			name:    "spaces around the equals sign",
+			headers: []string{`Bearer realm = "t" , service = s`},
+			want:    []challenge{{Scheme: "bearer", Params: map[string]string{"realm": "t", "service": "s"}}},
+		},
+		{
+			name:    "challenge without parameters",
+			headers: []string{`Negotiate`},
+			want:    []challenge{{Scheme: "negotiate", Params: map[string]string{}}},
+		},
+		{
+			name:    "parameter without a challenge",
+			headers: []string{`realm="t"`},
+			want:    nil,
+		},
+		{
+			name:    "empty",
+			headers: []string{""},
+			want:    nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseChallenges(tt.headers); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseChallenges(%q) = %+v, want %+v", tt.headers, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetChallenge(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		header     string
+		wantScheme string
+		wantErr    error
+	}{
+		{name: "anonymous", status: http.StatusOK},
+		{name: "bearer is preferred", status: http.StatusUnauthorized, header: `Basic realm="r", Bearer realm="t"`, wantScheme: "bearer"},
+		{name: "basic", status: http.StatusUnauthorized, header: `Basic realm="r"`, wantScheme: "basic"},
+		{name: "unsupported challenge", status: http.StatusUnauthorized, header: `Negotiate`, wantErr: ErrUnsupportedChallenge},
+		{name: "not found", status: http.StatusNotFound, wantErr: ErrManifestUnknown},
+		{name: "outage is not anonymous", status: http.StatusServiceUnavailable, wantErr: ErrNonOKhttpStatus},
+		{name: "redirect is not anonymous", status: http.StatusNotModified, wantErr: ErrNonOKhttpStatus},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.header != "" {
+					w.Header().Set("WWW-Authenticate", tt.header)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			ref, err := ParseReference(strings.TrimPrefix(server.URL, "http://") + "/app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := getChallenge(context.Background(), ref)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("getChallenge() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getChallenge() error = %v", err)
+			}
+			switch {
+			case tt.wantScheme == "" && got != nil:
+				t.Errorf("getChallenge() = %+v, want nil", got)
+			case tt.wantScheme != "" && (got == nil || got.Scheme != tt.wantScheme):
+				t.Errorf("getChallenge() = %+v, want scheme %q", got, tt.wantScheme)
+			}
+		})
+	}
+}
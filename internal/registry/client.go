@@ -0,0 +1,95 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/akakream/MultiPlatform2IPFS/utils"
+)
+
+// httpClient is shared by every registry request. It has no overall timeout
+// because layers can be large, the requests are bounded by their context and
+// the per-phase timeouts instead.
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   defaultMaxConcurrentDownloads,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+		ExpectContinueTimeout: time.Second,
+	},
+}
+
+// timeouts limit the phases of a copy. A timeout of 0 only stops the phase
+// when the copy is cancelled.
+type timeouts struct {
+	// auth limits resolving the credentials and fetching a token.
+	auth time.Duration
+	// manifest limits a single request for a manifest, a config or the rate limit.
+	manifest time.Duration
+	// blob limits a single attempt to download a layer.
+	blob time.Duration
+	// upload limits adding the image to IPFS.
+	upload time.Duration
+}
+
+var (
+	phaseTimeouts     timeouts
+	phaseTimeoutsErr  error
+	phaseTimeoutsOnce sync.Once
+)
+
+// getTimeouts returns the timeouts of the phases, read from AUTH_TIMEOUT,
+// MANIFEST_TIMEOUT, BLOB_TIMEOUT and UPLOAD_TIMEOUT.
+func getTimeouts() (timeouts, error) {
+	phaseTimeoutsOnce.Do(func() {
+		settings := []struct {
+			name         string
+			value        *time.Duration
+			defaultValue time.Duration
+		}{
+			{"AUTH_TIMEOUT", &phaseTimeouts.auth, 30 * time.Second},
+			{"MANIFEST_TIMEOUT", &phaseTimeouts.manifest, time.Minute},
+			{"BLOB_TIMEOUT", &phaseTimeouts.blob, 0},
+			{"UPLOAD_TIMEOUT", &phaseTimeouts.upload, 0},
+		}
+		for _, setting := range settings {
+			*setting.value = setting.defaultValue
+			value, err := utils.GetEnv(setting.name, "")
+			if err != nil {
+				phaseTimeoutsErr = err
+				return
+			}
+			if value == "" {
+				continue
+			}
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout < 0 {
+				phaseTimeoutsErr = fmt.Errorf("%s must be a duration such as 30s or 0, got %q", setting.name, value)
+				return
+			}
+			*setting.value = timeout
+		}
+	})
+	return phaseTimeouts, phaseTimeoutsErr
+}
+
+// withTimeout returns a context that is done after the timeout, or only with
+// ctx if the timeout is 0.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,196 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ErrCredentialHelper is error for when a docker credential helper fails
+var ErrCredentialHelper = errors.New("docker credential helper failed")
+
+// dockerHubAuthKey is the key docker uses for Docker Hub in the config.json.
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// tokenUsername is the username credential helpers return for identity tokens.
+const tokenUsername = "<token>"
+
+// dockerConfig is the part of ~/.docker/config.json that holds credentials.
+type dockerConfig struct {
+	Auths       map[string]dockerAuth `json:"auths"`
+	CredsStore  string                `json:"credsStore"`
+	CredHelpers map[string]string     `json:"credHelpers"`
+}
+
+type dockerAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// helperCredentials is the output of docker-credential-<helper> get.
+type helperCredentials struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// ResolveCredentials returns the credentials used for the registry of the
+// reference. Explicit credentials take precedence, otherwise they are looked
+// up in the docker config.json and its credential helpers. It returns nil if
+// no credentials are configured for the registry. A credential helper that
+// is missing or fails is logged and skipped, so public images can still be
+// pulled anonymously.
+func ResolveCredentials(ctx context.Context, ref Reference, explicit *Credentials) (*Credentials, error) {
+	if explicit != nil && !explicit.IsEmpty() {
+		return explicit, nil
+	}
+
+	config, err := loadDockerConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return nil, nil
+	}
+
+	keys := authKeys(ref.Registry)
+	if helper := config.CredHelpers[ref.Registry]; helper != "" {
+		creds, err := credentialsFromHelper(ctx, helper, keys[0])
+		if err != nil && ctx.Err() == nil {
+			logf(ctx, "Can not get the credentials of %s, pulling anonymously: %v", ref.Registry, err)
+			return nil, nil
+		}
+		return creds, err
+	}
+	if config.CredsStore != "" {
+		creds, err := credentialsFromHelper(ctx, config.CredsStore, keys[0])
+		if err != nil && ctx.Err() != nil {
+			return nil, err
+		}
+		if err != nil {
+			logf(ctx, "Can not get the credentials of %s from the credsStore, trying the auths: %v", ref.Registry, err)
+		} else if creds != nil {
+			return creds, nil
+		}
+	}
+
+	for key, auth := range config.Auths {
+		for _, candidate := range keys {
+			if normalizeAuthKey(key) == normalizeAuthKey(candidate) {
+				return auth.credentials()
+			}
+		}
+	}
+	return nil, nil
+}
+
+// IsEmpty reports whether no credential is set.
+func (c *Credentials) IsEmpty() bool {
+	return c.Username == "" && c.Password == "" && c.IdentityToken == ""
+}
+
+// loadDockerConfig reads the docker config.json from $DOCKER_CONFIG or ~/.docker.
+// It returns nil if the file does not exist.
+func loadDockerConfig() (*dockerConfig, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+
+	file, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var config dockerConfig
+	if err := json.Unmarshal(file, &config); err != nil {
+		return nil, fmt.Errorf("can not parse the docker config.json: %w", err)
+	}
+	return &config, nil
+}
+
+// authKeys returns the keys the registry may be stored under in the docker config.json.
+// The first key is the one docker itself uses.
+func authKeys(registry string) []string {
+	if registry == defaultRegistry {
+		return []string{dockerHubAuthKey, "index.docker.io", dockerHubEndpoint, defaultRegistry}
+	}
+	return []string{registry}
+}
+
+// normalizeAuthKey strips the scheme and the path from a docker config.json key.
+func normalizeAuthKey(key string) string {
+	key = strings.TrimPrefix(key, "https://")
+	key = strings.TrimPrefix(key, "http://")
+	if i := strings.Index(key, "/"); i != -1 {
+		key = key[:i]
+	}
+	return key
+}
+
+func (a dockerAuth) credentials() (*Credentials, error) {
+	creds := &Credentials{
+		Username:      a.Username,
+		Password:      a.Password,
+		IdentityToken: a.IdentityToken,
+	}
+	if a.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("can not decode the auth of the docker config.json: %w", err)
+		}
+		username, password, found := strings.Cut(string(decoded), ":")
+		if !found {
+			return nil, errors.New("the auth of the docker config.json is not in the username:password format")
+		}
+		creds.Username = username
+		creds.Password = password
+	}
+	if creds.IsEmpty() {
+		return nil, nil
+	}
+	return creds, nil
+}
+
+// credentialsFromHelper runs docker-credential-<helper> get for the server URL.
+// It returns nil if the helper has no credentials for the server.
+func credentialsFromHelper(ctx context.Context, helper string, serverURL string) (*Credentials, error) {
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		output := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(output, "credentials not found") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: docker-credential-%s: %v: %s", ErrCredentialHelper, helper, err, output)
+	}
+
+	var result helperCredentials
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+		return nil, fmt.Errorf("%w: docker-credential-%s: %v", ErrCredentialHelper, helper, err)
+	}
+	if result.Username == tokenUsername {
+		return &Credentials{IdentityToken: result.Secret}, nil
+	}
+	return &Credentials{Username: result.Username, Password: result.Secret}, nil
+}
@@ -0,0 +1,173 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// testCredentialHelpers are the docker-credential-<name> scripts of the tests.
+var testCredentialHelpers = map[string]string{
+	// user answers with the server URL it was asked for as the username
+	"user":   `read url; echo "{\"ServerURL\":\"$url\",\"Username\":\"$url\",\"Secret\":\"helper-secret\"}"`,
+	"token":  `echo '{"ServerURL":"ghcr.io","Username":"<token>","Secret":"helper-token"}'`,
+	"none":   `echo "credentials not found in native keychain"; exit 1`,
+	"broken": `echo "can not reach the keychain" >&2; exit 1`,
+}
+
+func TestResolveCredentials(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the credential helpers of the test are shell scripts")
+	}
+	bin := t.TempDir()
+	for name, script := range testCredentialHelpers {
+		path := filepath.Join(bin, "docker-credential-"+name)
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin)
+	basicAuth := base64.StdEncoding.EncodeToString([]byte("alice:s3cret:with:colons"))
+
+	tests := []struct {
+		name     string
+		config   string
+		ref      string
+		explicit *Credentials
+		want     *Credentials
+		wantErr  bool
+		wantLog  bool
+	}{
+		{
+			name:   "no config",
+			ref:    "ghcr.io/org/app",
+			config: "",
+		},
+		{
+			name:   "base64 auth",
+			ref:    "ghcr.io/org/app",
+			config: `{"auths":{"ghcr.io":{"auth":"` + basicAuth + `"}}}`,
+			want:   &Credentials{Username: "alice", Password: "s3cret:with:colons"},
+		},
+		{
+			name:   "username and password",
+			ref:    "ghcr.io/org/app",
+			config: `{"auths":{"https://ghcr.io":{"username":"bob","password":"pw"}}}`,
+			want:   &Credentials{Username: "bob", Password: "pw"},
+		},
+		{
+			name:   "identity token",
+			ref:    "registry.example.com/app",
+			config: `{"auths":{"registry.example.com":{"identitytoken":"refresh-token"}}}`,
+			want:   &Credentials{IdentityToken: "refresh-token"},
+		},
+		{
+			name:   "docker hub key of docker",
+			ref:    "busybox",
+			config: `{"auths":{"https://index.docker.io/v1/":{"auth":"` + basicAuth + `"}}}`,
+			want:   &Credentials{Username: "alice", Password: "s3cret:with:colons"},
+		},
+		{
+			name:   "auth of another registry",
+			ref:    "ghcr.io/org/app",
+			config: `{"auths":{"quay.io":{"auth":"` + basicAuth + `"}}}`,
+		},
+		{
+			name:    "invalid base64 auth",
+			ref:     "ghcr.io/org/app",
+			config:  `{"auths":{"ghcr.io":{"auth":"not base64!"}}}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid config",
+			ref:     "ghcr.io/org/app",
+			config:  `{"auths":`,
+			wantErr: true,
+		},
+		{
+			name:     "explicit credentials take precedence",
+			ref:      "ghcr.io/org/app",
+			config:   `{"auths":{"ghcr.io":{"auth":"` + basicAuth + `"}}}`,
+			explicit: &Credentials{Username: "explicit", Password: "pw"},
+			want:     &Credentials{Username: "explicit", Password: "pw"},
+		},
+		{
+			name:   "credHelpers of the registry",
+			ref:    "ghcr.io/org/app",
+			config: `{"credsStore":"none","credHelpers":{"ghcr.io":"user"}}`,
+			want:   &Credentials{Username: "ghcr.io", Password: "helper-secret"},
+		},
+		{
+			name:   "credHelpers with an identity token",
+			ref:    "ghcr.io/org/app",
+			config: `{"credHelpers":{"ghcr.io":"token"}}`,
+			want:   &Credentials{IdentityToken: "helper-token"},
+		},
+		{
+			name:   "credsStore is asked with the docker hub key",
+			ref:    "busybox",
+			config: `{"credsStore":"user"}`,
+			want:   &Credentials{Username: "https://index.docker.io/v1/", Password: "helper-secret"},
+		},
+		{
+			name:   "credsStore without credentials falls back to the auths",
+			ref:    "ghcr.io/org/app",
+			config: `{"credsStore":"none","auths":{"ghcr.io":{"auth":"` + basicAuth + `"}}}`,
+			want:   &Credentials{Username: "alice", Password: "s3cret:with:colons"},
+		},
+		{
+			name:    "broken credsStore falls back to the auths",
+			ref:     "ghcr.io/org/app",
+			config:  `{"credsStore":"broken","auths":{"ghcr.io":{"auth":"` + basicAuth + `"}}}`,
+			want:    &Credentials{Username: "alice", Password: "s3cret:with:colons"},
+			wantLog: true,
+		},
+		{
+			name:    "missing credsStore pulls anonymously",
+			ref:     "busybox",
+			config:  `{"credsStore":"desktop","auths":{"https://index.docker.io/v1/":{}}}`,
+			wantLog: true,
+		},
+		{
+			name:    "missing credHelpers pulls anonymously",
+			ref:     "ghcr.io/org/app",
+			config:  `{"credHelpers":{"ghcr.io":"gcloud"}}`,
+			wantLog: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("DOCKER_CONFIG", dir)
+			if tt.config != "" {
+				if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(tt.config), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ref, err := ParseReference(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			got, err := ResolveCredentials(context.Background(), ref, tt.explicit)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveCredentials() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ResolveCredentials() = %+v, want %+v", got, tt.want)
+			}
+			if logged := logs.Len() > 0; logged != tt.wantLog {
+				t.Errorf("ResolveCredentials() logged %q, want a warning %v", logs.String(), tt.wantLog)
+			}
+		})
+	}
+}
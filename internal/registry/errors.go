@@ -0,0 +1,139 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxErrorBodySize limits how much of an error response is read.
+const maxErrorBodySize = 64 << 10
+
+// The errors of the distribution spec a StatusError can match. Registries
+// that send no error body are matched by the status code instead.
+var (
+	// ErrUnauthorized is error for when the registry requires authentication
+	ErrUnauthorized = errors.New("authentication required")
+	// ErrDenied is error for when the credentials do not grant access to the repository
+	ErrDenied = errors.New("access denied")
+	// ErrNameUnknown is error for when the repository does not exist
+	ErrNameUnknown = errors.New("repository name not known to registry")
+	// ErrManifestUnknown is error for when the tag or digest does not exist
+	ErrManifestUnknown = errors.New("manifest unknown")
+	// ErrBlobUnknown is error for when a blob does not exist
+	ErrBlobUnknown = errors.New("blob unknown")
+	// ErrTooManyRequests is error for when the registry rate limits the requests
+	ErrTooManyRequests = errors.New("too many requests")
+)
+
+// errorCodes maps the codes of the distribution spec to their errors.
+var errorCodes = map[string]error{
+	"UNAUTHORIZED":     ErrUnauthorized,
+	"DENIED":           ErrDenied,
+	"NAME_UNKNOWN":     ErrNameUnknown,
+	"MANIFEST_UNKNOWN": ErrManifestUnknown,
+	"BLOB_UNKNOWN":     ErrBlobUnknown,
+	"TOOMANYREQUESTS":  ErrTooManyRequests,
+}
+
+// ErrorDetail is a single error of a distribution error body such as
+// {"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}.
+type ErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// StatusError is returned when the registry responds with an unexpected status.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	// Errors are the errors of the response body, if the registry sent any.
+	Errors []ErrorDetail
+	// RetryAfter is the delay requested by the Retry-After header of the response.
+	RetryAfter time.Duration
+	// RateLimited is set when the registry reported an exhausted pull budget.
+	RateLimited bool
+}
+
+func newStatusError(resp *http.Response) *StatusError {
+	statusErr := &StatusError{
+		URL:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+		Errors:     parseErrorBody(resp.Body),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+	limit, ok := recordRateLimit(resp)
+	if ok && resp.StatusCode == http.StatusTooManyRequests && limit.Remaining == 0 {
+		statusErr.RateLimited = true
+		if statusErr.RetryAfter == 0 {
+			statusErr.RetryAfter = rateLimitPollInterval
+		}
+	}
+	return statusErr
+}
+
+// parseErrorBody decodes the errors of a distribution error body. It
+// returns nil if the body is empty or not such a body.
+func parseErrorBody(body io.Reader) []ErrorDetail {
+	content, err := io.ReadAll(io.LimitReader(body, maxErrorBodySize))
+	if err != nil || len(content) == 0 {
+		return nil
+	}
+	var errorBody struct {
+		Errors []ErrorDetail `json:"errors"`
+	}
+	if err := json.Unmarshal(content, &errorBody); err != nil {
+		return nil
+	}
+	return errorBody.Errors
+}
+
+func (e *StatusError) Error() string {
+	message := fmt.Sprintf("%s: unexpected http status %d %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+	for _, detail := range e.Errors {
+		message += fmt.Sprintf(": %s: %s", detail.Code, detail.Message)
+	}
+	return message
+}
+
+// Is makes every StatusError match ErrNonOKhttpStatus and the errors of its
+// codes, e.g. ErrManifestUnknown for MANIFEST_UNKNOWN.
+func (e *StatusError) Is(target error) bool {
+	if target == ErrNonOKhttpStatus {
+		return true
+	}
+	for _, detail := range e.Errors {
+		if errorCodes[detail.Code] == target {
+			return true
+		}
+	}
+	return e.statusErr() == target
+}
+
+// statusErr returns the error the status code stands for. It is used when
+// the response has no error body, as for HEAD requests.
+func (e *StatusError) statusErr() error {
+	switch e.StatusCode {
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusForbidden:
+		return ErrDenied
+	case http.StatusTooManyRequests:
+		return ErrTooManyRequests
+	case http.StatusNotFound:
+		if len(e.Errors) > 0 {
+			return nil
+		}
+		if strings.Contains(e.URL, "/manifests/") {
+			return ErrManifestUnknown
+		}
+		if strings.Contains(e.URL, "/blobs/") {
+			return ErrBlobUnknown
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStatusErrorIs(t *testing.T) {
+	manifestURL := "https://ghcr.io/v2/org/app/manifests/1.2"
+	blobURL := "https://ghcr.io/v2/org/app/blobs/sha256:a"
+
+	tests := []struct {
+		name  string
+		err   *StatusError
+		is    []error
+		isNot []error
+	}{
+		{
+			name:  "error code",
+			err:   &StatusError{URL: manifestURL, StatusCode: 404, Errors: []ErrorDetail{{Code: "NAME_UNKNOWN"}}},
+			is:    []error{ErrNonOKhttpStatus, ErrNameUnknown},
+			isNot: []error{ErrManifestUnknown, ErrBlobUnknown},
+		},
+		{
+			name:  "several error codes",
+			err:   &StatusError{URL: manifestURL, StatusCode: 401, Errors: []ErrorDetail{{Code: "UNAUTHORIZED"}, {Code: "DENIED"}}},
+			is:    []error{ErrUnauthorized, ErrDenied},
+			isNot: []error{ErrTooManyRequests},
+		},
+		{
+			name:  "unknown error code falls back to the status",
+			err:   &StatusError{URL: manifestURL, StatusCode: 403, Errors: []ErrorDetail{{Code: "SOMETHING_NEW"}}},
+			is:    []error{ErrDenied},
+			isNot: []error{ErrUnauthorized},
+		},
+		{
+			name: "unauthorized without a body",
+			err:  &StatusError{URL: manifestURL, StatusCode: 401},
+			is:   []error{ErrUnauthorized},
+		},
+		{
+			name: "too many requests without a body",
+			err:  &StatusError{URL: manifestURL, StatusCode: 429},
+			is:   []error{ErrTooManyRequests},
+		},
+		{
+			name:  "manifest not found without a body",
+			err:   &StatusError{URL: manifestURL, StatusCode: 404},
+			is:    []error{ErrManifestUnknown},
+			isNot: []error{ErrBlobUnknown, ErrNameUnknown},
+		},
+		{
+			name:  "blob not found without a body",
+			err:   &StatusError{URL: blobURL, StatusCode: 404},
+			is:    []error{ErrBlobUnknown},
+			isNot: []error{ErrManifestUnknown},
+		},
+		{
+			name:  "not found with another error code",
+			err:   &StatusError{URL: manifestURL, StatusCode: 404, Errors: []ErrorDetail{{Code: "NAME_UNKNOWN"}}},
+			isNot: []error{ErrManifestUnknown},
+		},
+		{
+			name:  "server error",
+			err:   &StatusError{URL: manifestURL, StatusCode: 502},
+			is:    []error{ErrNonOKhttpStatus},
+			isNot: []error{ErrUnauthorized, ErrDenied, ErrManifestUnknown, ErrTooManyRequests},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wrapped := fmt.Errorf("copy: %w", tt.err)
+			for _, target := range tt.is {
+				if !errors.Is(wrapped, target) {
+					t.Errorf("errors.Is(%v, %v) = false, want true", tt.err, target)
+				}
+			}
+			for _, target := range tt.isNot {
+				if errors.Is(wrapped, target) {
+					t.Errorf("errors.Is(%v, %v) = true, want false", tt.err, target)
+				}
+			}
+		})
+	}
+}
+
+func TestNewStatusError(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []ErrorDetail
+	}{
+		{
+			name: "distribution error body",
+			body: `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown","detail":{"Tag":"nope"}}]}`,
+			want: []ErrorDetail{{Code: "MANIFEST_UNKNOWN", Message: "manifest unknown"}},
+		},
+		{name: "empty body"},
+		{name: "html body", body: "<html>Bad Gateway</html>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer server.Close()
+
+			resp, err := http.Get(server.URL + "/v2/app/manifests/nope")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			statusErr := newStatusError(resp)
+			if statusErr.StatusCode != http.StatusNotFound || !reflect.DeepEqual(statusErr.Errors, tt.want) {
+				t.Errorf("newStatusError() = %+v, want status 404 and errors %+v", statusErr, tt.want)
+			}
+			if !errors.Is(statusErr, ErrManifestUnknown) {
+				t.Errorf("newStatusError() = %v, want ErrManifestUnknown", statusErr)
+			}
+			if !strings.Contains(statusErr.Error(), "404") {
+				t.Errorf("Error() = %q, want the status", statusErr.Error())
+			}
+		})
+	}
+}
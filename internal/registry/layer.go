@@ -1,49 +1,239 @@
 package registry
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"os"
-	"sync"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akakream/MultiPlatform2IPFS/internal/fs"
 )
 
+// partialDirName is the directory under EXPORT_PATH that keeps partially
+// downloaded layers. It is next to the staging directories, so a finished
+// layer is moved into its staging directory without copying it.
+const partialDirName = "partial"
+
+// partialLayerMaxAge is how long a partial layer that is not written to is
+// kept for a copy to resume it, see CleanStagingDirs.
+const partialLayerMaxAge = 24 * time.Hour
+
+// downloadLayer downloads the layer to destination. The download is kept in
+// a partial file in partialDir, so an interrupted download is resumed with a
+// range request by the next attempt, even of another run.
+// The layer only appears at destination once its digest and size are verified.
+// The downloaded bytes are reported to blob. Every request takes its token
+// from auth, as the layer may wait for a download slot longer than a token lives.
 func downloadLayer(
-	repoName string,
-	digest string,
-	token string,
+	ctx context.Context,
+	ref Reference,
+	layer Descriptor,
+	auth *authorizer,
+	partialDir string,
 	destination string,
-	wg *sync.WaitGroup,
+	blob *blobReporter,
 ) error {
-	defer wg.Done()
-
-	url := registryEndpoint + repoName + "/blobs/" + digest
+	partialPath, err := partialLayerPath(partialDir, layer.Digest)
+	if err != nil {
+		return err
+	}
+	unlock, locked, err := fs.TryLockFile(partialPath)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		// Another download of the layer owns the partial file, download without resuming
+		return downloadLayerOnce(ctx, ref, layer, auth, destination, blob)
+	}
+	defer unlock()
 
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("Accept-Encoding", "gzip")
-	req.Header.Set("Authorization", "Bearer "+token)
+	partial, err := os.OpenFile(partialPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer partial.Close()
 
-	resp, err := client.Do(req)
+	digester, err := newDigester(layer.Digest)
+	if err != nil {
+		return err
+	}
+	offset, err := io.Copy(digester, partial)
 	if err != nil {
 		return err
 	}
+	if layer.Size >= 0 && offset > layer.Size {
+		if err := resetPartial(partial, digester); err != nil {
+			return err
+		}
+		offset = 0
+	}
+	blob.set(offset)
+
+	if layer.Size < 0 || offset < layer.Size {
+		offset, err = fetchLayer(ctx, ref, layer, auth, partial, digester, blob, offset)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := verifyDownload(digester, layer, offset); err != nil {
+		// The partial file is corrupt, the next attempt starts from scratch
+		partial.Close()
+		os.Remove(partialPath)
+		return err
+	}
+
+	if err := partial.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(partialPath, 0644); err != nil {
+		return err
+	}
+	return fs.MoveFile(partialPath, destination)
+}
+
+// fetchLayer appends the layer from offset on to the partial file and
+// returns the new size of the file. It falls back to downloading the whole
+// layer when the registry ignores the range.
+func fetchLayer(
+	ctx context.Context,
+	ref Reference,
+	layer Descriptor,
+	auth *authorizer,
+	partial *os.File,
+	digester hash.Hash,
+	blob *blobReporter,
+	offset int64,
+) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", ref.blobURL(layer.Digest), nil)
+	if err != nil {
+		return offset, err
+	}
+	// Ranges are only meaningful for the blob itself, not for a compressed transfer of it
+	req.Header.Set("Accept-Encoding", "identity")
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+
+	resp, err := auth.do(req)
+	if err != nil {
+		return offset, err
+	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		fmt.Println("Non-OK HTTP status:", resp.StatusCode)
-		return ErrNonOKhttpStatus
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && rangeStart(resp) == offset:
+		logf(ctx, "Resuming the download of %s at %d bytes", layer.Digest, offset)
+	case offset > 0 && (resp.StatusCode == http.StatusPartialContent ||
+		resp.StatusCode == http.StatusRequestedRangeNotSatisfiable):
+		// The registry does not serve the range we asked for, start over
+		if err := resetPartial(partial, digester); err != nil {
+			return 0, err
+		}
+		blob.set(0)
+		resp.Body.Close()
+		return fetchLayer(ctx, ref, layer, auth, partial, digester, blob, 0)
+	case resp.StatusCode == http.StatusOK:
+		if offset > 0 {
+			logf(ctx, "The registry ignored the range, downloading %s from the start", layer.Digest)
+			if err := resetPartial(partial, digester); err != nil {
+				return 0, err
+			}
+			blob.set(0)
+			offset = 0
+		}
+	default:
+		return offset, newStatusError(resp)
+	}
+
+	if _, err := partial.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
 	}
+	written, err := io.Copy(io.MultiWriter(partial, digester, blob), resp.Body)
+	return offset + written, err
+}
 
-	body, err := io.ReadAll(resp.Body)
+// downloadLayerOnce downloads the layer without keeping a partial file.
+func downloadLayerOnce(
+	ctx context.Context,
+	ref Reference,
+	layer Descriptor,
+	auth *authorizer,
+	destination string,
+	blob *blobReporter,
+) error {
+	url := ref.blobURL(layer.Digest)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return err
 	}
 
-	err = os.WriteFile(destination, body, os.ModePerm)
+	resp, err := auth.do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(resp)
+	}
 
-	return nil
+	blob.set(0)
+	return writeVerified(io.TeeReader(resp.Body, blob), destination, layer.Digest, layer.Size)
+}
+
+// verifyDownload checks the size and the digest of a downloaded layer.
+func verifyDownload(digester hash.Hash, layer Descriptor, size int64) error {
+	if layer.Size >= 0 && size != layer.Size {
+		return &VerificationError{
+			Digest:   layer.Digest,
+			Expected: fmt.Sprint(layer.Size),
+			Actual:   fmt.Sprint(size),
+			Err:      ErrSizeMismatch,
+		}
+	}
+	return checkDigest(digester, layer.Digest)
+}
+
+func resetPartial(partial *os.File, digester hash.Hash) error {
+	digester.Reset()
+	if err := partial.Truncate(0); err != nil {
+		return err
+	}
+	_, err := partial.Seek(0, io.SeekStart)
+	return err
+}
+
+// rangeStart returns the first byte of a Content-Range header such as
+// "bytes 100-199/200", or -1 if the header is missing or invalid.
+func rangeStart(resp *http.Response) int64 {
+	contentRange := strings.TrimPrefix(resp.Header.Get("Content-Range"), "bytes ")
+	start, _, found := strings.Cut(contentRange, "-")
+	if !found {
+		return -1
+	}
+	offset, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return offset
+}
+
+// partialLayerPath returns the path of the partial file of the layer in dir.
+func partialLayerPath(dir string, digest string) (string, error) {
+	if strings.ContainsAny(digest, `/\`) {
+		return "", errors.New("invalid digest " + digest)
+	}
+	if err := fs.CreateDir(dir); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, strings.ReplaceAll(digest, ":", "-")), nil
 }
@@ -0,0 +1,189 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akakream/MultiPlatform2IPFS/internal/fs"
+)
+
+func TestDownloadLayerResume(t *testing.T) {
+	content := bytes.Repeat([]byte("layer"), 1000)
+	sum := sha256.Sum256(content)
+	layer := Descriptor{Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(content))}
+	half := int64(len(content) / 2)
+
+	// serveRange answers a range request with the content from start on
+	serveRange := func(w http.ResponseWriter, start int64) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(content)-1, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[start:])
+	}
+
+	tests := []struct {
+		name string
+		// partial is the content of the partial file of an earlier attempt
+		partial []byte
+		serve   func(w http.ResponseWriter, r *http.Request)
+		// wantRanges are the Range headers of the requests
+		wantRanges []string
+		wantErr    error
+	}{
+		{
+			name:    "resumes with a range",
+			partial: content[:half],
+			serve: func(w http.ResponseWriter, r *http.Request) {
+				serveRange(w, half)
+			},
+			wantRanges: []string{"bytes=" + strconv.FormatInt(half, 10) + "-"},
+		},
+		{
+			name:    "restarts on a range that does not match",
+			partial: content[:half],
+			serve: func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Range") != "" {
+					serveRange(w, 1)
+					return
+				}
+				w.Write(content)
+			},
+			wantRanges: []string{"bytes=" + strconv.FormatInt(half, 10) + "-", ""},
+		},
+		{
+			name:    "restarts when the registry ignores the range",
+			partial: content[:half],
+			serve: func(w http.ResponseWriter, r *http.Request) {
+				w.Write(content)
+			},
+			wantRanges: []string{"bytes=" + strconv.FormatInt(half, 10) + "-"},
+		},
+		{
+			name: "downloads without a partial file",
+			serve: func(w http.ResponseWriter, r *http.Request) {
+				w.Write(content)
+			},
+			wantRanges: []string{""},
+		},
+		{
+			name:    "partial file with other content",
+			partial: bytes.Repeat([]byte("x"), int(half)),
+			serve: func(w http.ResponseWriter, r *http.Request) {
+				serveRange(w, half)
+			},
+			wantRanges: []string{"bytes=" + strconv.FormatInt(half, 10) + "-"},
+			wantErr:    ErrDigestMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var ranges []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				ranges = append(ranges, r.Header.Get("Range"))
+				mu.Unlock()
+				tt.serve(w, r)
+			}))
+			defer server.Close()
+
+			ref, err := ParseReference(strings.TrimPrefix(server.URL, "http://") + "/app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			dir := t.TempDir()
+			partialDir := filepath.Join(dir, partialDirName)
+			partialPath, err := partialLayerPath(partialDir, layer.Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.partial != nil {
+				if err := os.WriteFile(partialPath, tt.partial, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			destination := filepath.Join(dir, "layer")
+			blob := newProgressReporter(nil).blob(layer.Digest, layer.Size)
+			err = downloadLayer(context.Background(), ref, layer, nil, partialDir, destination, blob)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("downloadLayer() error = %v, want %v", err, tt.wantErr)
+			}
+			if fmt.Sprint(ranges) != fmt.Sprint(tt.wantRanges) {
+				t.Errorf("Range headers = %q, want %q", ranges, tt.wantRanges)
+			}
+			if _, err := os.Stat(partialPath); !os.IsNotExist(err) {
+				t.Errorf("the partial file is left behind: %v", err)
+			}
+
+			got, err := os.ReadFile(destination)
+			if tt.wantErr != nil {
+				if !os.IsNotExist(err) {
+					t.Errorf("the layer of a failed download is stored: %v", err)
+				}
+				return
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("downloaded layer has %d bytes, want the %d bytes of the layer", len(got), len(content))
+			}
+		})
+	}
+}
+
+func TestCleanPartialLayers(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-2 * time.Hour)
+
+	tests := []struct {
+		name   string
+		old    bool
+		locked bool
+		kept   bool
+	}{
+		{name: "stale", old: true},
+		{name: "recent", kept: true},
+		{name: "stale and locked by a download", old: true, locked: true, kept: true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "-"))
+		if err := os.WriteFile(path, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if tt.old {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tt.locked {
+			unlock, locked, err := fs.TryLockFile(path)
+			if err != nil || !locked {
+				t.Fatalf("TryLockFile() = %v, %v", locked, err)
+			}
+			defer unlock()
+		}
+	}
+
+	if err := cleanPartialLayers(dir, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := os.Stat(filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "-")))
+			if kept := err == nil; kept != tt.kept {
+				t.Errorf("partial layer kept = %v, want %v (error %v)", kept, tt.kept, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/akakream/MultiPlatform2IPFS/internal/fs"
+	"github.com/akakream/MultiPlatform2IPFS/utils"
+)
+
+// ErrInvalidExportFormat is error for when an export format is not known
+var ErrInvalidExportFormat = errors.New("invalid export format")
+
+// ExportFormat selects how the image is laid out in the directory that is added to IPFS.
+type ExportFormat string
+
+const (
+	// FormatFlat stores every manifest in a single manifests/ and every blob in a single blobs/ directory.
+	FormatFlat ExportFormat = "flat"
+	// FormatPlatform stores the index as manifestlist.json and every platform in
+	// its own directory with manifests/ and blobs/, as described in the README.
+	FormatPlatform ExportFormat = "platform"
+)
+
+// manifestListName is the file the index is stored in by FormatPlatform.
+const manifestListName = "manifestlist.json"
+
+// ParseExportFormat parses an export format. An empty string is the
+// EXPORT_FORMAT setting, which defaults to FormatFlat.
+func ParseExportFormat(s string) (ExportFormat, error) {
+	if s == "" {
+		var err error
+		s, err = utils.GetEnv("EXPORT_FORMAT", "")
+		if err != nil {
+			return "", err
+		}
+	}
+
+	switch ExportFormat(s) {
+	case "", FormatFlat:
+		return FormatFlat, nil
+	case FormatPlatform:
+		return FormatPlatform, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrInvalidExportFormat, s)
+}
+
+// ErrPlatformCollision is error for when two manifests of an image would be
+// stored in the same platform directory
+var ErrPlatformCollision = errors.New("several manifests have the same platform")
+
+// The annotations of the index entries of attestation manifests, as written
+// by BuildKit. They are listed with the platform unknown/unknown.
+const (
+	referenceTypeAnnotation   = "vnd.docker.reference.type"
+	referenceDigestAnnotation = "vnd.docker.reference.digest"
+	attestationReferenceType  = "attestation-manifest"
+)
+
+// exportLayout decides where manifests and blobs are stored in the export directory.
+type exportLayout struct {
+	format ExportFormat
+	root   string
+	// dirs are the names of the platform directories of the manifests of the
+	// index by their digest, see assignDirs.
+	dirs map[string]string
+}
+
+// platformDirName returns the name of the directory of the platform, e.g.
+// linuxarmv5. Windows images of several versions only differ in the os
+// version, so it is part of the name if it is set.
+func platformDirName(platform Platform) string {
+	return platform.OS + platform.Architecture + platform.Variant + platform.OSVersion
+}
+
+// assignDirs names the platform directories of the manifests of the index.
+// An attestation manifest is stored next to the manifest it describes, in a
+// directory such as linuxamd64-attestation. It fails if two other manifests
+// would share a directory, as they would overwrite each other's latest.
+func (l *exportLayout) assignDirs(manifests []ManifestEntry) error {
+	dirs := map[string]string{}
+	for _, manifest := range manifests {
+		if !manifest.isAttestation() {
+			dirs[manifest.Digest] = platformDirName(manifest.Platform)
+		}
+	}
+	for _, manifest := range manifests {
+		if !manifest.isAttestation() {
+			continue
+		}
+		if described, ok := dirs[manifest.Annotations[referenceDigestAnnotation]]; ok {
+			dirs[manifest.Digest] = described + "-attestation"
+		} else {
+			_, hex, _ := strings.Cut(manifest.Digest, ":")
+			if len(hex) > 12 {
+				hex = hex[:12]
+			}
+			dirs[manifest.Digest] = "attestation-" + hex
+		}
+	}
+
+	owners := map[string]string{}
+	for _, manifest := range manifests {
+		dir := dirs[manifest.Digest]
+		if owner, ok := owners[dir]; ok && owner != manifest.Digest {
+			return fmt.Errorf("%w: %s and %s would both be stored in %s", ErrPlatformCollision, owner, manifest.Digest, dir)
+		}
+		owners[dir] = manifest.Digest
+	}
+	l.dirs = dirs
+	return nil
+}
+
+// dirName returns the name of the platform directory of the manifest. The
+// manifest of an image without an index is named after its platform.
+func (l *exportLayout) dirName(manifestDigest string, platform Platform) string {
+	if dir, ok := l.dirs[manifestDigest]; ok {
+		return dir
+	}
+	return platformDirName(platform)
+}
+
+func (l *exportLayout) manifestDir(dir string) string {
+	if l.format == FormatPlatform {
+		return filepath.Join(l.root, dir, "manifests")
+	}
+	return filepath.Join(l.root, "manifests")
+}
+
+func (l *exportLayout) blobDir(dir string) string {
+	if l.format == FormatPlatform {
+		return filepath.Join(l.root, dir, "blobs")
+	}
+	return filepath.Join(l.root, "blobs")
+}
+
+// createDirs creates the manifests and blobs directories of the platform directory.
+func (l *exportLayout) createDirs(dir string) error {
+	return fs.CreateDirs([]string{l.manifestDir(dir), l.blobDir(dir)})
+}
+
+// storeIndex stores the image index and returns its digest.
+func (l *exportLayout) storeIndex(indexRaw []byte) (string, error) {
+	if l.format == FormatPlatform {
+		err := fs.WriteBytesToFile(filepath.Join(l.root, manifestListName), indexRaw)
+		if err != nil {
+			return "", err
+		}
+		return digestBytes(indexRaw), nil
+	}
+	if err := fs.CreateDir(l.manifestDir("")); err != nil {
+		return "", err
+	}
+	return storeFatManifest(indexRaw, l.manifestDir(""))
+}
+
+// storeManifestList stores a manifest list with the single manifest of an
+// image without an index, so FormatPlatform always has a manifestlist.json.
+// The other formats store nothing.
+func (l *exportLayout) storeManifestList(manifest ManifestEntry) error {
+	if l.format != FormatPlatform {
+		return nil
+	}
+	mediaType := "application/vnd.oci.image.index.v1+json"
+	if manifest.MediaType == "application/vnd.docker.distribution.manifest.v2+json" {
+		mediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+	}
+	indexRaw, err := json.Marshal(FatManifest{
+		SchemaVersion: 2,
+		MediaType:     mediaType,
+		Manifests:     []ManifestEntry{manifest},
+	})
+	if err != nil {
+		return err
+	}
+	return fs.WriteBytesToFile(filepath.Join(l.root, manifestListName), indexRaw)
+}
+
+// storeManifest stores the image manifest of a platform directory under the
+// reference it was fetched by and under its digest. The manifest is also
+// stored as latest when it is the top level manifest of an image without an
+// index, and always by FormatPlatform. It returns the digest of the manifest.
+func (l *exportLayout) storeManifest(dir string, reference string, manifestRaw []byte, topLevel bool) (string, error) {
+	manifestDir := l.manifestDir(dir)
+	digest := digestBytes(manifestRaw)
+
+	names := []string{digest}
+	if reference != digest {
+		names = append(names, reference)
+	}
+	if topLevel || l.format == FormatPlatform {
+		names = append(names, "latest")
+	}
+	for _, name := range names {
+		if err := fs.WriteBytesToFile(filepath.Join(manifestDir, name), manifestRaw); err != nil {
+			return "", err
+		}
+	}
+	return digest, nil
+}
+
+// blobSet makes sure every blob of an image is downloaded once. Further
+// destinations of the same blob are hard linked to the downloaded file.
+type blobSet struct {
+	mu    sync.Mutex
+	paths map[string]string
+	links []blobLink
+}
+
+type blobLink struct {
+	source      string
+	destination string
+}
+
+func newBlobSet() *blobSet {
+	return &blobSet{paths: map[string]string{}}
+}
+
+// add registers the destination of a blob. It reports whether the blob has to
+// be downloaded to the destination, otherwise it is linked by link.
+func (b *blobSet) add(digest string, destination string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	source, exists := b.paths[digest]
+	if !exists {
+		b.paths[digest] = destination
+		return true
+	}
+	if source != destination {
+		b.links = append(b.links, blobLink{source: source, destination: destination})
+	}
+	return false
+}
+
+// link links the blobs that are shared between platforms. It must be called after every download finished.
+func (b *blobSet) link() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, link := range b.links {
+		if err := fs.LinkFile(link.source, link.destination); err != nil {
+			return err
+		}
+	}
+	b.links = nil
+	return nil
+}
+
+// platformOfConfig reads the platform from an image config.
+func platformOfConfig(configRaw []byte) (Platform, error) {
+	var config Platform
+	if err := json.Unmarshal(configRaw, &config); err != nil {
+		return Platform{}, err
+	}
+	return config, nil
+}
@@ -0,0 +1,142 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAssignDirs(t *testing.T) {
+	attestation := func(digest string, described string) ManifestEntry {
+		return ManifestEntry{
+			Digest:   digest,
+			Platform: Platform{OS: "unknown", Architecture: "unknown"},
+			Annotations: map[string]string{
+				referenceTypeAnnotation:   attestationReferenceType,
+				referenceDigestAnnotation: described,
+			},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		manifests []ManifestEntry
+		want      map[string]string
+		wantErr   error
+	}{
+		{
+			name: "platforms",
+			manifests: []ManifestEntry{
+				{Digest: "sha256:a", Platform: Platform{OS: "linux", Architecture: "amd64"}},
+				{Digest: "sha256:b", Platform: Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+			},
+			want: map[string]string{"sha256:a": "linuxamd64", "sha256:b": "linuxarmv7"},
+		},
+		{
+			name: "attestations are stored next to their manifests",
+			manifests: []ManifestEntry{
+				{Digest: "sha256:a", Platform: Platform{OS: "linux", Architecture: "amd64"}},
+				{Digest: "sha256:b", Platform: Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+				attestation("sha256:c", "sha256:a"),
+				attestation("sha256:d", "sha256:b"),
+			},
+			want: map[string]string{
+				"sha256:a": "linuxamd64",
+				"sha256:b": "linuxarm64v8",
+				"sha256:c": "linuxamd64-attestation",
+				"sha256:d": "linuxarm64v8-attestation",
+			},
+		},
+		{
+			name: "attestation of a manifest that was not selected",
+			manifests: []ManifestEntry{
+				attestation("sha256:0123456789abcdef", "sha256:a"),
+			},
+			want: map[string]string{"sha256:0123456789abcdef": "attestation-0123456789ab"},
+		},
+		{
+			name: "windows versions",
+			manifests: []ManifestEntry{
+				{Digest: "sha256:a", Platform: Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.5122"}},
+				{Digest: "sha256:b", Platform: Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.20348.2113"}},
+			},
+			want: map[string]string{"sha256:a": "windowsamd6410.0.17763.5122", "sha256:b": "windowsamd6410.0.20348.2113"},
+		},
+		{
+			name: "same digest twice",
+			manifests: []ManifestEntry{
+				{Digest: "sha256:a", Platform: Platform{OS: "linux", Architecture: "amd64"}},
+				{Digest: "sha256:a", Platform: Platform{OS: "linux", Architecture: "amd64"}},
+			},
+			want: map[string]string{"sha256:a": "linuxamd64"},
+		},
+		{
+			name: "collision",
+			manifests: []ManifestEntry{
+				{Digest: "sha256:a", Platform: Platform{OS: "linux", Architecture: "amd64"}},
+				{Digest: "sha256:b", Platform: Platform{OS: "linux", Architecture: "amd64"}},
+			},
+			wantErr: ErrPlatformCollision,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layout := &exportLayout{format: FormatPlatform, root: t.TempDir()}
+			err := layout.assignDirs(tt.manifests)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("assignDirs() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("assignDirs() error = %v", err)
+			}
+			if !reflect.DeepEqual(layout.dirs, tt.want) {
+				t.Errorf("assignDirs() dirs = %v, want %v", layout.dirs, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoreManifestList(t *testing.T) {
+	tests := []struct {
+		format    ExportFormat
+		mediaType string
+		want      string
+	}{
+		{FormatPlatform, "application/vnd.docker.distribution.manifest.v2+json", "application/vnd.docker.distribution.manifest.list.v2+json"},
+		{FormatPlatform, "application/vnd.oci.image.manifest.v1+json", "application/vnd.oci.image.index.v1+json"},
+		{FormatFlat, "application/vnd.oci.image.manifest.v1+json", ""},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.format)+" "+tt.mediaType, func(t *testing.T) {
+			layout := &exportLayout{format: tt.format, root: t.TempDir()}
+			manifest := ManifestEntry{Digest: "sha256:a", MediaType: tt.mediaType, Size: 1}
+			if err := layout.storeManifestList(manifest); err != nil {
+				t.Fatalf("storeManifestList() error = %v", err)
+			}
+
+			raw, err := os.ReadFile(filepath.Join(layout.root, manifestListName))
+			if tt.want == "" {
+				if !os.IsNotExist(err) {
+					t.Fatalf("storeManifestList() stored a manifest list for %s", tt.format)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var list FatManifest
+			if err := json.Unmarshal(raw, &list); err != nil {
+				t.Fatal(err)
+			}
+			if list.MediaType != tt.want || len(list.Manifests) != 1 || list.Manifests[0].Digest != "sha256:a" {
+				t.Errorf("storeManifestList() stored %s", raw)
+			}
+		})
+	}
+}
@@ -1,10 +1,13 @@
 package registry
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"mime"
 	"net/http"
 	"path/filepath"
 	"strings"
@@ -12,118 +15,184 @@ import (
 	"github.com/akakream/MultiPlatform2IPFS/internal/fs"
 )
 
-func storeFatManifest(fatManifestRaw []byte, dir_manifests string) error {
+// storeFatManifest stores the manifest as latest and under its digest. It returns the digest.
+func storeFatManifest(fatManifestRaw []byte, dir_manifests string) (string, error) {
 	err := fs.WriteBytesToFile(filepath.Join(dir_manifests, "latest"), fatManifestRaw)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	fatManifestSha256, err := fs.Sha256File(filepath.Join(dir_manifests, "latest"))
 	if err != nil {
-		return err
+		return "", err
 	}
 	err = fs.WriteBytesToFile(
 		filepath.Join(dir_manifests, "sha256:"+fatManifestSha256),
 		fatManifestRaw,
 	)
 	if err != nil {
-		return err
+		return "", err
 	}
-	return nil
+	return "sha256:" + fatManifestSha256, nil
 }
 
-func getFatManifest(imageName string, imageTag string, token string) (*FatManifest, []byte, error) {
-	url := registryEndpoint + imageName + "/manifests/" + imageTag
+// digestBytes returns the sha256 digest of the content.
+func digestBytes(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// expectedManifestDigest returns the digest a manifest fetched by the
+// reference must have. Manifests fetched by tag are checked against the
+// Docker-Content-Digest header if the registry sends one.
+func expectedManifestDigest(reference string, resp *http.Response) string {
+	if isDigest(reference) {
+		return reference
+	}
+	return resp.Header.Get("Docker-Content-Digest")
+}
 
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
+// headManifest sends a HEAD request for the manifest of the reference. It
+// does not count as a pull. The caller closes the body of the response.
+func headManifest(ctx context.Context, ref Reference, auth *authorizer) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", ref.manifestURL(ref.Reference()), nil)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	req.Header.Set("Accept", strings.Join(acceptList[:], ", "))
-	req.Header.Set("Authorization", "Bearer "+token)
+	return auth.do(req)
+}
 
-	resp, err := client.Do(req)
+// headManifestDigest returns the digest of the index, or of the manifest for
+// images without an index, from the Docker-Content-Digest header. It is empty
+// if the registry does not send the header.
+func headManifestDigest(ctx context.Context, ref Reference, auth *authorizer) (string, error) {
+	resp, err := headManifest(ctx, ref, auth)
 	if err != nil {
-		return nil, nil, err
+		return "", err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		fmt.Println("Non-OK HTTP status:", resp.StatusCode)
-		return &FatManifest{}, nil, ErrNonOKhttpStatus
+		return "", newStatusError(resp)
+	}
+	recordRateLimit(resp)
+	return resp.Header.Get("Docker-Content-Digest"), nil
+}
+
+// getFatManifest fetches the index of the reference. If the reference points
+// to the manifest of an image without an index, it returns the verified body
+// of the manifest with ErrManifestIsNotFat, so it is not pulled again.
+func getFatManifest(ctx context.Context, ref Reference, auth *authorizer) (*FatManifest, []byte, error) {
+	url := ref.manifestURL(ref.Reference())
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", strings.Join(acceptList[:], ", "))
+
+	resp, err := auth.do(req)
+	if err != nil {
+		return nil, nil, err
 	}
+	defer resp.Body.Close()
 
-	if resp.Header.Get(
-		"content-type",
-	) != "application/vnd.docker.distribution.manifest.list.v2+json" &&
-		resp.Header.Get("content-type") != "application/vnd.oci.image.index.v1+json" {
-		return &FatManifest{}, nil, ErrManifestIsNotFat
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, newStatusError(resp)
 	}
+	recordRateLimit(resp)
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, nil, err
+	}
+	if err := verifyContent(body, expectedManifestDigest(ref.Reference(), resp), -1); err != nil {
+		return nil, nil, err
 	}
 
 	var fatManifest FatManifest
 	if err := json.Unmarshal(body, &fatManifest); err != nil { // Parse []byte to the go struct pointer
 		return nil, nil, err
 	}
+	// Registries that send no content type are judged by the media type of the body
+	mediaType := fatManifest.MediaType
+	if header := resp.Header.Get("Content-Type"); header != "" {
+		mediaType, _, err = mime.ParseMediaType(header)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing the content type of %s: %w", url, err)
+		}
+	}
+	if mediaType != "application/vnd.docker.distribution.manifest.list.v2+json" &&
+		mediaType != "application/vnd.oci.image.index.v1+json" {
+		return nil, body, ErrManifestIsNotFat
+	}
 	return &fatManifest, body, nil
 }
 
-func getManifest(imageName string, digest string, token string) (Manifest, []byte, error) {
-	url := registryEndpoint + imageName + "/manifests/" + digest
+// getManifest fetches the manifest with the tag or digest reference. size
+// is the size of the manifest in the index, or -1 if it is not known.
+func getManifest(ctx context.Context, ref Reference, reference string, size int64, auth *authorizer) (Manifest, []byte, error) {
+	url := ref.manifestURL(reference)
 
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return Manifest{}, nil, err
+	}
 	req.Header.Set("Accept", strings.Join(acceptList[:], ", "))
-	req.Header.Set("Authorization", "Bearer "+token)
 
-	resp, err := client.Do(req)
+	resp, err := auth.do(req)
 	if err != nil {
-		log.Fatalln(err)
+		return Manifest{}, nil, err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		fmt.Println("Non-OK HTTP status:", resp.StatusCode)
-		return Manifest{}, nil, ErrNonOKhttpStatus
+		return Manifest{}, nil, newStatusError(resp)
 	}
+	recordRateLimit(resp)
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatalln(err)
+		return Manifest{}, nil, err
+	}
+	if err := verifyContent(body, expectedManifestDigest(reference, resp), size); err != nil {
+		return Manifest{}, nil, err
 	}
 
 	var manifest Manifest
 	if err := json.Unmarshal(body, &manifest); err != nil { // Parse []byte to the go struct pointer
-		fmt.Println("Can not unmarshal JSON")
+		return Manifest{}, nil, fmt.Errorf("decoding the manifest %s: %w", reference, err)
 	}
 
 	return manifest, body, nil
 }
 
-func getConfig(imageName string, digest string, token string) ([]byte, error) {
-	url := registryEndpoint + imageName + "/blobs/" + digest
+func getConfig(ctx context.Context, ref Reference, config Descriptor, auth *authorizer) ([]byte, error) {
+	url := ref.blobURL(config.Digest)
 
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Set("Accept", strings.Join(acceptList[:], ", "))
-	req.Header.Set("Authorization", "Bearer "+token)
 
-	resp, err := client.Do(req)
+	resp, err := auth.do(req)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		fmt.Println("Non-OK HTTP status:", resp.StatusCode)
-		return nil, ErrNonOKhttpStatus
+		return nil, newStatusError(resp)
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
+	}
+	if err := verifyContent(body, config.Digest, config.Size); err != nil {
+		return nil, err
 	}
 
 	// var config Config
@@ -0,0 +1,36 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// outputKey is the context key of the output of a copy.
+type outputKey struct{}
+
+// withOutput returns a context whose copy writes its messages to output. A
+// nil output keeps the messages in the standard logger.
+func withOutput(ctx context.Context, output io.Writer) context.Context {
+	if output == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, outputKey{}, output)
+}
+
+// logf writes a message of the copy of ctx to its output, see
+// CopyOptions.Output. Without an output it goes to the standard logger.
+func logf(ctx context.Context, format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	output, ok := ctx.Value(outputKey{}).(io.Writer)
+	if !ok {
+		log.Print(message)
+		return
+	}
+	if !strings.HasSuffix(message, "\n") {
+		message += "\n"
+	}
+	io.WriteString(output, message)
+}
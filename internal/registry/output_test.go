@@ -0,0 +1,38 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestLogf(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	var output bytes.Buffer
+	logf(withOutput(context.Background(), &output), "Downloading the image %s...", "busybox")
+	if got, want := output.String(), "Downloading the image busybox...\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("a message with an output went to the log: %q", logs.String())
+	}
+
+	// The output is kept by the contexts of the requests of the copy
+	ctx, cancel := context.WithCancel(withOutput(context.Background(), &output))
+	defer cancel()
+	output.Reset()
+	logf(ctx, "retrying\n")
+	if got, want := output.String(), "retrying\n"; got != want {
+		t.Errorf("output of a derived context = %q, want %q", got, want)
+	}
+
+	logf(withOutput(context.Background(), nil), "Uploading the image...")
+	if !bytes.Contains(logs.Bytes(), []byte("Uploading the image...")) {
+		t.Errorf("a message without an output did not go to the log: %q", logs.String())
+	}
+}
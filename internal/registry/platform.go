@@ -0,0 +1,158 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+var (
+	// ErrInvalidPlatform is error for when a platform can not be parsed
+	ErrInvalidPlatform = errors.New("invalid platform")
+	// ErrNoMatchingPlatform is error for when no manifest of the image matches the selected platforms
+	ErrNoMatchingPlatform = errors.New("no manifest matches the selected platforms")
+)
+
+// Platform is the platform of an image manifest, e.g. linux/arm64/v8.
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+	// OSVersion is the version of the operating system, which Windows images
+	// need to run. It is not part of the patterns of ParsePlatform.
+	OSVersion string `json:"os.version,omitempty"`
+}
+
+// ParsePlatform parses a platform in the os/architecture/variant form. The
+// components may contain the wildcards of path.Match, and missing components
+// match anything, so linux, linux/* and linux/arm* are all valid patterns.
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(strings.TrimSpace(s), "/")
+	if len(parts) > 3 || parts[0] == "" {
+		return Platform{}, fmt.Errorf("%w: %q", ErrInvalidPlatform, s)
+	}
+	for _, part := range parts {
+		if _, err := path.Match(part, ""); err != nil {
+			return Platform{}, fmt.Errorf("%w: %q: %v", ErrInvalidPlatform, s, err)
+		}
+	}
+
+	platform := Platform{OS: strings.ToLower(parts[0])}
+	if len(parts) > 1 {
+		platform.Architecture = strings.ToLower(parts[1])
+	}
+	if len(parts) > 2 {
+		platform.Variant = strings.ToLower(parts[2])
+	}
+	return platform, nil
+}
+
+// ParsePlatforms parses a list of platforms, see ParsePlatform.
+func ParsePlatforms(platforms []string) ([]Platform, error) {
+	var parsed []Platform
+	for _, s := range platforms {
+		platform, err := ParsePlatform(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, platform)
+	}
+	return parsed, nil
+}
+
+// String returns the platform in the os/architecture/variant form.
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// normalize fills in the variant docker assumes when a manifest does not specify one.
+func (p Platform) normalize() Platform {
+	if p.Architecture == "arm64" && p.Variant == "" {
+		p.Variant = "v8"
+	}
+	return p
+}
+
+// Matches reports whether the platform matches the pattern p.
+func (p Platform) Matches(platform Platform) bool {
+	platform = platform.normalize()
+	pattern := p
+	if pattern.Architecture == "arm64" && pattern.Variant == "" {
+		// linux/arm64 selects every arm64 variant
+		pattern.Variant = "*"
+	}
+
+	return matchComponent(pattern.OS, platform.OS) &&
+		matchComponent(pattern.Architecture, platform.Architecture) &&
+		matchComponent(pattern.Variant, platform.Variant)
+}
+
+// matchComponent matches a single platform component. An empty pattern matches anything.
+func matchComponent(pattern string, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, _ := path.Match(pattern, value)
+	return matched
+}
+
+// selectManifests returns the manifests of the index that match any of the
+// platforms. All manifests are selected when no platform is given.
+func selectManifests(manifests []ManifestEntry, platforms []Platform) []ManifestEntry {
+	if len(platforms) == 0 {
+		return manifests
+	}
+
+	var selected []ManifestEntry
+	for _, manifest := range manifests {
+		for _, platform := range platforms {
+			if platform.Matches(manifest.Platform) {
+				selected = append(selected, manifest)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// filterIndex rewrites the raw image index so it only lists the selected
+// manifests. Every other field of the index is kept as it is.
+func filterIndex(indexRaw []byte, selected []ManifestEntry) ([]byte, error) {
+	var index map[string]json.RawMessage
+	if err := json.Unmarshal(indexRaw, &index); err != nil {
+		return nil, err
+	}
+	var manifests []json.RawMessage
+	if err := json.Unmarshal(index["manifests"], &manifests); err != nil {
+		return nil, err
+	}
+
+	digests := map[string]bool{}
+	for _, manifest := range selected {
+		digests[manifest.Digest] = true
+	}
+
+	kept := []json.RawMessage{}
+	for _, manifestRaw := range manifests {
+		var manifest ManifestEntry
+		if err := json.Unmarshal(manifestRaw, &manifest); err != nil {
+			return nil, err
+		}
+		if digests[manifest.Digest] {
+			kept = append(kept, manifestRaw)
+		}
+	}
+
+	keptRaw, err := json.Marshal(kept)
+	if err != nil {
+		return nil, err
+	}
+	index["manifests"] = keptRaw
+	return json.Marshal(index)
+}
@@ -0,0 +1,166 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParsePlatform(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Platform
+	}{
+		{"linux", Platform{OS: "linux"}},
+		{"linux/amd64", Platform{OS: "linux", Architecture: "amd64"}},
+		{"linux/arm/v7", Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{" Linux/ARM64 ", Platform{OS: "linux", Architecture: "arm64"}},
+		{"linux/*", Platform{OS: "linux", Architecture: "*"}},
+		{"linux/arm*", Platform{OS: "linux", Architecture: "arm*"}},
+		{"*/amd64", Platform{OS: "*", Architecture: "amd64"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParsePlatform(tt.in)
+			if err != nil {
+				t.Fatalf("ParsePlatform(%q) error = %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParsePlatform(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePlatformInvalid(t *testing.T) {
+	tests := []string{"", "/amd64", "linux/arm/v7/extra", "linux/[arm"}
+	for _, in := range tests {
+		t.Run(in, func(t *testing.T) {
+			if _, err := ParsePlatform(in); !errors.Is(err, ErrInvalidPlatform) {
+				t.Errorf("ParsePlatform(%q) error = %v, want ErrInvalidPlatform", in, err)
+			}
+		})
+	}
+}
+
+func TestPlatformMatches(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		platform Platform
+		want     bool
+	}{
+		{"linux", Platform{OS: "linux", Architecture: "amd64"}, true},
+		{"linux", Platform{OS: "windows", Architecture: "amd64"}, false},
+		{"linux/amd64", Platform{OS: "linux", Architecture: "amd64"}, true},
+		{"linux/amd64", Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, false},
+		{"linux/arm64", Platform{OS: "linux", Architecture: "arm64"}, true},
+		{"linux/arm64", Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, true},
+		{"linux/arm64", Platform{OS: "linux", Architecture: "arm64", Variant: "v9"}, true},
+		{"linux/arm64/v8", Platform{OS: "linux", Architecture: "arm64"}, true},
+		{"linux/arm64/v8", Platform{OS: "linux", Architecture: "arm64", Variant: "v9"}, false},
+		{"linux/arm/v7", Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, true},
+		{"linux/arm/v7", Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, false},
+		{"linux/arm", Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, true},
+		{"linux/arm*", Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, true},
+		{"linux/*", Platform{OS: "linux", Architecture: "s390x"}, true},
+		{"*/amd64", Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.5122"}, true},
+		{"linux/amd64", Platform{OS: "unknown", Architecture: "unknown"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.platform.String(), func(t *testing.T) {
+			pattern, err := ParsePlatform(tt.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := pattern.Matches(tt.platform); got != tt.want {
+				t.Errorf("%q.Matches(%+v) = %v, want %v", tt.pattern, tt.platform, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterIndex(t *testing.T) {
+	index := `{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.oci.image.index.v1+json",
+		"manifests": [
+			{"digest": "sha256:amd64", "mediaType": "application/vnd.oci.image.manifest.v1+json", "size": 1, "platform": {"os": "linux", "architecture": "amd64"}},
+			{"digest": "sha256:arm64", "mediaType": "application/vnd.oci.image.manifest.v1+json", "size": 2, "platform": {"os": "linux", "architecture": "arm64", "variant": "v8"}, "annotations": {"a": "b"}}
+		],
+		"annotations": {"org.opencontainers.image.created": "2023-01-01T00:00:00Z"}
+	}`
+
+	tests := []struct {
+		name     string
+		selected []ManifestEntry
+		want     []string
+	}{
+		{name: "none", selected: nil, want: []string{}},
+		{name: "one", selected: []ManifestEntry{{Digest: "sha256:arm64"}}, want: []string{"sha256:arm64"}},
+		{name: "all", selected: []ManifestEntry{{Digest: "sha256:arm64"}, {Digest: "sha256:amd64"}}, want: []string{"sha256:amd64", "sha256:arm64"}},
+		{name: "unknown digest", selected: []ManifestEntry{{Digest: "sha256:s390x"}}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filtered, err := filterIndex([]byte(index), tt.selected)
+			if err != nil {
+				t.Fatalf("filterIndex() error = %v", err)
+			}
+			var got struct {
+				SchemaVersion int               `json:"schemaVersion"`
+				MediaType     string            `json:"mediaType"`
+				Manifests     []ManifestEntry   `json:"manifests"`
+				Annotations   map[string]string `json:"annotations"`
+			}
+			if err := json.Unmarshal(filtered, &got); err != nil {
+				t.Fatal(err)
+			}
+			digests := []string{}
+			for _, manifest := range got.Manifests {
+				digests = append(digests, manifest.Digest)
+			}
+			if !reflect.DeepEqual(digests, tt.want) {
+				t.Errorf("filterIndex() manifests = %v, want %v", digests, tt.want)
+			}
+			if got.SchemaVersion != 2 || got.MediaType == "" || got.Annotations["org.opencontainers.image.created"] == "" {
+				t.Errorf("filterIndex() dropped fields of the index: %s", filtered)
+			}
+		})
+	}
+
+	if _, err := filterIndex([]byte(`{"manifests": "nope"}`), nil); err == nil {
+		t.Error("filterIndex() of a malformed index error = nil")
+	}
+}
+
+func TestSelectManifests(t *testing.T) {
+	manifests := []ManifestEntry{
+		{Digest: "amd64", Platform: Platform{OS: "linux", Architecture: "amd64"}},
+		{Digest: "arm64", Platform: Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+		{Digest: "armv7", Platform: Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+	}
+	tests := []struct {
+		platforms []string
+		want      []string
+	}{
+		{nil, []string{"amd64", "arm64", "armv7"}},
+		{[]string{"linux/amd64"}, []string{"amd64"}},
+		{[]string{"linux/arm*"}, []string{"arm64", "armv7"}},
+		{[]string{"linux/arm64", "linux/*"}, []string{"amd64", "arm64", "armv7"}},
+		{[]string{"windows"}, nil},
+	}
+	for _, tt := range tests {
+		platforms, err := ParsePlatforms(tt.platforms)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, manifest := range selectManifests(manifests, platforms) {
+			got = append(got, manifest.Digest)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("selectManifests(%v) = %v, want %v", tt.platforms, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/akakream/MultiPlatform2IPFS/utils"
+)
+
+// defaultMaxConcurrentDownloads is the size of the process wide pool when
+// MAX_CONCURRENT_DOWNLOADS is not set. It stays below the connection limits
+// at which Docker Hub starts to throttle.
+const defaultMaxConcurrentDownloads = 8
+
+var (
+	processSlots     chan struct{}
+	processSlotsErr  error
+	processSlotsOnce sync.Once
+)
+
+// getProcessSlots returns the pool shared by every copy of the process. Its
+// size is MAX_CONCURRENT_DOWNLOADS.
+func getProcessSlots() (chan struct{}, error) {
+	processSlotsOnce.Do(func() {
+		size := defaultMaxConcurrentDownloads
+		value, err := utils.GetEnv("MAX_CONCURRENT_DOWNLOADS", "")
+		if err != nil {
+			processSlotsErr = err
+			return
+		}
+		if value != "" {
+			size, err = strconv.Atoi(value)
+			if err != nil || size < 1 {
+				processSlotsErr = fmt.Errorf("MAX_CONCURRENT_DOWNLOADS must be a positive number, got %q", value)
+				return
+			}
+		}
+		processSlots = make(chan struct{}, size)
+	})
+	return processSlots, processSlotsErr
+}
+
+// pool limits the number of concurrent registry requests of a single copy.
+// Every request takes a slot of the copy and a slot of the process.
+type pool struct {
+	jobSlots     chan struct{}
+	processSlots chan struct{}
+}
+
+// newPool returns a pool of the given size. A size of 0 only limits the copy by the process wide pool.
+func newPool(size int) (*pool, error) {
+	processSlots, err := getProcessSlots()
+	if err != nil {
+		return nil, err
+	}
+	p := &pool{processSlots: processSlots}
+	if size > 0 {
+		p.jobSlots = make(chan struct{}, size)
+	}
+	return p, nil
+}
+
+// acquire waits for a free slot. Call the returned function to give it back.
+func (p *pool) acquire(ctx context.Context) (func(), error) {
+	if p.jobSlots != nil {
+		select {
+		case p.jobSlots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	select {
+	case p.processSlots <- struct{}{}:
+	case <-ctx.Done():
+		if p.jobSlots != nil {
+			<-p.jobSlots
+		}
+		return nil, ctx.Err()
+	}
+
+	return func() {
+		<-p.processSlots
+		if p.jobSlots != nil {
+			<-p.jobSlots
+		}
+	}, nil
+}
@@ -0,0 +1,191 @@
+package registry
+
+import (
+	"sync"
+	"time"
+)
+
+// progressInterval limits how often the bytes of a single blob or of the
+// upload are reported.
+const progressInterval = 250 * time.Millisecond
+
+// Phase is the phase a copy is in.
+type Phase string
+
+const (
+	// PhaseDownloading is the download of the image from the registry.
+	PhaseDownloading Phase = "downloading"
+	// PhaseUploading is the add of the downloaded image to IPFS.
+	PhaseUploading Phase = "uploading"
+	// PhasePinning is the pin of the added image.
+	PhasePinning Phase = "pinning"
+)
+
+// ProgressEvent names what changed with a progress update.
+type ProgressEvent string
+
+const (
+	// EventPhase is reported when the copy enters a phase.
+	EventPhase ProgressEvent = "phase"
+	// EventDownload is reported when a download is scheduled or finished.
+	EventDownload ProgressEvent = "download"
+	// EventBlob is reported when bytes of a blob were downloaded.
+	EventBlob ProgressEvent = "blob"
+	// EventUpload is reported when bytes of the image were sent to IPFS.
+	EventUpload ProgressEvent = "upload"
+)
+
+// Progress reports how far a copy is.
+type Progress struct {
+	// Event is what changed with this update.
+	Event ProgressEvent `json:"-"`
+	Phase Phase         `json:"phase"`
+	// Completed is the number of finished downloads of manifests and layers.
+	Completed int `json:"completed"`
+	// Total is the number of downloads known so far. It grows while the
+	// manifests are fetched and their layers are found.
+	Total int `json:"total"`
+	// DownloadedBytes and DownloadTotalBytes are the downloaded and the total
+	// bytes of the layers known so far.
+	DownloadedBytes    int64 `json:"downloadedBytes"`
+	DownloadTotalBytes int64 `json:"downloadTotalBytes"`
+	// UploadedBytes and UploadTotalBytes are the bytes sent to IPFS and the
+	// size of the image.
+	UploadedBytes    int64 `json:"uploadedBytes"`
+	UploadTotalBytes int64 `json:"uploadTotalBytes"`
+	// Blob is the blob of an EventBlob update.
+	Blob *BlobProgress `json:"blob,omitempty"`
+}
+
+// BlobProgress is the download progress of a single blob.
+type BlobProgress struct {
+	Digest     string `json:"digest"`
+	Downloaded int64  `json:"downloaded"`
+	Total      int64  `json:"total"`
+}
+
+// progressReporter passes the progress of a copy to the callback of its
+// CopyOptions. The callback is never called concurrently.
+type progressReporter struct {
+	mu       sync.Mutex
+	callback func(Progress)
+	progress Progress
+	// lastUpload and uploadReported are the time and the bytes of the last
+	// reported upload update.
+	lastUpload     time.Time
+	uploadReported int64
+}
+
+func newProgressReporter(callback func(Progress)) *progressReporter {
+	return &progressReporter{callback: callback}
+}
+
+func (r *progressReporter) update(event ProgressEvent, change func(*Progress)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	change(&r.progress)
+	if r.callback != nil {
+		progress := r.progress
+		progress.Event = event
+		r.callback(progress)
+	}
+	r.progress.Blob = nil
+}
+
+// phase reports that the copy entered the phase.
+func (r *progressReporter) phase(phase Phase) {
+	r.update(EventPhase, func(p *Progress) { p.Phase = phase })
+}
+
+// scheduled reports a new download.
+func (r *progressReporter) scheduled() {
+	r.update(EventDownload, func(p *Progress) { p.Total++ })
+}
+
+// completed reports a finished download.
+func (r *progressReporter) completed() {
+	r.update(EventDownload, func(p *Progress) { p.Completed++ })
+}
+
+// blob returns the reporter of a new blob download with the total size.
+func (r *progressReporter) blob(digest string, total int64) *blobReporter {
+	r.mu.Lock()
+	r.progress.DownloadTotalBytes += total
+	r.mu.Unlock()
+	return &blobReporter{reporter: r, progress: BlobProgress{Digest: digest, Total: total}}
+}
+
+// uploadSize sets the size of the image that is sent to IPFS.
+func (r *progressReporter) uploadSize(size int64) {
+	r.mu.Lock()
+	r.progress.UploadTotalBytes = size
+	r.mu.Unlock()
+}
+
+// uploaded reports the bytes sent to IPFS so far. Updates are reported at
+// most every progressInterval, except for the last one.
+func (r *progressReporter) uploaded(sent int64) {
+	r.mu.Lock()
+	if sent > r.progress.UploadTotalBytes {
+		// The request has some overhead over the files
+		sent = r.progress.UploadTotalBytes
+	}
+	if sent == r.uploadReported ||
+		sent < r.progress.UploadTotalBytes && time.Since(r.lastUpload) < progressInterval {
+		r.mu.Unlock()
+		return
+	}
+	r.lastUpload = time.Now()
+	r.uploadReported = sent
+	r.mu.Unlock()
+	r.update(EventUpload, func(p *Progress) { p.UploadedBytes = sent })
+}
+
+// blobReporter reports the download of a single blob. It is written to with
+// the downloaded bytes. Updates are reported at most every progressInterval,
+// except for the one that completes the blob.
+type blobReporter struct {
+	reporter *progressReporter
+	mu       sync.Mutex
+	progress BlobProgress
+	reported int64
+	last     time.Time
+}
+
+// Write counts the downloaded bytes in p.
+func (b *blobReporter) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	b.progress.Downloaded += int64(len(p))
+	b.mu.Unlock()
+	b.report(false)
+	return len(p), nil
+}
+
+// set reports that downloaded bytes of the blob are present, e.g. when a
+// download is resumed or starts over.
+func (b *blobReporter) set(downloaded int64) {
+	b.mu.Lock()
+	b.progress.Downloaded = downloaded
+	b.mu.Unlock()
+	b.report(true)
+}
+
+func (b *blobReporter) report(force bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	complete := b.progress.Downloaded == b.progress.Total
+	if !force && !complete && time.Since(b.last) < progressInterval {
+		return
+	}
+	if b.progress.Downloaded == b.reported && !force {
+		return
+	}
+	b.last = time.Now()
+	delta := b.progress.Downloaded - b.reported
+	b.reported = b.progress.Downloaded
+	blob := b.progress
+	b.reporter.update(EventBlob, func(p *Progress) {
+		p.DownloadedBytes += delta
+		p.Blob = &blob
+	})
+}
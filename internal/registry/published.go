@@ -0,0 +1,69 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/akakream/MultiPlatform2IPFS/internal/ipfs"
+	"github.com/akakream/MultiPlatform2IPFS/utils"
+)
+
+// findPublished returns the result of an earlier copy of the image with the
+// same options, so the copy can be skipped. It returns nil if the image has
+// to be copied. The digest of the image is read with a HEAD request, or taken
+// from the reference.
+func findPublished(ctx context.Context, client *ipfs.Client, ref Reference, auth *authorizer, opts CopyOptions, timeout time.Duration) (*CopyResult, error) {
+	digest := ref.Digest
+	if digest == "" {
+		headCtx, cancel := withTimeout(ctx, timeout)
+		var err error
+		digest, err = headManifestDigest(headCtx, ref, auth)
+		cancel()
+		if err != nil {
+			// The copy itself reports the problem
+			logf(ctx, "Can not read the digest of %s: %v", ref, err)
+			return nil, nil
+		}
+		if digest == "" {
+			return nil, nil
+		}
+	}
+
+	result, err := opts.Lookup(digest)
+	if err != nil || result == nil {
+		return nil, err
+	}
+
+	check, err := checkPinned()
+	if err != nil {
+		return nil, err
+	}
+	if check {
+		pinned, err := client.IsPinned(ctx, result.Cid)
+		if err != nil {
+			return nil, fmt.Errorf("checking the pin of %s: %w", result.Cid, err)
+		}
+		if !pinned {
+			logf(ctx, "The image %s was published as %s, which is no longer pinned.", digest, result.Cid)
+			return nil, nil
+		}
+	}
+	result.Reused = true
+	return result, nil
+}
+
+// checkPinned reports whether a published image is only reused while its CID
+// is pinned, set with CHECK_PINNED. It defaults to true.
+func checkPinned() (bool, error) {
+	value, err := utils.GetEnv("CHECK_PINNED", "")
+	if err != nil || value == "" {
+		return true, err
+	}
+	check, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("CHECK_PINNED must be true or false, got %q", value)
+	}
+	return check, nil
+}
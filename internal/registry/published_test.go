@@ -0,0 +1,117 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/akakream/MultiPlatform2IPFS/internal/ipfs"
+)
+
+func TestFindPublished(t *testing.T) {
+	digest := digestBytes([]byte("index"))
+	errLookup := errors.New("store is broken")
+	published := map[string]*CopyResult{
+		digest: {Cid: "bafy-pinned", SourceDigest: digest},
+		// The image of the other digest was unpinned since it was copied
+		digestBytes([]byte("other index")): {Cid: "bafy-unpinned"},
+	}
+	lookup := func(digest string) (*CopyResult, error) {
+		if result, ok := published[digest]; ok {
+			copied := *result
+			return &copied, nil
+		}
+		return nil, nil
+	}
+
+	tests := []struct {
+		name        string
+		reference   string
+		headDigest  string
+		headStatus  int
+		lookup      func(string) (*CopyResult, error)
+		checkPinned string
+		wantCid     string
+		wantHeads   int32
+		wantErr     error
+	}{
+		{name: "published and pinned", reference: "app:latest", headDigest: digest, wantCid: "bafy-pinned", wantHeads: 1},
+		{name: "by digest without a request", reference: "app@" + digest, wantCid: "bafy-pinned"},
+		{name: "not published", reference: "app:latest", headDigest: digestBytes([]byte("new index")), wantHeads: 1},
+		{name: "no longer pinned", reference: "app:latest", headDigest: digestBytes([]byte("other index")), wantHeads: 1},
+		{
+			name: "pin is not checked", reference: "app:latest", headDigest: digestBytes([]byte("other index")),
+			checkPinned: "false", wantCid: "bafy-unpinned", wantHeads: 1,
+		},
+		{name: "registry without a digest", reference: "app:latest", wantHeads: 1},
+		{name: "registry fails", reference: "app:latest", headStatus: http.StatusInternalServerError, wantHeads: 1},
+		{
+			name: "lookup fails", reference: "app:latest", headDigest: digest, wantHeads: 1,
+			lookup:  func(string) (*CopyResult, error) { return nil, errLookup },
+			wantErr: errLookup,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CHECK_PINNED", tt.checkPinned)
+			var heads int32
+			registryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodHead {
+					t.Errorf("registry got a %s request, want only HEAD", r.Method)
+				}
+				atomic.AddInt32(&heads, 1)
+				if tt.headDigest != "" {
+					w.Header().Set("Docker-Content-Digest", tt.headDigest)
+				}
+				if tt.headStatus != 0 {
+					w.WriteHeader(tt.headStatus)
+				}
+			}))
+			defer registryServer.Close()
+			kubo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				cid := r.URL.Query().Get("arg")
+				if r.URL.Path != "/api/v0/pin/ls" || cid != "bafy-pinned" {
+					w.WriteHeader(http.StatusInternalServerError)
+					fmt.Fprintf(w, `{"Message":"path '%s' is not pinned","Code":0,"Type":"error"}`, cid)
+					return
+				}
+				fmt.Fprintf(w, `{"Keys":{%q:{"Type":"recursive"}}}`, cid)
+			}))
+			defer kubo.Close()
+			client, err := ipfs.NewClient(ipfs.Config{API: kubo.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ref, err := ParseReference(strings.TrimPrefix(registryServer.URL, "http://") + "/" + tt.reference)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := CopyOptions{Lookup: lookup}
+			if tt.lookup != nil {
+				opts.Lookup = tt.lookup
+			}
+			result, err := findPublished(context.Background(), client, ref, nil, opts, 0)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("findPublished() error = %v, want %v", err, tt.wantErr)
+			}
+			if heads != tt.wantHeads {
+				t.Errorf("findPublished() sent %d HEAD requests, want %d", heads, tt.wantHeads)
+			}
+			if tt.wantCid == "" {
+				if result != nil {
+					t.Errorf("findPublished() = %+v, want the image to be copied", result)
+				}
+				return
+			}
+			if result == nil || result.Cid != tt.wantCid || !result.Reused {
+				t.Errorf("findPublished() = %+v, want the reused image %s", result, tt.wantCid)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitPollInterval is how often the budget is checked again while a
+// copy waits for the rate limit window to move on.
+const rateLimitPollInterval = time.Minute
+
+// RateLimit is the pull budget a registry reported with the ratelimit-limit
+// and ratelimit-remaining headers, as Docker Hub does.
+type RateLimit struct {
+	// Registry is the host the limit was reported by.
+	Registry string `json:"registry"`
+	// Limit is the number of manifest pulls allowed in the window.
+	Limit int `json:"limit"`
+	// Remaining is the number of manifest pulls left in the window.
+	Remaining int `json:"remaining"`
+	// Window is the length of the window in seconds.
+	Window int `json:"window"`
+	// UpdatedAt is when the registry reported the limit.
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+var (
+	rateLimitsMu sync.Mutex
+	rateLimits   = map[string]RateLimit{}
+)
+
+// RateLimits returns the latest budget reported by every registry.
+func RateLimits() []RateLimit {
+	rateLimitsMu.Lock()
+	defer rateLimitsMu.Unlock()
+
+	limits := make([]RateLimit, 0, len(rateLimits))
+	for _, limit := range rateLimits {
+		limits = append(limits, limit)
+	}
+	sort.Slice(limits, func(i, j int) bool { return limits[i].Registry < limits[j].Registry })
+	return limits
+}
+
+// recordRateLimit remembers the budget of the response, if it has one.
+func recordRateLimit(resp *http.Response) (RateLimit, bool) {
+	limit, window, ok := parseRateLimitHeader(resp.Header.Get("ratelimit-limit"))
+	if !ok {
+		return RateLimit{}, false
+	}
+	remaining, _, ok := parseRateLimitHeader(resp.Header.Get("ratelimit-remaining"))
+	if !ok {
+		return RateLimit{}, false
+	}
+
+	rateLimit := RateLimit{
+		Registry:  resp.Request.URL.Host,
+		Limit:     limit,
+		Remaining: remaining,
+		Window:    window,
+		UpdatedAt: time.Now(),
+	}
+	rateLimitsMu.Lock()
+	rateLimits[rateLimit.Registry] = rateLimit
+	rateLimitsMu.Unlock()
+	return rateLimit, true
+}
+
+// parseRateLimitHeader parses a header such as "100;w=21600" into the number
+// and the window in seconds. The window is 0 if it is not given.
+func parseRateLimitHeader(header string) (int, int, bool) {
+	if header == "" {
+		return 0, 0, false
+	}
+	value, params, _ := strings.Cut(header, ";")
+	number, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || number < 0 {
+		return 0, 0, false
+	}
+
+	window := 0
+	for _, param := range strings.Split(params, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if key == "w" {
+			window, _ = strconv.Atoi(value)
+		}
+	}
+	return number, window, true
+}
+
+// headRateLimit asks the registry for the current budget with a HEAD request
+// for the manifest, which does not count as a pull. It returns false if the
+// registry does not report a limit.
+func headRateLimit(ctx context.Context, ref Reference, auth *authorizer) (RateLimit, bool, error) {
+	resp, err := headManifest(ctx, ref, auth)
+	if err != nil {
+		return RateLimit{}, false, err
+	}
+	defer resp.Body.Close()
+
+	limit, ok := recordRateLimit(resp)
+	return limit, ok, nil
+}
+
+// waitForBudget waits until the registry allows the given number of manifest
+// pulls, so a copy does not start only to run into the rate limit halfway.
+// Registries without a rate limit do not wait. timeout limits every check.
+func waitForBudget(ctx context.Context, ref Reference, auth *authorizer, pulls int, timeout time.Duration) error {
+	for {
+		checkCtx, cancel := withTimeout(ctx, timeout)
+		limit, ok, err := headRateLimit(checkCtx, ref, auth)
+		cancel()
+		if err != nil {
+			// The pull itself reports the problem
+			logf(ctx, "Can not check the rate limit of %s: %v", ref.endpoint(), err)
+			return nil
+		}
+		if !ok {
+			return nil
+		}
+		if pulls > limit.Limit {
+			// The budget never covers the copy, pull as far as it goes
+			pulls = limit.Limit
+		}
+		if limit.Remaining >= pulls {
+			logf(ctx, "Rate limit of %s: %d of %d pulls remaining, %d needed", limit.Registry, limit.Remaining, limit.Limit, pulls)
+			return nil
+		}
+
+		logf(ctx, "Rate limit of %s: %d of %d pulls remaining, %d needed, waiting for the window to move on", limit.Registry, limit.Remaining, limit.Limit, pulls)
+		timer := time.NewTimer(rateLimitPollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimitHeader(t *testing.T) {
+	tests := []struct {
+		header     string
+		wantNumber int
+		wantWindow int
+		wantOK     bool
+	}{
+		{"100;w=21600", 100, 21600, true},
+		{"76;w=21600", 76, 21600, true},
+		{"0;w=21600", 0, 21600, true},
+		{"100", 100, 0, true},
+		{" 100 ; w=60 ", 100, 60, true},
+		{"100;x=1;w=60", 100, 60, true},
+		{"", 0, 0, false},
+		{"many", 0, 0, false},
+		{"-1;w=60", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			number, window, ok := parseRateLimitHeader(tt.header)
+			if number != tt.wantNumber || window != tt.wantWindow || ok != tt.wantOK {
+				t.Errorf("parseRateLimitHeader(%q) = %d, %d, %v, want %d, %d, %v",
+					tt.header, number, window, ok, tt.wantNumber, tt.wantWindow, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRateLimitedStatusError(t *testing.T) {
+	tests := []struct {
+		name            string
+		status          int
+		remaining       string
+		retryAfter      string
+		wantRateLimited bool
+		wantRetryAfter  time.Duration
+	}{
+		{name: "budget exhausted", status: 429, remaining: "0;w=21600", wantRateLimited: true, wantRetryAfter: rateLimitPollInterval},
+		{name: "budget exhausted with retry-after", status: 429, remaining: "0;w=21600", retryAfter: "30", wantRateLimited: true, wantRetryAfter: 30 * time.Second},
+		{name: "throttled with budget left", status: 429, remaining: "10;w=21600"},
+		{name: "throttled without budget headers", status: 429, retryAfter: "5", wantRetryAfter: 5 * time.Second},
+		{name: "server error", status: 503, remaining: "0;w=21600"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.remaining != "" {
+					w.Header().Set("ratelimit-limit", "100;w=21600")
+					w.Header().Set("ratelimit-remaining", tt.remaining)
+				}
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			resp, err := http.Get(server.URL + "/v2/app/manifests/latest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			statusErr := newStatusError(resp)
+			if statusErr.RateLimited != tt.wantRateLimited || statusErr.RetryAfter != tt.wantRetryAfter {
+				t.Errorf("newStatusError() RateLimited = %v, RetryAfter = %s, want %v, %s",
+					statusErr.RateLimited, statusErr.RetryAfter, tt.wantRateLimited, tt.wantRetryAfter)
+			}
+		})
+	}
+}
+
+func TestWaitForBudget(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     string
+		remaining string
+		pulls     int
+		wantErr   error
+	}{
+		{name: "no rate limit", pulls: 3},
+		{name: "enough budget", limit: "100;w=21600", remaining: "3;w=21600", pulls: 3},
+		{name: "copy larger than the limit", limit: "2;w=21600", remaining: "2;w=21600", pulls: 3},
+		{name: "waits until cancelled", limit: "100;w=21600", remaining: "2;w=21600", pulls: 3, wantErr: context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodHead {
+					t.Errorf("budget checked with %s, a pull counts against the limit", r.Method)
+				}
+				if tt.limit != "" {
+					w.Header().Set("ratelimit-limit", tt.limit)
+					w.Header().Set("ratelimit-remaining", tt.remaining)
+				}
+			}))
+			defer server.Close()
+
+			ref, err := ParseReference(strings.TrimPrefix(server.URL, "http://") + "/app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			err = waitForBudget(ctx, ref, nil, tt.pulls, time.Second)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("waitForBudget() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
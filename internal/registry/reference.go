@@ -0,0 +1,163 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// defaultRegistry is the registry used when the reference does not name one.
+	defaultRegistry = "docker.io"
+	// defaultNamespace is prepended to single component Docker Hub repositories.
+	defaultNamespace = "library"
+	// defaultTag is used when the reference has neither a tag nor a digest.
+	defaultTag = "latest"
+	// dockerHubEndpoint is the host that serves the registry API for docker.io.
+	dockerHubEndpoint = "registry-1.docker.io"
+)
+
+var (
+	// ErrInvalidReference is error for when an image reference can not be parsed
+	ErrInvalidReference = errors.New("invalid image reference")
+
+	pathComponentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	tagRegexp           = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestRegexp        = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]{32,}$`)
+)
+
+// Reference is a parsed image reference such as ghcr.io/org/app:1.2 or
+// localhost:5000/team/svc@sha256:...
+type Reference struct {
+	// Registry is the registry host with an optional port, e.g. docker.io or localhost:5000.
+	Registry string
+	// Repository is the full repository path inside the registry, e.g. library/busybox.
+	Repository string
+	// Tag is the tag of the image. It is empty when the image is referenced by digest only.
+	Tag string
+	// Digest is the content digest of the image, e.g. sha256:...
+	Digest string
+}
+
+// ParseReference parses an image reference. Docker Hub and the library
+// namespace are used when the reference does not name a registry or a
+// namespace, and the latest tag is used when neither a tag nor a digest is given.
+func ParseReference(s string) (Reference, error) {
+	var ref Reference
+	if s == "" {
+		return ref, fmt.Errorf("%w: empty reference", ErrInvalidReference)
+	}
+
+	remainder := s
+	if i := strings.Index(remainder, "@"); i != -1 {
+		ref.Digest = remainder[i+1:]
+		remainder = remainder[:i]
+		if !digestRegexp.MatchString(ref.Digest) {
+			return Reference{}, fmt.Errorf("%w: invalid digest %q", ErrInvalidReference, ref.Digest)
+		}
+	}
+
+	// A colon after the last slash separates the tag. A colon before it belongs to the registry port.
+	if i := strings.LastIndex(remainder, ":"); i != -1 && i > strings.LastIndex(remainder, "/") {
+		ref.Tag = remainder[i+1:]
+		remainder = remainder[:i]
+		if !tagRegexp.MatchString(ref.Tag) {
+			return Reference{}, fmt.Errorf("%w: invalid tag %q", ErrInvalidReference, ref.Tag)
+		}
+	}
+
+	ref.Registry = defaultRegistry
+	if i := strings.Index(remainder, "/"); i != -1 && isRegistryHost(remainder[:i]) {
+		ref.Registry = remainder[:i]
+		remainder = remainder[i+1:]
+	}
+	if ref.Registry == "index.docker.io" || ref.Registry == dockerHubEndpoint {
+		ref.Registry = defaultRegistry
+	}
+
+	if remainder == "" {
+		return Reference{}, fmt.Errorf("%w: empty repository in %q", ErrInvalidReference, s)
+	}
+	for _, component := range strings.Split(remainder, "/") {
+		if !pathComponentRegexp.MatchString(component) {
+			return Reference{}, fmt.Errorf("%w: invalid repository %q", ErrInvalidReference, remainder)
+		}
+	}
+	if ref.Registry == defaultRegistry && !strings.Contains(remainder, "/") {
+		remainder = defaultNamespace + "/" + remainder
+	}
+	ref.Repository = remainder
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = defaultTag
+	}
+
+	return ref, nil
+}
+
+// isRegistryHost reports whether the first path component of a reference is a registry host.
+func isRegistryHost(component string) bool {
+	return strings.ContainsAny(component, ".:") || component == "localhost"
+}
+
+// Name returns the registry and repository of the reference, e.g. docker.io/library/busybox.
+func (r Reference) Name() string {
+	return r.Registry + "/" + r.Repository
+}
+
+// Reference returns the digest of the reference if it has one, otherwise its tag.
+func (r Reference) Reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// String returns the fully qualified reference.
+func (r Reference) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// endpoint returns the host that serves the registry API of the reference.
+func (r Reference) endpoint() string {
+	if r.Registry == defaultRegistry {
+		return dockerHubEndpoint
+	}
+	return r.Registry
+}
+
+// scheme returns the URL scheme used to talk to the registry. Registries on
+// the loopback interface are reached over plain http like the docker daemon does.
+func (r Reference) scheme() string {
+	host := r.Registry
+	if i := strings.LastIndex(host, ":"); i != -1 {
+		host = host[:i]
+	}
+	if host == "localhost" || host == "127.0.0.1" || host == "[::1]" {
+		return "http"
+	}
+	return "https"
+}
+
+// repositoryURL returns the base URL of the repository on the registry API.
+func (r Reference) repositoryURL() string {
+	return r.scheme() + "://" + r.endpoint() + "/v2/" + r.Repository
+}
+
+// manifestURL returns the URL of the manifest with the given tag or digest.
+func (r Reference) manifestURL(reference string) string {
+	return r.repositoryURL() + "/manifests/" + reference
+}
+
+// blobURL returns the URL of the blob with the given digest.
+func (r Reference) blobURL(digest string) string {
+	return r.repositoryURL() + "/blobs/" + digest
+}
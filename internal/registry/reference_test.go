@@ -0,0 +1,88 @@
+package registry
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	digest := "sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	tests := []struct {
+		in   string
+		want Reference
+	}{
+		{"busybox", Reference{Registry: "docker.io", Repository: "library/busybox", Tag: "latest"}},
+		{"busybox:1.36", Reference{Registry: "docker.io", Repository: "library/busybox", Tag: "1.36"}},
+		{"akakream/app", Reference{Registry: "docker.io", Repository: "akakream/app", Tag: "latest"}},
+		{"docker.io/library/busybox", Reference{Registry: "docker.io", Repository: "library/busybox", Tag: "latest"}},
+		{"index.docker.io/busybox", Reference{Registry: "docker.io", Repository: "library/busybox", Tag: "latest"}},
+		{"registry-1.docker.io/library/busybox", Reference{Registry: "docker.io", Repository: "library/busybox", Tag: "latest"}},
+		{"ghcr.io/org/team/app:1.2", Reference{Registry: "ghcr.io", Repository: "org/team/app", Tag: "1.2"}},
+		{"localhost/app", Reference{Registry: "localhost", Repository: "app", Tag: "latest"}},
+		{"localhost:5000/team/svc:v1", Reference{Registry: "localhost:5000", Repository: "team/svc", Tag: "v1"}},
+		{"localhost:5000/team/svc@" + digest, Reference{Registry: "localhost:5000", Repository: "team/svc", Digest: digest}},
+		{"busybox:1.36@" + digest, Reference{Registry: "docker.io", Repository: "library/busybox", Tag: "1.36", Digest: digest}},
+		{"quay.io/my_org/my-app__x", Reference{Registry: "quay.io", Repository: "my_org/my-app__x", Tag: "latest"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseReference(tt.in)
+			if err != nil {
+				t.Fatalf("ParseReference(%q) error = %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseReference(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseReferenceInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"BusyBox",
+		"busybox:",
+		"busybox:-bad",
+		"busybox@sha256:short",
+		"busybox@",
+		"ghcr.io/",
+		"org//app",
+		"app/",
+		"-app",
+	}
+	for _, in := range tests {
+		t.Run(in, func(t *testing.T) {
+			if _, err := ParseReference(in); !errors.Is(err, ErrInvalidReference) {
+				t.Errorf("ParseReference(%q) error = %v, want ErrInvalidReference", in, err)
+			}
+		})
+	}
+}
+
+func TestReferenceURLs(t *testing.T) {
+	tests := []struct {
+		in       string
+		str      string
+		manifest string
+	}{
+		{"busybox", "docker.io/library/busybox:latest", "https://registry-1.docker.io/v2/library/busybox/manifests/latest"},
+		{"ghcr.io/org/app:1.2", "ghcr.io/org/app:1.2", "https://ghcr.io/v2/org/app/manifests/1.2"},
+		{"localhost:5000/app:v1", "localhost:5000/app:v1", "http://localhost:5000/v2/app/manifests/v1"},
+		{"127.0.0.1:5000/app", "127.0.0.1:5000/app:latest", "http://127.0.0.1:5000/v2/app/manifests/latest"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			ref, err := ParseReference(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ref.String(); got != tt.str {
+				t.Errorf("String() = %q, want %q", got, tt.str)
+			}
+			if got := ref.manifestURL(ref.Reference()); got != tt.manifest {
+				t.Errorf("manifestURL() = %q, want %q", got, tt.manifest)
+			}
+		})
+	}
+}
@@ -2,14 +2,11 @@ package registry
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
-	"os"
+	"io"
 	"path/filepath"
-	"sync"
-
-	"github.com/joho/godotenv"
 
 	"github.com/akakream/MultiPlatform2IPFS/internal/fs"
 	"github.com/akakream/MultiPlatform2IPFS/internal/ipfs"
@@ -31,172 +28,411 @@ var acceptList = [9]string{
 var (
 	// ErrManifestIsNotFat is error for when the repository is not multi-platform
 	ErrManifestIsNotFat = errors.New("the repository is not multi-platform")
-	// ErrNonOKhttpStatus is error for when the http status is not OK.
+	// ErrNonOKhttpStatus is error for when the http status is not OK. Every
+	// StatusError matches it.
 	ErrNonOKhttpStatus = errors.New("the http status is not OK")
 )
 
-const registryEndpoint = "https://index.docker.io/v2/library/"
+// CopyOptions configure a single CopyImage call.
+type CopyOptions struct {
+	// Credentials are used for the registry instead of the ones in the docker config.json.
+	Credentials *Credentials
+	// Platforms select the platforms that are copied. All platforms are copied if it is empty.
+	Platforms []Platform
+	// Format is the layout of the directory that is added to IPFS. It defaults to FormatFlat.
+	Format ExportFormat
+	// Concurrency limits the concurrent downloads of the copy. The process wide
+	// limit MAX_CONCURRENT_DOWNLOADS applies as well. 0 means no extra limit.
+	Concurrency int
+	// KeepStaging keeps the staging directory of the copy for debugging.
+	// KEEP_STAGING_DIRS keeps the directories of every copy.
+	KeepStaging bool
+	// Progress is called whenever the copy enters a phase or a download
+	// is scheduled or finished. It may be nil.
+	Progress func(Progress)
+	// Output receives the messages of the copy, one per line. The messages
+	// go to the standard logger if it is nil.
+	Output io.Writer
+	// Lookup returns the result of an earlier copy with the same options of
+	// the image whose index, or manifest for images without an index, has
+	// the digest. It returns nil if there is none. The copy is skipped when
+	// it returns a result. It may be nil.
+	Lookup func(digest string) (*CopyResult, error)
+	// Force copies the image even if Lookup finds an earlier copy.
+	Force bool
+	// Add are the options the image is added to IPFS with. Nil uses the add
+	// options of the client.
+	Add *ipfs.AddOptions
+	// OnlyHash computes the CID the image would have without storing or
+	// pinning it.
+	OnlyHash bool
+}
 
-// const registryEndpoint = "https://registry-1.docker.io/v2/library/"
+// CopyResult describes an image that was copied to IPFS.
+type CopyResult struct {
+	Cid string
+	// SourceDigest is the digest of the index, or of the manifest for images
+	// without an index, as served by the registry.
+	SourceDigest string
+	// IndexDigest is the digest of the stored index. It differs from the
+	// upstream digest when the index was filtered by platform. It is the
+	// digest of the manifest for images without an index.
+	IndexDigest string
+	// Platforms are the platforms of the copied manifests.
+	Platforms []Platform
+	// Manifests are the copied manifests in the order of Platforms.
+	Manifests []PlatformManifest
+	// Reused reports that the image was published before and not copied again.
+	Reused bool
+}
 
-func CopyImage(ctx context.Context, imageName string, imageTag string) (string, error) {
-	fmt.Println("Removing existing files under the export directory...")
-	clearExportPath()
+// PlatformManifest is a copied manifest of a platform.
+type PlatformManifest struct {
+	Platform Platform `json:"platform"`
+	Digest   string   `json:"digest"`
+	// Size is the size of the manifest, its config and its layers in bytes.
+	Size int64 `json:"size"`
+}
 
-	fmt.Println("Downloading the image...")
-	err := downloadImage(imageName, imageTag)
+// CopyImage downloads the image of the reference into its own staging
+// directory under EXPORT_PATH and uploads it to IPFS, so concurrent copies do
+// not interfere. Cancelling ctx stops every transfer of the copy. The staging
+// directory is removed when the copy ends, only the partial layers are kept
+// to be resumed. An image that opts.Lookup finds is not copied
+// again, its earlier result is returned instead. The image is added to the
+// IPFS node of client.
+func CopyImage(ctx context.Context, client *ipfs.Client, ref Reference, opts CopyOptions) (*CopyResult, error) {
+	ctx = withOutput(ctx, opts.Output)
+	timeouts, err := getTimeouts()
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	keepStaging, err := keepStagingDirs(opts)
+	if err != nil {
+		return nil, err
 	}
 
-	fmt.Println("Uploading the image...")
-	cid, err := uploadImage()
+	authCtx, cancel := withTimeout(ctx, timeouts.auth)
+	creds, err := ResolveCredentials(authCtx, ref, opts.Credentials)
+	cancel()
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	auth, err := newAuthorizer(ctx, ref, creds, timeouts.auth)
+	if err != nil {
+		return nil, err
 	}
-	fmt.Println("The multi-arch image is uploaded to the IPFS!")
-	return cid, nil
-}
 
-func createFolderStructure() (string, string, error) {
-	if err := godotenv.Load(); err != nil {
-		panic(err)
+	if opts.Lookup != nil && !opts.Force {
+		published, err := findPublished(ctx, client, ref, auth, opts, timeouts.manifest)
+		if err != nil {
+			return nil, err
+		}
+		if published != nil {
+			logf(ctx, "The image %s is already published as %s.", ref, published.Cid)
+			return published, nil
+		}
+	}
+
+	exportPath, err := getExportPath()
+	if err != nil {
+		return nil, err
 	}
-	exportPath, err := utils.GetEnv("EXPORT_PATH", "./export")
+	staging, err := newStagingDir(exportPath)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	defer func() {
+		if keepStaging {
+			logf(ctx, "Keeping the staging directory %s", staging.path)
+			staging.unlock()
+			return
+		}
+		if err := staging.remove(); err != nil {
+			logf(ctx, "%v", err)
+		}
+	}()
 
-	dir_manifests := filepath.Join(exportPath, "manifests")
-	dir_blobs := filepath.Join(exportPath, "blobs")
-	err = fs.CreateDirs([]string{dir_manifests, dir_blobs})
+	progress := newProgressReporter(opts.Progress)
+	progress.phase(PhaseDownloading)
+	logf(ctx, "Downloading the image %s to %s...", ref, staging.path)
+	result, err := downloadImage(ctx, ref, auth, opts, timeouts, staging.path, progress)
 	if err != nil {
-		return "", "", err
+		return nil, fmt.Errorf("downloading %s: %w", ref, err)
 	}
 
-	return dir_manifests, dir_blobs, err
+	add := client.AddOptions()
+	if opts.Add != nil {
+		add = *opts.Add
+	}
+	progress.phase(PhaseUploading)
+	logf(ctx, "Uploading the image...")
+	uploadCtx, cancel := withTimeout(ctx, timeouts.upload)
+	defer cancel()
+	result.Cid, err = uploadImage(uploadCtx, client, staging.path, add, opts.OnlyHash, progress)
+	if err != nil {
+		return nil, err
+	}
+	if opts.OnlyHash {
+		logf(ctx, "The image would be published as %s.", result.Cid)
+		return result, nil
+	}
+	logf(ctx, "The multi-arch image is uploaded to the IPFS as %s!", result.Cid)
+	return result, nil
 }
 
-func downloadImage(imageName string, imageTag string) error {
-	token, err := getCachedOrNewToken(imageName, imageTag)
-	if err != nil {
-		return err
+// getExportPath returns EXPORT_PATH, the directory the staging directories are created in.
+func getExportPath() (string, error) {
+	if err := utils.LoadEnv(); err != nil {
+		return "", err
 	}
+	return utils.GetEnv("EXPORT_PATH", "./export")
+}
 
-	dir_manifests, dir_blobs, err := createFolderStructure()
+// download holds the state of downloading a single image.
+type download struct {
+	ctx       context.Context
+	ref       Reference
+	auth      *authorizer
+	timeouts  timeouts
+	layout    *exportLayout
+	blobs     *blobSet
+	scheduler *scheduler
+	progress  *progressReporter
+	// partialDir keeps the partial layers, see downloadLayer.
+	partialDir string
+}
+
+func downloadImage(
+	ctx context.Context,
+	ref Reference,
+	auth *authorizer,
+	opts CopyOptions,
+	timeouts timeouts,
+	dir string,
+	progress *progressReporter,
+) (*CopyResult, error) {
+	format := opts.Format
+	if format == "" {
+		format = FormatFlat
+	}
+	layout := &exportLayout{format: format, root: dir}
+
+	pool, err := newPool(opts.Concurrency)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	d := &download{
+		ctx:       ctx,
+		ref:       ref,
+		auth:      auth,
+		timeouts:  timeouts,
+		layout:    layout,
+		blobs:     newBlobSet(),
+		scheduler: newScheduler(ctx, pool, progress),
+		progress:  progress,
+		// The staging directories are in EXPORT_PATH, as are the partial layers
+		partialDir: filepath.Join(filepath.Dir(dir), partialDirName),
+	}
+	result := &CopyResult{}
+
+	if err := waitForBudget(ctx, ref, auth, 1, timeouts.manifest); err != nil {
+		return nil, err
 	}
 
-	fatManifest, fatManifestRaw, err := getFatManifest(imageName, imageTag, token)
-	downloadWG := sync.WaitGroup{}
+	var fatManifest *FatManifest
+	var fatManifestRaw []byte
+	err = withRetry(ctx, "fetching the index of "+ref.String(), func() error {
+		manifestCtx, cancel := withTimeout(ctx, timeouts.manifest)
+		defer cancel()
+		var err error
+		fatManifest, fatManifestRaw, err = getFatManifest(manifestCtx, ref, auth)
+		return err
+	})
+	if err != nil && !errors.Is(err, ErrManifestIsNotFat) {
+		return nil, err
+	}
 
 	if err != nil {
-		log.Println("For the provided repository name, there is no Fat Manifest.")
-		log.Print(err)
-		manifestRaw, err := getManifestWithLayers(
-			imageName,
-			"latest",
-			dir_manifests,
-			dir_blobs,
-			token,
-			&downloadWG,
-		)
-		if err != nil {
-			return err
+		logf(ctx, "For the provided repository name, there is no Fat Manifest: %v", err)
+		// The manifest was fetched in place of the index, it is not pulled again
+		manifestRaw := fatManifestRaw
+		d.scheduler.schedule("fetching the manifest "+ref.Reference(), func() error {
+			manifest, err := d.getManifestWithLayers(ref.Reference(), -1, nil, manifestRaw)
+			if err != nil {
+				return err
+			}
+			result.SourceDigest = manifest.Digest
+			result.IndexDigest = manifest.Digest
+			result.Platforms = []Platform{manifest.Platform}
+			result.Manifests = []PlatformManifest{manifest}
+			return nil
+		})
+	} else {
+		result.SourceDigest = digestBytes(fatManifestRaw)
+		selected := selectManifests(fatManifest.Manifests, opts.Platforms)
+		if len(selected) == 0 {
+			return nil, ErrNoMatchingPlatform
 		}
-		imageManifestSha256, err := fs.Sha256File(filepath.Join(dir_manifests, "latest"))
-		if err != nil {
-			return err
+		if len(opts.Platforms) > 0 {
+			fatManifestRaw, err = filterIndex(fatManifestRaw, selected)
+			if err != nil {
+				return nil, err
+			}
 		}
-		err = fs.WriteBytesToFile(
-			filepath.Join(dir_manifests, "sha256:"+imageManifestSha256),
-			manifestRaw,
-		)
-		if err != nil {
-			return err
+
+		if err := layout.assignDirs(selected); err != nil {
+			return nil, err
 		}
-	} else {
-		err = storeFatManifest(fatManifestRaw, dir_manifests)
+		result.IndexDigest, err = layout.storeIndex(fatManifestRaw)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		logf(ctx, "The index %s lists %d of %d manifests.", result.IndexDigest, len(selected), len(fatManifest.Manifests))
 
-		for _, manifestValue := range fatManifest.Manifests {
-			_, err = getManifestWithLayers(imageName, manifestValue.Digest, dir_manifests, dir_blobs, token, &downloadWG)
+		if err := waitForBudget(ctx, ref, auth, len(selected), timeouts.manifest); err != nil {
+			return nil, err
+		}
+
+		// The manifests and configs of the platforms are fetched in parallel.
+		// Every task fills in the size of its own manifest.
+		result.Manifests = make([]PlatformManifest, len(selected))
+		for i, manifestValue := range selected {
+			i, manifestValue := i, manifestValue
+			result.Manifests[i] = PlatformManifest{Platform: manifestValue.Platform, Digest: manifestValue.Digest}
+			d.scheduler.schedule("fetching the manifest "+manifestValue.Digest, func() error {
+				manifest, err := d.getManifestWithLayers(manifestValue.Digest, manifestValue.Size, &manifestValue.Platform, nil)
+				if err != nil {
+					return err
+				}
+				result.Manifests[i].Size = manifest.Size
+				return nil
+			})
+			result.Platforms = append(result.Platforms, manifestValue.Platform)
 		}
 	}
 
-	downloadWG.Wait()
-	return nil
+	if err := d.scheduler.wait(); err != nil {
+		return nil, err
+	}
+	if err := d.blobs.link(); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-func getManifestWithLayers(
-	imageName string,
-	manifestDigest string,
-	dir_manifests string,
-	dir_blobs string,
-	token string,
-	downloadWG *sync.WaitGroup,
-) ([]byte, error) {
-	manifest, manifestRaw, err := getManifest(imageName, manifestDigest, token)
-	if err != nil {
-		return nil, err
+// getManifestWithLayers stores the manifest with its config and schedules the
+// downloads of its layers. It is run by the scheduler, which retries it. size
+// is the size of the manifest in the index or -1. platform is nil for the
+// manifest of an image without an index, its platform is then read from the
+// config. fetched is the body of the manifest if it was fetched already,
+// otherwise nil. It returns the platform, the digest and the size of the
+// manifest.
+func (d *download) getManifestWithLayers(manifestDigest string, size int64, platform *Platform, fetched []byte) (PlatformManifest, error) {
+	var manifest Manifest
+	manifestRaw := fetched
+	if manifestRaw != nil {
+		if err := json.Unmarshal(manifestRaw, &manifest); err != nil {
+			return PlatformManifest{}, fmt.Errorf("decoding the manifest %s: %w", manifestDigest, err)
+		}
+	} else {
+		ctx, cancel := withTimeout(d.ctx, d.timeouts.manifest)
+		var err error
+		manifest, manifestRaw, err = getManifest(ctx, d.ref, manifestDigest, size, d.auth)
+		cancel()
+		if err != nil {
+			return PlatformManifest{}, err
+		}
 	}
 
-	err = fs.WriteBytesToFile(filepath.Join(dir_manifests, manifestDigest), manifestRaw)
+	ctx, cancel := withTimeout(d.ctx, d.timeouts.manifest)
+	config, err := getConfig(ctx, d.ref, manifest.Config, d.auth)
+	cancel()
 	if err != nil {
-		return nil, err
+		return PlatformManifest{}, err
+	}
+
+	topLevel := platform == nil
+	if topLevel {
+		configPlatform, err := platformOfConfig(config)
+		if err != nil {
+			return PlatformManifest{}, err
+		}
+		platform = &configPlatform
 	}
 
-	config, err := getConfig(imageName, manifest.Config.Digest, token)
+	dir := d.layout.dirName(manifestDigest, *platform)
+	if err := d.layout.createDirs(dir); err != nil {
+		return PlatformManifest{}, err
+	}
+	dir_blobs := d.layout.blobDir(dir)
+
+	digest, err := d.layout.storeManifest(dir, manifestDigest, manifestRaw, topLevel)
 	if err != nil {
-		return nil, err
+		return PlatformManifest{}, err
+	}
+	if topLevel {
+		mediaType := manifest.MediaType
+		if mediaType == "" {
+			mediaType = "application/vnd.oci.image.manifest.v1+json"
+		}
+		err := d.layout.storeManifestList(ManifestEntry{
+			Digest:    digest,
+			MediaType: mediaType,
+			Platform:  *platform,
+			Size:      int64(len(manifestRaw)),
+		})
+		if err != nil {
+			return PlatformManifest{}, err
+		}
 	}
 
 	err = fs.WriteBytesToFile(filepath.Join(dir_blobs, manifest.Config.Digest), config)
 	if err != nil {
-		return nil, err
+		return PlatformManifest{}, err
 	}
 
+	imageSize := int64(len(manifestRaw)) + int64(len(config))
 	for _, layerValue := range manifest.Layers {
-		// TODO: ADD RETRY HERE
-		downloadWG.Add(1)
-		go downloadLayer(
-			imageName,
-			layerValue.Digest,
-			token,
-			filepath.Join(dir_blobs, layerValue.Digest),
-			downloadWG,
-		)
-	}
-	return nil, nil
+		imageSize += layerValue.Size
+		destination := filepath.Join(dir_blobs, layerValue.Digest)
+		if !d.blobs.add(layerValue.Digest, destination) {
+			continue
+		}
+		layer := layerValue
+		blob := d.progress.blob(layer.Digest, layer.Size)
+		d.scheduler.schedule("downloading the layer "+layer.Digest, func() error {
+			// Every attempt resumes from the partial file of the previous one
+			ctx, cancel := withTimeout(d.ctx, d.timeouts.blob)
+			defer cancel()
+			return downloadLayer(ctx, d.ref, layer, d.auth, d.partialDir, destination, blob)
+		})
+	}
+	return PlatformManifest{Platform: *platform, Digest: digest, Size: imageSize}, nil
 }
 
-func uploadImage() (string, error) {
-	fmt.Println("uploadImage")
-	if err := godotenv.Load(); err != nil {
-		panic(err)
-	}
-	exportPath, err := utils.GetEnv("EXPORT_PATH", "./export")
-	if err != nil {
-		panic(err)
-	}
-	cid, err := ipfs.Add(exportPath, true)
+// uploadImage adds the staging directory to IPFS and pins it, unless onlyHash
+// is set. The pinning phase starts once the files are sent, the node pins
+// them before it answers the add.
+func uploadImage(ctx context.Context, client *ipfs.Client, dir string, add ipfs.AddOptions, onlyHash bool, progress *progressReporter) (string, error) {
+	size, err := fs.DirSize(dir)
 	if err != nil {
 		return "", err
 	}
-	return cid, nil
-}
-
-func clearExportPath() {
-	if err := godotenv.Load(); err != nil {
-		panic(err)
-	}
-	exportPath, err := utils.GetEnv("EXPORT_PATH", "./export")
+	progress.uploadSize(size)
+	pinning := false
+	cid, err := client.Add(ctx, dir, add, onlyHash, func(sent int64) {
+		progress.uploaded(sent)
+		if sent >= size && !onlyHash && !pinning {
+			// The files are sent, the node stores their last blocks and pins
+			// them before it answers
+			pinning = true
+			progress.phase(PhasePinning)
+		}
+	})
 	if err != nil {
-		panic(err)
+		return "", fmt.Errorf("adding %s to IPFS: %w", dir, err)
 	}
-
-	os.RemoveAll(exportPath)
+	return cid, nil
 }
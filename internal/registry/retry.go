@@ -0,0 +1,113 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxAttempts is how often a request is tried before its error is returned.
+	maxAttempts = 5
+	// retryBaseDelay is the delay before the first retry. It doubles with every further retry.
+	retryBaseDelay = 500 * time.Millisecond
+	// retryMaxDelay caps the delay between two attempts.
+	retryMaxDelay = 30 * time.Second
+)
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// isRetryable reports whether a failed request may succeed when it is sent
+// again. That is the case for server errors, rate limiting, network errors
+// and requests that ran into their phase timeout.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryDelay returns the jittered exponential backoff before the next
+// attempt. A longer delay requested by the registry is honoured.
+func retryDelay(attempt int, err error) time.Duration {
+	delay := retryBaseDelay << (attempt - 1)
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+	// Full jitter in the upper half keeps parallel downloads from retrying in lockstep
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > delay {
+		delay = statusErr.RetryAfter
+	}
+	return delay
+}
+
+// isRateLimited reports whether the request failed because the pull budget
+// of the registry is exhausted.
+func isRateLimited(err error) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.RateLimited
+}
+
+// withRetry calls fn until it succeeds, fails with an error that is not
+// retryable or maxAttempts is reached. Attempts that hit an exhausted rate
+// limit do not count, the request waits until the registry serves it again.
+// It stops waiting when ctx is done.
+func withRetry(ctx context.Context, description string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err != nil && ctx.Err() != nil {
+			// The copy is cancelled or ran out of time, not only the attempt
+			return ctx.Err()
+		}
+		if err == nil || !isRetryable(err) || attempt == maxAttempts && !isRateLimited(err) {
+			return err
+		}
+
+		delay := retryDelay(attempt, err)
+		if isRateLimited(err) {
+			attempt--
+			logf(ctx, "%s hit the rate limit, retrying in %s: %v", description, delay.Round(time.Millisecond), err)
+		} else {
+			logf(ctx, "%s failed (attempt %d of %d), retrying in %s: %v", description, attempt, maxAttempts, delay.Round(time.Millisecond), err)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		header string
+		min    time.Duration
+		max    time.Duration
+	}{
+		{"", 0, 0},
+		{"0", 0, 0},
+		{"-5", 0, 0},
+		{"120", 120 * time.Second, 120 * time.Second},
+		{"soon", 0, 0},
+		{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			if got := parseRetryAfter(tt.header); got < tt.min || got > tt.max {
+				t.Errorf("parseRetryAfter(%q) = %s, want between %s and %s", tt.header, got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"server error", &StatusError{StatusCode: http.StatusBadGateway}, true},
+		{"too many requests", &StatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{"not found", &StatusError{StatusCode: http.StatusNotFound}, false},
+		{"unauthorized", &StatusError{StatusCode: http.StatusUnauthorized}, false},
+		{"wrapped server error", fmt.Errorf("layer: %w", &StatusError{StatusCode: http.StatusServiceUnavailable}), true},
+		{"network error", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"truncated body", fmt.Errorf("layer: %w", io.ErrUnexpectedEOF), true},
+		{"phase timeout", fmt.Errorf("layer: %w", context.DeadlineExceeded), true},
+		{"cancelled", fmt.Errorf("layer: %w", context.Canceled), false},
+		{"digest mismatch", &VerificationError{}, false},
+		{"other", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		attempt int
+		err     error
+		min     time.Duration
+		max     time.Duration
+	}{
+		{"first", 1, errors.New("boom"), retryBaseDelay / 2, retryBaseDelay},
+		{"second", 2, errors.New("boom"), retryBaseDelay, 2 * retryBaseDelay},
+		{"fourth", 4, errors.New("boom"), 4 * retryBaseDelay, 8 * retryBaseDelay},
+		{"capped", 10, errors.New("boom"), retryMaxDelay / 2, retryMaxDelay},
+		{"overflow", 100, errors.New("boom"), retryMaxDelay / 2, retryMaxDelay},
+		{"retry-after is honoured", 1, &StatusError{StatusCode: 429, RetryAfter: time.Minute}, time.Minute, time.Minute},
+		{"shorter retry-after is ignored", 4, &StatusError{StatusCode: 503, RetryAfter: time.Millisecond}, 4 * retryBaseDelay, 8 * retryBaseDelay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				if got := retryDelay(tt.attempt, tt.err); got < tt.min || got > tt.max {
+					t.Fatalf("retryDelay(%d, %v) = %s, want between %s and %s", tt.attempt, tt.err, got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		errs     []error
+		wantErr  error
+		wantRuns int
+	}{
+		{name: "success", ctx: context.Background(), errs: []error{nil}, wantRuns: 1},
+		{name: "retried once", ctx: context.Background(), errs: []error{&StatusError{StatusCode: 502}, nil}, wantRuns: 2},
+		{name: "not retryable", ctx: context.Background(), errs: []error{&StatusError{StatusCode: 404, URL: "/manifests/x"}}, wantErr: ErrManifestUnknown, wantRuns: 1},
+		{name: "cancelled", ctx: cancelled, errs: []error{&StatusError{StatusCode: 502}}, wantErr: context.Canceled, wantRuns: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs := 0
+			err := withRetry(tt.ctx, "test", func() error {
+				err := tt.errs[runs]
+				runs++
+				return err
+			})
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("withRetry() error = %v, want %v", err, tt.wantErr)
+			}
+			if runs != tt.wantRuns {
+				t.Errorf("withRetry() ran %d times, want %d", runs, tt.wantRuns)
+			}
+		})
+	}
+}
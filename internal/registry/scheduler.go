@@ -0,0 +1,69 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// scheduler runs the downloads of an image in the background, bounded by
+// its pool. Every download is retried on its own, and the errors of the
+// downloads that still fail are gathered so the copy fails instead of
+// uploading a broken image.
+type scheduler struct {
+	ctx      context.Context
+	pool     *pool
+	progress *progressReporter
+	wg       sync.WaitGroup
+
+	mu    sync.Mutex
+	errs  []error
+	tasks int
+}
+
+func newScheduler(ctx context.Context, pool *pool, progress *progressReporter) *scheduler {
+	return &scheduler{ctx: ctx, pool: pool, progress: progress}
+}
+
+// schedule runs the task in the background with retries. Every attempt
+// waits for a slot of the pool, the slot is given back between attempts.
+func (s *scheduler) schedule(description string, task func() error) {
+	s.mu.Lock()
+	s.tasks++
+	s.mu.Unlock()
+	s.progress.scheduled()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		err := withRetry(s.ctx, description, func() error {
+			release, err := s.pool.acquire(s.ctx)
+			if err != nil {
+				return err
+			}
+			defer release()
+			return task()
+		})
+		if err != nil {
+			logf(s.ctx, "%s failed: %v", description, err)
+			s.mu.Lock()
+			s.errs = append(s.errs, fmt.Errorf("%s: %w", description, err))
+			s.mu.Unlock()
+			return
+		}
+		s.progress.completed()
+	}()
+}
+
+// wait waits for every scheduled task. It returns the first error, annotated
+// with the number of failed tasks, if any task failed.
+func (s *scheduler) wait() error {
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d downloads failed, first error: %w", len(s.errs), s.tasks, s.errs[0])
+}
@@ -0,0 +1,284 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tryAcquire acquires a slot of the pool unless it stays full for a while.
+func tryAcquire(p *pool) (func(), bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	release, err := p.acquire(ctx)
+	return release, err == nil
+}
+
+func TestPoolLimits(t *testing.T) {
+	processSlots := make(chan struct{}, 3)
+	first := &pool{jobSlots: make(chan struct{}, 2), processSlots: processSlots}
+	second := &pool{jobSlots: make(chan struct{}, 2), processSlots: processSlots}
+	unlimited := &pool{processSlots: processSlots}
+
+	// The first copy is limited by its own pool
+	releaseFirst, ok := tryAcquire(first)
+	if !ok {
+		t.Fatal("acquire() of an empty pool failed")
+	}
+	if _, ok := tryAcquire(first); !ok {
+		t.Fatal("acquire() of the second slot of a copy failed")
+	}
+	if _, ok := tryAcquire(first); ok {
+		t.Fatal("acquire() took a third slot of a copy of size 2")
+	}
+
+	// The second copy is limited by the process wide pool
+	releaseSecond, ok := tryAcquire(second)
+	if !ok {
+		t.Fatal("acquire() of another copy failed while the process had a free slot")
+	}
+	if _, ok := tryAcquire(second); ok {
+		t.Fatal("acquire() took a fourth slot of a process of size 3")
+	}
+	if _, ok := tryAcquire(unlimited); ok {
+		t.Fatal("acquire() of a copy without a limit took a fourth slot of a process of size 3")
+	}
+	// Waiting for the process gives the slot of the copy back
+	if len(second.jobSlots) != 1 {
+		t.Errorf("copy holds %d slots after a cancelled acquire(), want 1", len(second.jobSlots))
+	}
+
+	releaseSecond()
+	if release, ok := tryAcquire(unlimited); !ok {
+		t.Error("acquire() failed after a slot of the process was given back")
+	} else {
+		release()
+	}
+	releaseFirst()
+	if len(first.jobSlots) != 1 || len(processSlots) != 1 {
+		t.Errorf("pools hold %d slots of the copy and %d of the process, want 1 and 1", len(first.jobSlots), len(processSlots))
+	}
+}
+
+func TestPoolConcurrency(t *testing.T) {
+	processSlots := make(chan struct{}, 3)
+	pools := []*pool{
+		{jobSlots: make(chan struct{}, 2), processSlots: processSlots},
+		{jobSlots: make(chan struct{}, 2), processSlots: processSlots},
+	}
+
+	var mu sync.Mutex
+	var running, maxRunning int
+	runningOf := make([]int, len(pools))
+	var wg sync.WaitGroup
+	for i, p := range pools {
+		for j := 0; j < 10; j++ {
+			wg.Add(1)
+			go func(i int, p *pool) {
+				defer wg.Done()
+				release, err := p.acquire(context.Background())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer release()
+
+				mu.Lock()
+				running++
+				runningOf[i]++
+				if running > maxRunning {
+					maxRunning = running
+				}
+				if runningOf[i] > 2 {
+					t.Errorf("copy %d runs %d downloads, want at most 2", i, runningOf[i])
+				}
+				mu.Unlock()
+
+				time.Sleep(time.Millisecond)
+
+				mu.Lock()
+				running--
+				runningOf[i]--
+				mu.Unlock()
+			}(i, p)
+		}
+	}
+	wg.Wait()
+	if maxRunning > 3 {
+		t.Errorf("process ran %d downloads at once, want at most 3", maxRunning)
+	}
+}
+
+func TestNewPool(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		size    int
+		want    int
+		wantErr bool
+	}{
+		{name: "default", want: defaultMaxConcurrentDownloads},
+		{name: "MAX_CONCURRENT_DOWNLOADS", env: "3", size: 2, want: 3},
+		{name: "zero", env: "0", wantErr: true},
+		{name: "not a number", env: "many", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The process wide pool is created once per process
+			processSlots, processSlotsErr = nil, nil
+			processSlotsOnce = sync.Once{}
+			t.Cleanup(func() {
+				processSlots, processSlotsErr = nil, nil
+				processSlotsOnce = sync.Once{}
+			})
+			t.Setenv("MAX_CONCURRENT_DOWNLOADS", tt.env)
+
+			p, err := newPool(tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newPool() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if cap(p.processSlots) != tt.want {
+				t.Errorf("process wide pool has %d slots, want %d", cap(p.processSlots), tt.want)
+			}
+			if cap(p.jobSlots) != tt.size {
+				t.Errorf("pool of the copy has %d slots, want %d", cap(p.jobSlots), tt.size)
+			}
+		})
+	}
+}
+
+func TestSchedulerCollectsErrors(t *testing.T) {
+	errFirst, errSecond := errors.New("first"), errors.New("second")
+	tests := []struct {
+		name    string
+		tasks   []error
+		wantErr []error
+	}{
+		{name: "no failure", tasks: []error{nil, nil}},
+		{name: "one failure", tasks: []error{nil, errFirst, nil}, wantErr: []error{errFirst}},
+		{name: "every task fails", tasks: []error{errFirst, errSecond}, wantErr: []error{errFirst, errSecond}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &pool{jobSlots: make(chan struct{}, 1), processSlots: make(chan struct{}, 1)}
+			s := newScheduler(context.Background(), p, newProgressReporter(nil))
+			var mu sync.Mutex
+			calls := 0
+			for i, taskErr := range tt.tasks {
+				taskErr := taskErr
+				s.schedule(fmt.Sprintf("task %d", i), func() error {
+					mu.Lock()
+					calls++
+					mu.Unlock()
+					return taskErr
+				})
+			}
+
+			err := s.wait()
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("wait() error = %v", err)
+				}
+			} else {
+				want := fmt.Sprintf("%d of %d downloads failed", len(tt.wantErr), len(tt.tasks))
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Fatalf("wait() error = %v, want %q", err, want)
+				}
+				matched := false
+				for _, wantErr := range tt.wantErr {
+					matched = matched || errors.Is(err, wantErr)
+				}
+				if !matched {
+					t.Errorf("wait() error = %v, want one of %v", err, tt.wantErr)
+				}
+			}
+			// Errors that are not retryable are not tried again
+			if calls != len(tt.tasks) {
+				t.Errorf("tasks ran %d times, want %d", calls, len(tt.tasks))
+			}
+		})
+	}
+}
+
+func TestDownloadImageCollectsPlatformErrors(t *testing.T) {
+	config := `{"architecture":"amd64","os":"linux"}`
+	layer := "layer content"
+	manifest := func(layerDigest string) string {
+		return fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",`+
+			`"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":%q,"size":%d},`+
+			`"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":%q,"size":%d}]}`,
+			digestBytes([]byte(config)), len(config), layerDigest, len(layer))
+	}
+	// amd64 is complete, the manifest of arm64 and the layer of arm are missing
+	amd64 := manifest(digestBytes([]byte(layer)))
+	arm64 := manifest(digestBytes([]byte("arm64 layer")))
+	arm := manifest(digestBytes([]byte("arm layer")))
+	entry := func(body, arch string) string {
+		return fmt.Sprintf(`{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":%q,"size":%d,"platform":{"architecture":%q,"os":"linux"}}`,
+			digestBytes([]byte(body)), len(body), arch)
+	}
+	index := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[` +
+		entry(amd64, "amd64") + "," + entry(arm64, "arm64") + "," + entry(arm, "arm") + `]}`
+
+	blobs := map[string]string{
+		"/v2/app/manifests/latest":                        index,
+		"/v2/app/manifests/" + digestBytes([]byte(amd64)): amd64,
+		"/v2/app/manifests/" + digestBytes([]byte(arm)):   arm,
+		"/v2/app/blobs/" + digestBytes([]byte(config)):    config,
+		"/v2/app/blobs/" + digestBytes([]byte(layer)):     layer,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := blobs[r.URL.Path]
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			code := "BLOB_UNKNOWN"
+			if strings.Contains(r.URL.Path, "/manifests/") {
+				code = "MANIFEST_UNKNOWN"
+			}
+			fmt.Fprintf(w, `{"errors":[{"code":%q}]}`, code)
+			return
+		}
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			var mediaType string
+			if body == index {
+				mediaType = "application/vnd.oci.image.index.v1+json"
+			} else {
+				mediaType = "application/vnd.oci.image.manifest.v1+json"
+			}
+			w.Header().Set("Content-Type", mediaType)
+		}
+		if r.Method != http.MethodHead {
+			w.Write([]byte(body))
+		}
+	}))
+	defer server.Close()
+
+	ref, err := ParseReference(strings.TrimPrefix(server.URL, "http://") + "/app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "staging")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	_, err = downloadImage(context.Background(), ref, nil, CopyOptions{}, timeouts{}, dir, newProgressReporter(nil))
+	// Three manifests and two layers are scheduled, the copy waits for all of them
+	if err == nil || !strings.Contains(err.Error(), "2 of 5 downloads failed") {
+		t.Fatalf("downloadImage() error = %v, want 2 of 5 failed downloads", err)
+	}
+	if !errors.Is(err, ErrManifestUnknown) && !errors.Is(err, ErrBlobUnknown) {
+		t.Errorf("downloadImage() error = %v, want the error of a platform", err)
+	}
+}
@@ -0,0 +1,180 @@
+package registry
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akakream/MultiPlatform2IPFS/internal/fs"
+	"github.com/akakream/MultiPlatform2IPFS/utils"
+)
+
+// stagingDirPrefix is the prefix of the staging directories under EXPORT_PATH.
+const stagingDirPrefix = "job-"
+
+// stagingDir is the directory a single copy downloads its image to before it
+// is added to IPFS. It is locked by the process of the copy with a lock file
+// next to it, so it is never added to IPFS with the image.
+type stagingDir struct {
+	path   string
+	unlock func()
+}
+
+// newStagingDir creates a locked staging directory with a random name under root.
+func newStagingDir(root string) (*stagingDir, error) {
+	if err := fs.CreateDir(root); err != nil {
+		return nil, fmt.Errorf("creating the export directory: %w", err)
+	}
+
+	for {
+		suffix := make([]byte, 8)
+		if _, err := rand.Read(suffix); err != nil {
+			return nil, err
+		}
+		path := filepath.Join(root, stagingDirPrefix+hex.EncodeToString(suffix))
+
+		// The lock is taken before the directory exists, so the cleanup of
+		// stale directories never sees an unlocked directory of a running copy
+		unlock, locked, err := fs.TryLockFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if !locked {
+			continue
+		}
+		if err := os.Mkdir(path, 0755); err != nil {
+			unlock()
+			if os.IsExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("creating the staging directory: %w", err)
+		}
+		return &stagingDir{path: path, unlock: unlock}, nil
+	}
+}
+
+// remove removes the staging directory and releases its lock.
+func (s *stagingDir) remove() error {
+	defer s.unlock()
+	if err := os.RemoveAll(s.path); err != nil {
+		return fmt.Errorf("removing the staging directory: %w", err)
+	}
+	return nil
+}
+
+// keepStagingDirs reports whether staging directories are kept after a copy,
+// either for the copy or for every copy with KEEP_STAGING_DIRS.
+func keepStagingDirs(opts CopyOptions) (bool, error) {
+	if opts.KeepStaging {
+		return true, nil
+	}
+	value, err := utils.GetEnv("KEEP_STAGING_DIRS", "")
+	if err != nil || value == "" {
+		return false, err
+	}
+	keep, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("KEEP_STAGING_DIRS must be true or false, got %q", value)
+	}
+	return keep, nil
+}
+
+// CleanStagingDirs removes the staging directories that were left behind by
+// copies whose process is gone, e.g. after a crash. Directories of running
+// copies are kept, as their process still holds the lock. It returns the
+// number of removed directories. Partial layers that were not written to for
+// partialLayerMaxAge are removed as well, see cleanPartialLayers.
+func CleanStagingDirs() (int, error) {
+	root, err := getExportPath()
+	if err != nil {
+		return 0, err
+	}
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Lock files without a directory are left behind as well
+	names := map[string]bool{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), stagingDirPrefix) {
+			names[strings.TrimSuffix(entry.Name(), ".lock")] = true
+		}
+	}
+
+	removed := 0
+	for name := range names {
+		path := filepath.Join(root, name)
+		unlock, locked, err := fs.TryLockFile(path)
+		if err != nil {
+			return removed, err
+		}
+		if !locked {
+			continue
+		}
+		_, statErr := os.Stat(path)
+		err = os.RemoveAll(path)
+		unlock()
+		if err != nil {
+			return removed, fmt.Errorf("removing the stale staging directory: %w", err)
+		}
+		if statErr == nil {
+			log.Printf("Removed the stale staging directory %s", path)
+			removed++
+		}
+	}
+	return removed, cleanPartialLayers(filepath.Join(root, partialDirName), partialLayerMaxAge)
+}
+
+// cleanPartialLayers removes the partial layers in dir that were not written
+// to for maxAge, so downloads that are never resumed do not fill the disk.
+// Partial layers that a download holds the lock of are kept.
+func cleanPartialLayers(dir string, maxAge time.Duration) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".lock") {
+			continue
+		}
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		unlock, locked, err := fs.TryLockFile(path)
+		if err != nil {
+			return err
+		}
+		if !locked {
+			continue
+		}
+		err = os.Remove(path)
+		unlock()
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing the stale partial layer: %w", err)
+		}
+		log.Printf("Removed the stale partial layer %s", path)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package registry
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/akakream/MultiPlatform2IPFS/internal/fs"
+)
+
+func TestCleanStagingDirs(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("EXPORT_PATH", root)
+
+	// The copy of a running process holds the lock of its directory
+	running, err := newStagingDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer running.remove()
+	if err := os.WriteFile(filepath.Join(running.path, "index.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The copy of a crashed process left its directory behind, the kernel released its lock
+	crashed, err := newStagingDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(crashed.path, "index.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	crashed.unlock()
+
+	for _, name := range []string{"job-orphan.lock", "busybox.tar"} {
+		if err := os.WriteFile(filepath.Join(root, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	partialDir := filepath.Join(root, partialDirName)
+	if err := os.MkdirAll(partialDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * partialLayerMaxAge)
+	for _, name := range []string{"stale", "recent"} {
+		path := filepath.Join(partialDir, name)
+		if err := os.WriteFile(path, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if name == "stale" {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	removed, err := CleanStagingDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("CleanStagingDirs() removed %d directories, want 1", removed)
+	}
+
+	// The lock files of the removed directories are gone, as is the orphaned one
+	want := []string{
+		"busybox.tar",
+		filepath.Base(running.path),
+		filepath.Base(running.path) + ".lock",
+		partialDirName,
+	}
+	sort.Strings(want)
+	if got := dirNames(t, root); !reflect.DeepEqual(got, want) {
+		t.Errorf("EXPORT_PATH has %q after the cleanup, want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(running.path, "index.json")); err != nil {
+		t.Errorf("the directory of a running copy lost its content: %v", err)
+	}
+	if got := dirNames(t, partialDir); !reflect.DeepEqual(got, []string{"recent"}) {
+		t.Errorf("partial layers after the cleanup = %q, want only the recent one", got)
+	}
+
+	// The directory of the running copy is still locked
+	_, locked, err := fs.TryLockFile(running.path)
+	if err != nil || locked {
+		t.Errorf("TryLockFile() of a running copy = %v, %v, want it locked", locked, err)
+	}
+}
+
+func TestCleanStagingDirsWithoutExportPath(t *testing.T) {
+	t.Setenv("EXPORT_PATH", filepath.Join(t.TempDir(), "missing"))
+	if removed, err := CleanStagingDirs(); removed != 0 || err != nil {
+		t.Errorf("CleanStagingDirs() = %d, %v, want nothing to clean", removed, err)
+	}
+}
+
+func TestStagingDirRemove(t *testing.T) {
+	root := t.TempDir()
+	staging, err := newStagingDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(staging.path, "index.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := staging.remove(); err != nil {
+		t.Fatal(err)
+	}
+	if got := dirNames(t, root); len(got) != 0 {
+		t.Errorf("remove() left %q behind", got)
+	}
+}
+
+// dirNames returns the sorted names of the entries of dir.
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
@@ -1,62 +1,318 @@
 package registry
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/akakream/MultiPlatform2IPFS/internal/fs"
 )
 
-func getCachedOrNewToken(imageName string, imageTag string) (string, error) {
-	cacheHit, token, err := fs.GetCachedToken(imageName, imageTag)
+// clientID identifies this tool to token endpoints that use OAuth2.
+const clientID = "multiplatform2ipfs"
+
+var (
+	tokenCache     *fs.TokenCache
+	tokenCacheErr  error
+	tokenCacheOnce sync.Once
+)
+
+// getTokenCache returns the token cache shared by all copies of the process.
+func getTokenCache() (*fs.TokenCache, error) {
+	tokenCacheOnce.Do(func() {
+		path, err := fs.TokenCachePath()
+		if err != nil {
+			tokenCacheErr = err
+			return
+		}
+		tokenCache = fs.NewTokenCache(path)
+	})
+	return tokenCache, tokenCacheErr
+}
+
+// getAuthorization returns the value of the Authorization header for the
+// repository of the reference. It follows the challenge of the registry, so
+// it returns an empty string for registries that allow anonymous pulls.
+func getAuthorization(ctx context.Context, ref Reference, creds *Credentials) (string, error) {
+	cache, err := getTokenCache()
 	if err != nil {
 		return "", err
 	}
+	if token, ok := cache.Get(tokenKey(ref, creds)); ok {
+		logf(ctx, "Cached token for the repositoy %s is being used.", ref.Name())
+		return "Bearer " + token, nil
+	}
+	return fetchAuthorization(ctx, ref, creds)
+}
 
-	if !cacheHit {
-		token, err = getToken(imageName)
-		if err != nil {
-			return "", err
-		}
-		err = fs.FillCache(imageName, token)
-		if err != nil {
-			return "", err
+// fetchAuthorization follows the challenge of the registry like
+// getAuthorization, but never uses a cached token. A fetched token replaces
+// the cached one.
+func fetchAuthorization(ctx context.Context, ref Reference, creds *Credentials) (string, error) {
+	cache, err := getTokenCache()
+	if err != nil {
+		return "", err
+	}
+	challenge, err := getChallenge(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	if challenge == nil {
+		logf(ctx, "The repository %s allows anonymous access.", ref.Name())
+		return "", nil
+	}
+
+	if challenge.Scheme == "basic" {
+		if creds == nil || creds.Username == "" {
+			return "", fmt.Errorf("%w: the registry %s requires credentials", ErrUnsupportedChallenge, ref.Registry)
 		}
-		fmt.Println(
-			"New token for the repositoy " + imageName + " is fetched and stored.",
-		)
-	} else {
-		fmt.Println("Cached token for the repositoy " + imageName + " is being used.")
+		return basicAuthorization(creds), nil
 	}
 
-	return token, nil
+	key := tokenKey(ref, creds)
+	tokenResponse, err := getToken(ctx, challenge, key.Scope, creds)
+	if err != nil {
+		return "", err
+	}
+	err = cache.Put(key, tokenResponse.Token, tokenResponse.ExpiresIn, tokenResponse.IssuedAt)
+	if err != nil {
+		return "", err
+	}
+	logf(ctx, "New token for the repositoy %s is fetched and stored.", ref.Name())
+
+	return "Bearer " + tokenResponse.Token, nil
+}
+
+// tokenKey returns the key the tokens for the repository of the reference
+// are cached under.
+func tokenKey(ref Reference, creds *Credentials) fs.TokenKey {
+	return fs.TokenKey{
+		Registry:   ref.Registry,
+		Repository: ref.Repository,
+		Scope:      pullScope(ref),
+		Account:    creds.account(),
+	}
 }
 
-func getToken(imageName string) (string, error) {
-	url := "https://auth.docker.io/token?service=registry.docker.io&scope=repository:library/" + imageName + ":pull"
+// authorizer sends the requests of a copy with the Authorization header of
+// the repository. Bearer tokens expire after a few minutes, while a copy may
+// wait much longer for the rate limit or for a download slot, so the header
+// of every request is taken from the token cache and a token that expired or
+// that the registry rejects is replaced by a new one. A nil authorizer sends
+// anonymous requests.
+type authorizer struct {
+	ref   Reference
+	creds *Credentials
+	// timeout limits fetching a new token.
+	timeout time.Duration
+	// static is the header of registries that do not issue bearer tokens:
+	// empty for anonymous access, or basic authorization. It never expires.
+	static string
+	bearer bool
+	// mu keeps concurrent requests from fetching a new token at the same time.
+	mu sync.Mutex
+}
 
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
+// newAuthorizer returns the authorizer of the repository of the reference.
+// It follows the challenge of the registry once to learn how it authorizes.
+func newAuthorizer(ctx context.Context, ref Reference, creds *Credentials, timeout time.Duration) (*authorizer, error) {
+	authCtx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	authorization, err := getAuthorization(authCtx, ref, creds)
+	if err != nil {
+		return nil, err
+	}
+	a := &authorizer{ref: ref, creds: creds, timeout: timeout}
+	if strings.HasPrefix(authorization, "Bearer ") {
+		a.bearer = true
+	} else {
+		a.static = authorization
+	}
+	return a, nil
+}
+
+// get returns the Authorization header for the next request.
+func (a *authorizer) get(ctx context.Context) (string, error) {
+	if a == nil || !a.bearer {
+		return a.staticAuthorization(), nil
+	}
+	cache, err := getTokenCache()
 	if err != nil {
 		return "", err
 	}
+	key := tokenKey(a.ref, a.creds)
+	if token, ok := cache.Get(key); ok {
+		return "Bearer " + token, nil
+	}
 
-	resp, err := client.Do(req)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// Another request may have fetched a new token in the meantime
+	if token, ok := cache.Get(key); ok {
+		return "Bearer " + token, nil
+	}
+	authCtx, cancel := withTimeout(ctx, a.timeout)
+	defer cancel()
+	return fetchAuthorization(authCtx, a.ref, a.creds)
+}
+
+// refresh returns a new Authorization header in place of the rejected one.
+func (a *authorizer) refresh(ctx context.Context, rejected string) (string, error) {
+	if a == nil || !a.bearer {
+		return a.staticAuthorization(), nil
+	}
+	cache, err := getTokenCache()
 	if err != nil {
 		return "", err
 	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// Requests that were rejected at the same time only fetch one new token
+	if token, ok := cache.Get(tokenKey(a.ref, a.creds)); ok && "Bearer "+token != rejected {
+		return "Bearer " + token, nil
+	}
+	authCtx, cancel := withTimeout(ctx, a.timeout)
+	defer cancel()
+	return fetchAuthorization(authCtx, a.ref, a.creds)
+}
+
+func (a *authorizer) staticAuthorization() string {
+	if a == nil {
+		return ""
+	}
+	return a.static
+}
+
+// do sends the request with the Authorization header. If the registry
+// answers 401, the request is sent once more with a new token. The request
+// must not have a body.
+func (a *authorizer) do(req *http.Request) (*http.Response, error) {
+	authorization, err := a.get(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	setAuthorization(req, authorization)
+	resp, err := httpClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || a == nil || !a.bearer {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	authorization, err = a.refresh(req.Context(), authorization)
+	if err != nil {
+		return nil, err
+	}
+	retry := req.Clone(req.Context())
+	setAuthorization(retry, authorization)
+	return httpClient.Do(retry)
+}
+
+// pullScope returns the token scope needed to pull from the repository of the reference.
+func pullScope(ref Reference) string {
+	return "repository:" + ref.Repository + ":pull"
+}
+
+// account returns the name the tokens fetched with the credentials are cached under.
+func (c *Credentials) account() string {
+	if c == nil {
+		return ""
+	}
+	if c.Username == "" && c.IdentityToken != "" {
+		return tokenUsername
+	}
+	return c.Username
+}
+
+// getToken fetches a bearer token for the scope from the realm advertised by the challenge.
+func getToken(ctx context.Context, challenge *challenge, scope string, creds *Credentials) (*TokenResponse, error) {
+	realm := challenge.Params["realm"]
+	if realm == "" {
+		return nil, fmt.Errorf("%w: bearer challenge without realm", ErrUnsupportedChallenge)
+	}
+
+	req, err := newTokenRequest(ctx, realm, challenge.Params["service"], scope, creds)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp)
+	}
+
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	var jsonResult TokenResponse
 	if err := json.Unmarshal(body, &jsonResult); err != nil { // Parse []byte to the go struct pointer
-		return "", err
+		return nil, err
+	}
+	// Some registries only return the OAuth2 compatible access_token
+	if jsonResult.Token == "" {
+		jsonResult.Token = jsonResult.AccessToken
+	}
+	return &jsonResult, nil
+}
+
+// newTokenRequest builds the request for the token endpoint. An identity
+// token is exchanged with the OAuth2 refresh token grant, username and
+// password are sent with basic authentication.
+func newTokenRequest(ctx context.Context, realm string, service string, scope string, creds *Credentials) (*http.Request, error) {
+	if creds != nil && creds.IdentityToken != "" {
+		form := url.Values{}
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", creds.IdentityToken)
+		form.Set("client_id", clientID)
+		form.Set("scope", scope)
+		if service != "" {
+			form.Set("service", service)
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", realm, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	}
+
+	tokenURL, err := url.Parse(realm)
+	if err != nil {
+		return nil, err
+	}
+	query := tokenURL.Query()
+	if service != "" {
+		query.Set("service", service)
+	}
+	query.Set("scope", scope)
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", tokenURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if creds != nil && creds.Username != "" {
+		req.Header.Set("Authorization", basicAuthorization(creds))
+	}
+	return req, nil
+}
+
+// setAuthorization adds the Authorization header to the request. Anonymous requests are sent without one.
+func setAuthorization(req *http.Request, authorization string) {
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
 	}
-	return jsonResult.Token, nil
 }
@@ -0,0 +1,195 @@
+package registry
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/akakream/MultiPlatform2IPFS/internal/fs"
+)
+
+func TestTokenCachePath(t *testing.T) {
+	home := t.TempDir()
+	tests := []struct {
+		name      string
+		path      string
+		cacheHome string
+		want      string
+	}{
+		{name: "TOKEN_CACHE_PATH", path: "/var/cache/tokens.json", cacheHome: "/xdg", want: "/var/cache/tokens.json"},
+		{name: "XDG_CACHE_HOME", cacheHome: "/xdg", want: filepath.Join("/xdg", "multiplatform2ipfs", "tokens.json")},
+		{name: "home directory", want: filepath.Join(home, ".cache", "multiplatform2ipfs", "tokens.json")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TOKEN_CACHE_PATH", tt.path)
+			t.Setenv("XDG_CACHE_HOME", tt.cacheHome)
+			t.Setenv("HOME", home)
+			if runtime.GOOS == "windows" {
+				t.Setenv("USERPROFILE", home)
+			}
+			got, err := fs.TokenCachePath()
+			if err != nil || got != tt.want {
+				t.Errorf("TokenCachePath() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenCacheExpiry(t *testing.T) {
+	key := fs.TokenKey{Registry: "ghcr.io", Repository: "org/app", Scope: "repository:org/app:pull"}
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		expiresIn int
+		issuedAt  time.Time
+		valid     bool
+	}{
+		{name: "fresh token", expiresIn: 300, issuedAt: now, valid: true},
+		{name: "expired token", expiresIn: 300, issuedAt: now.Add(-10 * time.Minute)},
+		{name: "token about to expire", expiresIn: 300, issuedAt: now.Add(-295 * time.Second)},
+		{name: "default lifetime of 60s", issuedAt: now.Add(-30 * time.Second), valid: true},
+		{name: "default lifetime is over", issuedAt: now.Add(-2 * time.Minute)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tokens.json")
+			if err := fs.NewTokenCache(path).Put(key, "token", tt.expiresIn, tt.issuedAt); err != nil {
+				t.Fatal(err)
+			}
+			// A new cache of the file stands for another process
+			if _, ok := fs.NewTokenCache(path).Get(key); ok != tt.valid {
+				t.Errorf("Get() of another process found a token = %v, want %v", ok, tt.valid)
+			}
+		})
+	}
+}
+
+func TestTokenCacheKeys(t *testing.T) {
+	cache := fs.NewTokenCache(filepath.Join(t.TempDir(), "tokens.json"))
+	key := fs.TokenKey{Registry: "docker.io", Repository: "library/busybox", Scope: "repository:library/busybox:pull"}
+	if err := cache.Put(key, "busybox-token", 300, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	others := []fs.TokenKey{
+		{Registry: "ghcr.io", Repository: key.Repository, Scope: key.Scope},
+		{Registry: key.Registry, Repository: "library/nginx", Scope: key.Scope},
+		{Registry: key.Registry, Repository: key.Repository, Scope: "repository:library/busybox:pull,push"},
+		{Registry: key.Registry, Repository: key.Repository, Scope: key.Scope, Account: "alice"},
+	}
+	for _, other := range others {
+		if token, ok := cache.Get(other); ok {
+			t.Errorf("Get(%+v) = %q, want no token of another key", other, token)
+		}
+	}
+	if token, ok := cache.Get(key); !ok || token != "busybox-token" {
+		t.Errorf("Get() = %q, %v, want the token", token, ok)
+	}
+}
+
+func TestTokenCacheSharedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache", "tokens.json")
+	busybox := fs.TokenKey{Registry: "docker.io", Repository: "library/busybox", Scope: "repository:library/busybox:pull"}
+	nginx := fs.TokenKey{Registry: "docker.io", Repository: "library/nginx", Scope: "repository:library/nginx:pull"}
+	expired := fs.TokenKey{Registry: "docker.io", Repository: "library/old", Scope: "repository:library/old:pull"}
+
+	first, second := fs.NewTokenCache(path), fs.NewTokenCache(path)
+	if err := first.Put(expired, "old-token", 60, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Put(busybox, "busybox-token", 300, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	// The write of the second process keeps the token of the first one
+	if err := second.Put(nginx, "nginx-token", 300, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if token, ok := first.Get(nginx); !ok || token != "nginx-token" {
+		t.Errorf("Get() of a token of another process = %q, %v", token, ok)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var store fs.TokenStore
+	if err := json.Unmarshal(data, &store); err != nil {
+		t.Fatalf("the cache file is not valid JSON: %v", err)
+	}
+	tokens := map[string]bool{}
+	for _, item := range store.Tokens {
+		tokens[item.Token] = true
+	}
+	if !tokens["busybox-token"] || !tokens["nginx-token"] || tokens["old-token"] {
+		t.Errorf("cache file has the tokens %v, want the busybox and nginx tokens without the expired one", tokens)
+	}
+	if runtime.GOOS != "windows" {
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("cache file mode = %v, %v, want 0600", info.Mode().Perm(), err)
+		}
+	}
+	// The file is replaced atomically, no temporary file is left behind
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "tokens.json" {
+			t.Errorf("cache directory has %s besides tokens.json", entry.Name())
+		}
+	}
+}
+
+func TestTokenCacheCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	if err := os.WriteFile(path, []byte(`{"tokens": [`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key := fs.TokenKey{Registry: "ghcr.io", Repository: "org/app", Scope: "repository:org/app:pull"}
+	cache := fs.NewTokenCache(path)
+	if _, ok := cache.Get(key); ok {
+		t.Fatal("Get() of a corrupt cache found a token")
+	}
+	if err := cache.Put(key, "token", 300, time.Now()); err != nil {
+		t.Fatalf("Put() to a corrupt cache error = %v", err)
+	}
+	if token, ok := fs.NewTokenCache(path).Get(key); !ok || token != "token" {
+		t.Errorf("Get() after rewriting a corrupt cache = %q, %v", token, ok)
+	}
+}
+
+func TestTokenCachePutWaitsForTheLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	key := fs.TokenKey{Registry: "ghcr.io", Repository: "org/app", Scope: "repository:org/app:pull"}
+
+	// Another process holds the lock of the cache file
+	unlock, err := fs.LockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fs.NewTokenCache(path).Put(key, "token", 300, time.Now())
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Put() returned %v while another process held the lock", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Put() wrote the file while another process held the lock: %v", err)
+	}
+
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if token, ok := fs.NewTokenCache(path).Get(key); !ok || token != "token" {
+		t.Errorf("Get() after Put() = %q, %v", token, ok)
+	}
+}
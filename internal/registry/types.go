@@ -16,29 +16,31 @@ type FatManifest struct {
 }
 
 type ManifestEntry struct {
+	Digest      string            `json:"digest"`
+	MediaType   string            `json:"mediaType"`
+	Platform    Platform          `json:"platform,omitempty"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// isAttestation reports whether the entry is an attestation manifest, such
+// as the provenance BuildKit attaches to the manifest of every platform.
+func (m ManifestEntry) isAttestation() bool {
+	return m.Annotations[referenceTypeAnnotation] == attestationReferenceType
+}
+
+// Descriptor references the config or a layer of a manifest.
+type Descriptor struct {
 	Digest    string `json:"digest"`
 	MediaType string `json:"mediaType"`
-	Platform  struct {
-		Architecture string `json:"architecture"`
-		Os           string `json:"os"`
-		Variant      string `json:"variant"`
-	} `json:"platform,omitempty"`
-	Size int `json:"size"`
+	Size      int64  `json:"size"`
 }
 
 type Manifest struct {
-	Config struct {
-		Digest    string `json:"digest"`
-		MediaType string `json:"mediaType"`
-		Size      int    `json:"size"`
-	} `json:"config"`
-	Layers []struct {
-		Digest    string `json:"digest"`
-		MediaType string `json:"mediaType"`
-		Size      int    `json:"size"`
-	} `json:"layers"`
-	MediaType     string `json:"mediaType"`
-	SchemaVersion int    `json:"schemaVersion"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+	MediaType     string       `json:"mediaType"`
+	SchemaVersion int          `json:"schemaVersion"`
 }
 
 // type Config struct {
@@ -0,0 +1,136 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ErrDigestMismatch is error for when content does not match its digest
+	ErrDigestMismatch = errors.New("digest mismatch")
+	// ErrSizeMismatch is error for when content does not match its size
+	ErrSizeMismatch = errors.New("size mismatch")
+	// ErrUnsupportedDigest is error for when the algorithm of a digest is not supported
+	ErrUnsupportedDigest = errors.New("unsupported digest algorithm")
+)
+
+// VerificationError is returned when fetched content does not match the
+// digest or the size it was referenced with. It wraps ErrDigestMismatch or ErrSizeMismatch.
+type VerificationError struct {
+	Digest   string
+	Expected string
+	Actual   string
+	Err      error
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("%s: %v: expected %s, got %s", e.Digest, e.Err, e.Expected, e.Actual)
+}
+
+func (e *VerificationError) Unwrap() error {
+	return e.Err
+}
+
+// newDigester returns the hash of the algorithm of the digest.
+func newDigester(digest string) (hash.Hash, error) {
+	algorithm, _, _ := strings.Cut(digest, ":")
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedDigest, digest)
+}
+
+// isDigest reports whether the manifest reference is a digest rather than a tag.
+func isDigest(reference string) bool {
+	return strings.Contains(reference, ":")
+}
+
+// verifyContent checks content against the digest and the size it was
+// referenced with. An empty digest or a negative size is not checked.
+func verifyContent(content []byte, digest string, size int64) error {
+	if size >= 0 && int64(len(content)) != size {
+		return &VerificationError{
+			Digest:   digest,
+			Expected: fmt.Sprint(size),
+			Actual:   fmt.Sprint(len(content)),
+			Err:      ErrSizeMismatch,
+		}
+	}
+	if digest == "" {
+		return nil
+	}
+
+	digester, err := newDigester(digest)
+	if err != nil {
+		return err
+	}
+	digester.Write(content)
+	return checkDigest(digester, digest)
+}
+
+// checkDigest compares the sum of the digester with the digest.
+func checkDigest(digester hash.Hash, digest string) error {
+	algorithm, _, _ := strings.Cut(digest, ":")
+	actual := algorithm + ":" + hex.EncodeToString(digester.Sum(nil))
+	if actual != digest {
+		return &VerificationError{
+			Digest:   digest,
+			Expected: digest,
+			Actual:   actual,
+			Err:      ErrDigestMismatch,
+		}
+	}
+	return nil
+}
+
+// writeVerified streams r into a temporary file next to destination while
+// hashing it. The file is renamed to destination only if it matches the
+// digest and the size, otherwise it is removed.
+func writeVerified(r io.Reader, destination string, digest string, size int64) error {
+	digester, err := newDigester(digest)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(destination), filepath.Base(destination)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(io.MultiWriter(tmp, digester), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if size >= 0 && written != size {
+		return &VerificationError{
+			Digest:   digest,
+			Expected: fmt.Sprint(size),
+			Actual:   fmt.Sprint(written),
+			Err:      ErrSizeMismatch,
+		}
+	}
+	if err := checkDigest(digester, digest); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), destination)
+}
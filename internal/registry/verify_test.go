@@ -0,0 +1,144 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteVerified(t *testing.T) {
+	content := "layer content"
+	sum512 := sha512.Sum512([]byte(content))
+
+	tests := []struct {
+		name    string
+		digest  string
+		size    int64
+		wantErr error
+	}{
+		{name: "matching content", digest: digestBytes([]byte(content)), size: int64(len(content))},
+		{name: "unknown size", digest: digestBytes([]byte(content)), size: -1},
+		{name: "sha512", digest: "sha512:" + hex.EncodeToString(sum512[:]), size: int64(len(content))},
+		{name: "wrong digest", digest: digestBytes([]byte("other content")), size: int64(len(content)), wantErr: ErrDigestMismatch},
+		{name: "wrong size", digest: digestBytes([]byte(content)), size: 3, wantErr: ErrSizeMismatch},
+		{name: "unsupported algorithm", digest: "md5:abc", size: -1, wantErr: ErrUnsupportedDigest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			destination := filepath.Join(dir, "blob")
+			err := writeVerified(strings.NewReader(content), destination, tt.digest, tt.size)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("writeVerified() error = %v, want %v", err, tt.wantErr)
+			}
+			var verificationErr *VerificationError
+			if (tt.wantErr == ErrDigestMismatch || tt.wantErr == ErrSizeMismatch) && !errors.As(err, &verificationErr) {
+				t.Errorf("writeVerified() error = %T, want a *VerificationError", err)
+			}
+
+			got, readErr := os.ReadFile(destination)
+			if tt.wantErr != nil {
+				if !os.IsNotExist(readErr) {
+					t.Errorf("writeVerified() stored content that failed the verification: %v", readErr)
+				}
+			} else if string(got) != content {
+				t.Errorf("stored content = %q, want %q", got, content)
+			}
+			// The temporary file is removed in every case
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entries {
+				if entry.Name() != "blob" {
+					t.Errorf("writeVerified() left %s behind", entry.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestGetManifestVerifiesDigest(t *testing.T) {
+	body := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`
+	digest := digestBytes([]byte(body))
+	otherDigest := digestBytes([]byte("other"))
+
+	tests := []struct {
+		name      string
+		reference string
+		header    string
+		size      int64
+		wantErr   error
+	}{
+		{name: "tag with matching header", reference: "latest", header: digest, size: -1},
+		{name: "tag without header", reference: "latest", size: -1},
+		{name: "tag with another header", reference: "latest", header: otherDigest, size: -1, wantErr: ErrDigestMismatch},
+		{name: "digest", reference: digest, size: int64(len(body))},
+		// The digest of the reference is checked, not the header the registry sends
+		{name: "digest with another header", reference: digest, header: otherDigest, size: -1},
+		{name: "other content than the digest", reference: otherDigest, header: otherDigest, size: -1, wantErr: ErrDigestMismatch},
+		{name: "other size than in the index", reference: digest, size: 10, wantErr: ErrSizeMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.header != "" {
+					w.Header().Set("Docker-Content-Digest", tt.header)
+				}
+				w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+				w.Write([]byte(body))
+			}))
+			defer server.Close()
+
+			ref, err := ParseReference(strings.TrimPrefix(server.URL, "http://") + "/app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, raw, err := getManifest(context.Background(), ref, tt.reference, tt.size, nil)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("getManifest() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && string(raw) != body {
+				t.Errorf("getManifest() body = %q, want %q", raw, body)
+			}
+		})
+	}
+}
+
+func TestGetFatManifestVerifiesDigest(t *testing.T) {
+	body := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+	tests := []struct {
+		name    string
+		header  string
+		wantErr error
+	}{
+		{name: "matching header", header: digestBytes([]byte(body))},
+		{name: "another header", header: digestBytes([]byte("other")), wantErr: ErrDigestMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Docker-Content-Digest", tt.header)
+				w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+				w.Write([]byte(body))
+			}))
+			defer server.Close()
+
+			ref, err := ParseReference(strings.TrimPrefix(server.URL, "http://") + "/app:latest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = getFatManifest(context.Background(), ref, nil)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("getFatManifest() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
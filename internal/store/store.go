@@ -0,0 +1,709 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/akakream/MultiPlatform2IPFS/internal/fs"
+	"github.com/akakream/MultiPlatform2IPFS/internal/ipfs"
+	registry "github.com/akakream/MultiPlatform2IPFS/internal/registry"
+	"github.com/akakream/MultiPlatform2IPFS/utils"
+)
+
+var (
+	// ErrJobNotFound is error for when the store has no job with the id
+	ErrJobNotFound = errors.New("job not found")
+	// ErrImageNotFound is error for when the store has no image with the name and tag
+	ErrImageNotFound = errors.New("image not found")
+	// ErrPinNotFound is error for when the store has no pin of the CID
+	ErrPinNotFound = errors.New("pin not found")
+)
+
+// JobState is the state of a copy job.
+type JobState string
+
+const (
+	JobQueued      JobState = "queued"
+	JobDownloading JobState = "downloading"
+	JobUploading   JobState = "uploading"
+	JobPinning     JobState = "pinning"
+	JobDone        JobState = "done"
+	JobFailed      JobState = "failed"
+	// JobInterrupted is a job that was stopped by the shutdown of its server.
+	// The next start of a server resumes it.
+	JobInterrupted JobState = "interrupted"
+	// JobCancelled is a job that was cancelled through the API.
+	JobCancelled JobState = "cancelled"
+)
+
+// JobOptions are the options a job copies its image with.
+type JobOptions struct {
+	Platforms   []registry.Platform   `json:"platforms,omitempty"`
+	Format      registry.ExportFormat `json:"format,omitempty"`
+	Concurrency int                   `json:"concurrency,omitempty"`
+	// Credentials reports whether the job was given credentials. They are
+	// never stored, so such a job can not be resumed.
+	Credentials bool `json:"credentials,omitempty"`
+	// Force copies the image even if it was published before.
+	Force bool `json:"force,omitempty"`
+	// Add are the options the image is added to IPFS with. It is nil for
+	// records from before add options could be chosen, see AddOptions.
+	Add *ipfs.AddOptions `json:"add,omitempty"`
+	// OnlyHash computes the CID of the image without storing it.
+	OnlyHash bool `json:"onlyHash,omitempty"`
+}
+
+// NewJobOptions returns the stored options of a copy.
+func NewJobOptions(opts registry.CopyOptions) JobOptions {
+	return JobOptions{
+		Platforms:   opts.Platforms,
+		Format:      opts.Format,
+		Concurrency: opts.Concurrency,
+		Credentials: opts.Credentials != nil && !opts.Credentials.IsEmpty(),
+		Force:       opts.Force,
+		Add:         opts.Add,
+		OnlyHash:    opts.OnlyHash,
+	}
+}
+
+// AddOptions returns the options the image is added with. Records without
+// add options were added with the default ones.
+func (o JobOptions) AddOptions() ipfs.AddOptions {
+	if o.Add == nil {
+		return ipfs.DefaultAddOptions
+	}
+	return *o.Add
+}
+
+// sameImage reports whether copies with the options store the same image.
+func (o JobOptions) sameImage(other JobOptions) bool {
+	if o.Format != other.Format || len(o.Platforms) != len(other.Platforms) {
+		return false
+	}
+	if o.AddOptions() != other.AddOptions() {
+		return false
+	}
+	platforms := map[registry.Platform]bool{}
+	for _, platform := range o.Platforms {
+		platforms[platform] = true
+	}
+	for _, platform := range other.Platforms {
+		if !platforms[platform] {
+			return false
+		}
+	}
+	return true
+}
+
+// Job is the record of a copy job.
+type Job struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Tag  string `json:"tag"`
+	// Reference is the normalized reference of the image.
+	Reference string            `json:"reference"`
+	Options   JobOptions        `json:"options"`
+	State     JobState          `json:"state"`
+	Progress  registry.Progress `json:"progress"`
+	// SourceDigest is the digest of the index, or of the manifest for images
+	// without an index, as served by the registry.
+	SourceDigest string `json:"sourceDigest,omitempty"`
+	// Digest is the digest of the stored index.
+	Digest    string                      `json:"digest,omitempty"`
+	Manifests []registry.PlatformManifest `json:"manifests,omitempty"`
+	Cid       string                      `json:"cid,omitempty"`
+	// Reused reports that the image was published before and not copied again.
+	Reused bool   `json:"reused,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// ErrorStatus is the HTTP status of the error of a failed job, e.g. 404
+	// for an image that does not exist or 502 for a registry outage.
+	ErrorStatus int `json:"errorStatus,omitempty"`
+	// Pid is the process that runs the job. It is only informational, the
+	// process holds the lock of the job while it runs it, see LockJob.
+	Pid        int        `json:"pid,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// Finished reports whether the job is done, failed or cancelled.
+func (j Job) Finished() bool {
+	return j.State == JobDone || j.State == JobFailed || j.State == JobCancelled
+}
+
+// Image is the record of an image that was copied to IPFS. There is one
+// record for every name and tag, the latest copy replaces the previous one.
+type Image struct {
+	// Name is the registry and repository of the image, e.g. docker.io/library/busybox.
+	Name string `json:"name"`
+	// Tag is the tag of the image, or its digest if it was copied by digest.
+	Tag string `json:"tag"`
+	// Reference is the normalized reference of the image.
+	Reference string     `json:"reference"`
+	Options   JobOptions `json:"options"`
+	// SourceDigest is the digest of the index as served by the registry.
+	SourceDigest string `json:"sourceDigest"`
+	// Digest is the digest of the stored index.
+	Digest    string                      `json:"digest"`
+	Manifests []registry.PlatformManifest `json:"manifests"`
+	Cid       string                      `json:"cid"`
+	// JobID is the job that copied the image. It is empty for copies that
+	// were not run as a job.
+	JobID    string    `json:"jobId,omitempty"`
+	CopiedAt time.Time `json:"copiedAt"`
+}
+
+// NewImage returns the record of a finished copy of the reference. jobID is
+// empty for copies that were not run as a job.
+func NewImage(ref registry.Reference, opts registry.CopyOptions, result *registry.CopyResult, jobID string, copiedAt time.Time) Image {
+	return Image{
+		Name:         ref.Name(),
+		Tag:          ref.Reference(),
+		Reference:    ref.String(),
+		Options:      NewJobOptions(opts),
+		SourceDigest: result.SourceDigest,
+		Digest:       result.IndexDigest,
+		Manifests:    result.Manifests,
+		Cid:          result.Cid,
+		JobID:        jobID,
+		CopiedAt:     copiedAt,
+	}
+}
+
+// Result returns the image as the result of a copy.
+func (i Image) Result() *registry.CopyResult {
+	result := &registry.CopyResult{
+		Cid:          i.Cid,
+		SourceDigest: i.SourceDigest,
+		IndexDigest:  i.Digest,
+		Manifests:    i.Manifests,
+	}
+	for _, manifest := range i.Manifests {
+		result.Platforms = append(result.Platforms, manifest.Platform)
+	}
+	return result
+}
+
+// Size returns the size of all manifests, configs and layers of the image.
+// Layers shared by several platforms are counted for each of them.
+func (i Image) Size() int64 {
+	var size int64
+	for _, manifest := range i.Manifests {
+		size += manifest.Size
+	}
+	return size
+}
+
+// PinState is the state of a pin.
+type PinState string
+
+const (
+	PinPinning PinState = "pinning"
+	PinPinned  PinState = "pinned"
+	PinFailed  PinState = "failed"
+)
+
+// Pin is the record of a CID that was pinned through the API.
+type Pin struct {
+	Cid string `json:"cid"`
+	// Recursive pins the blocks the CID links to as well.
+	Recursive bool      `json:"recursive"`
+	State     PinState  `json:"state"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// storeFile is the content of the store file.
+type storeFile struct {
+	// Generation is incremented by every write. It is the first field of the
+	// file, so a reader tells whether the file changed from its first bytes.
+	Generation uint64  `json:"generation"`
+	Jobs       []Job   `json:"jobs"`
+	Images     []Image `json:"images"`
+	Pins       []Pin   `json:"pins"`
+}
+
+// prune removes the jobs that finished and the pins that failed longer than
+// retention before now. A retention of 0 keeps them all.
+func (f *storeFile) prune(retention time.Duration, now time.Time) {
+	if retention <= 0 {
+		return
+	}
+	kept := f.Jobs[:0]
+	for _, job := range f.Jobs {
+		finishedAt := job.UpdatedAt
+		if job.FinishedAt != nil {
+			finishedAt = *job.FinishedAt
+		}
+		if job.Finished() && now.Sub(finishedAt) > retention {
+			continue
+		}
+		kept = append(kept, job)
+	}
+	f.Jobs = kept
+
+	keptPins := f.Pins[:0]
+	for _, pin := range f.Pins {
+		if pin.State == PinFailed && now.Sub(pin.UpdatedAt) > retention {
+			continue
+		}
+		keptPins = append(keptPins, pin)
+	}
+	f.Pins = keptPins
+}
+
+// defaultRetention is how long finished jobs are kept when JOB_RETENTION is
+// not set.
+const defaultRetention = 7 * 24 * time.Hour
+
+// generationPrefixSize is how many bytes of the store file are read to find
+// its generation.
+const generationPrefixSize = 64
+
+// Store keeps the jobs in a single JSON file, so they survive restarts. The
+// file is written atomically under a file lock and can be shared by several
+// processes. Finished jobs and failed pins are removed after the retention,
+// so the file does not grow without bounds. Images and pinned pins are kept
+// until they are deleted, as they stand for content pinned on the IPFS node.
+type Store struct {
+	path      string
+	retention time.Duration
+
+	mu    sync.Mutex
+	cache *storeFile
+	// info is the file the cache was read from.
+	info os.FileInfo
+}
+
+// DefaultPath returns the path of the store file. It is STORE_PATH if set,
+// otherwise store.json in the data directory.
+func DefaultPath() (string, error) {
+	path, err := utils.GetEnv("STORE_PATH", "")
+	if err != nil {
+		return "", err
+	}
+	if path != "" {
+		return path, nil
+	}
+	dir, err := fs.DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "store.json"), nil
+}
+
+// DefaultRetention returns how long finished jobs are kept, JOB_RETENTION
+// if set, otherwise a week. 0 keeps every job.
+func DefaultRetention() (time.Duration, error) {
+	value, err := utils.GetEnv("JOB_RETENTION", "")
+	if err != nil || value == "" {
+		return defaultRetention, err
+	}
+	retention, err := time.ParseDuration(value)
+	if err != nil || retention < 0 {
+		return 0, fmt.Errorf("JOB_RETENTION must be a duration such as 168h or 0, got %q", value)
+	}
+	return retention, nil
+}
+
+// Open returns the store backed by the file at path. The file is created
+// with the first job. Jobs that finished longer than retention ago are
+// removed with the next write, 0 keeps every job.
+func Open(path string, retention time.Duration) (*Store, error) {
+	if err := fs.CreateDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	s := &Store{path: path, retention: retention}
+	if _, err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Job returns the job with the id.
+func (s *Store) Job(id string) (Job, error) {
+	file, err := s.load()
+	if err != nil {
+		return Job{}, err
+	}
+	for _, job := range file.Jobs {
+		if job.ID == id {
+			return job, nil
+		}
+	}
+	return Job{}, ErrJobNotFound
+}
+
+// Jobs returns every job, the oldest first.
+func (s *Store) Jobs() ([]Job, error) {
+	file, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	jobs := append([]Job(nil), file.Jobs...)
+	sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	return jobs, nil
+}
+
+// PutJob adds the job or replaces the job with the same id.
+func (s *Store) PutJob(job Job) error {
+	return s.update(func(file *storeFile) error {
+		for i := range file.Jobs {
+			if file.Jobs[i].ID == job.ID {
+				file.Jobs[i] = job
+				return nil
+			}
+		}
+		file.Jobs = append(file.Jobs, job)
+		return nil
+	})
+}
+
+// UpdateJob changes the job with the id and returns it. The change runs
+// under the lock of the store file, so it sees the latest state of the job.
+// An error of change is returned and nothing is written.
+func (s *Store) UpdateJob(id string, change func(*Job) error) (Job, error) {
+	var updated Job
+	err := s.update(func(file *storeFile) error {
+		for i := range file.Jobs {
+			if file.Jobs[i].ID == id {
+				if err := change(&file.Jobs[i]); err != nil {
+					return err
+				}
+				updated = file.Jobs[i]
+				return nil
+			}
+		}
+		return ErrJobNotFound
+	})
+	return updated, err
+}
+
+// LockJob takes the advisory lock of the job with the id, which the process
+// that queues or runs the job holds until the job ends. It reports false if a
+// running process holds the lock. The lock of a process that died is
+// released by the kernel, even if another process got its pid since.
+func (s *Store) LockJob(id string) (func(), bool, error) {
+	dir := filepath.Join(filepath.Dir(s.path), "jobs")
+	if err := fs.CreateDir(dir); err != nil {
+		return nil, false, err
+	}
+	return fs.TryLockFile(filepath.Join(dir, id))
+}
+
+// Image returns the image with the name and tag.
+func (s *Store) Image(name string, tag string) (Image, error) {
+	file, err := s.load()
+	if err != nil {
+		return Image{}, err
+	}
+	for _, image := range file.Images {
+		if image.Name == name && image.Tag == tag {
+			return image, nil
+		}
+	}
+	return Image{}, ErrImageNotFound
+}
+
+// Images returns every image, sorted by name and tag.
+func (s *Store) Images() ([]Image, error) {
+	file, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	images := append([]Image(nil), file.Images...)
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Name != images[j].Name {
+			return images[i].Name < images[j].Name
+		}
+		return images[i].Tag < images[j].Tag
+	})
+	return images, nil
+}
+
+// FindImage returns the latest image whose source digest is digest and that
+// was copied with the same platforms and format as options.
+func (s *Store) FindImage(digest string, options JobOptions) (Image, error) {
+	file, err := s.load()
+	if err != nil {
+		return Image{}, err
+	}
+	var found *Image
+	for i, image := range file.Images {
+		if image.SourceDigest != digest || !image.Options.sameImage(options) {
+			continue
+		}
+		if found == nil || image.CopiedAt.After(found.CopiedAt) {
+			found = &file.Images[i]
+		}
+	}
+	if found == nil {
+		return Image{}, ErrImageNotFound
+	}
+	return *found, nil
+}
+
+// Lookup returns a lookup for CopyOptions that finds the images copied with
+// the same platforms and format as options.
+func (s *Store) Lookup(options JobOptions) func(string) (*registry.CopyResult, error) {
+	return func(digest string) (*registry.CopyResult, error) {
+		image, err := s.FindImage(digest, options)
+		if errors.Is(err, ErrImageNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return image.Result(), nil
+	}
+}
+
+// PutImage adds the image or replaces the image with the same name and tag.
+func (s *Store) PutImage(image Image) error {
+	return s.update(func(file *storeFile) error {
+		for i := range file.Images {
+			if file.Images[i].Name == image.Name && file.Images[i].Tag == image.Tag {
+				file.Images[i] = image
+				return nil
+			}
+		}
+		file.Images = append(file.Images, image)
+		return nil
+	})
+}
+
+// DeleteImage removes the image with the name and tag and returns it.
+func (s *Store) DeleteImage(name string, tag string) (Image, error) {
+	var deleted Image
+	err := s.update(func(file *storeFile) error {
+		for i := range file.Images {
+			if file.Images[i].Name == name && file.Images[i].Tag == tag {
+				deleted = file.Images[i]
+				file.Images = append(file.Images[:i], file.Images[i+1:]...)
+				return nil
+			}
+		}
+		return ErrImageNotFound
+	})
+	return deleted, err
+}
+
+// Pin returns the pin of the CID.
+func (s *Store) Pin(cid string) (Pin, error) {
+	file, err := s.load()
+	if err != nil {
+		return Pin{}, err
+	}
+	for _, pin := range file.Pins {
+		if pin.Cid == cid {
+			return pin, nil
+		}
+	}
+	return Pin{}, ErrPinNotFound
+}
+
+// Pins returns every pin, the oldest first.
+func (s *Store) Pins() ([]Pin, error) {
+	file, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	pins := append([]Pin(nil), file.Pins...)
+	sort.SliceStable(pins, func(i, j int) bool { return pins[i].CreatedAt.Before(pins[j].CreatedAt) })
+	return pins, nil
+}
+
+// PutPin adds the pin or replaces the pin of the same CID.
+func (s *Store) PutPin(pin Pin) error {
+	return s.update(func(file *storeFile) error {
+		for i := range file.Pins {
+			if file.Pins[i].Cid == pin.Cid {
+				file.Pins[i] = pin
+				return nil
+			}
+		}
+		file.Pins = append(file.Pins, pin)
+		return nil
+	})
+}
+
+// UpdatePin changes the pin of the CID and returns it. The change runs under
+// the lock of the store file. An error of change is returned and nothing is
+// written.
+func (s *Store) UpdatePin(cid string, change func(*Pin) error) (Pin, error) {
+	var updated Pin
+	err := s.update(func(file *storeFile) error {
+		for i := range file.Pins {
+			if file.Pins[i].Cid == cid {
+				if err := change(&file.Pins[i]); err != nil {
+					return err
+				}
+				updated = file.Pins[i]
+				return nil
+			}
+		}
+		return ErrPinNotFound
+	})
+	return updated, err
+}
+
+// DeletePin removes the pin of the CID and returns it.
+func (s *Store) DeletePin(cid string) (Pin, error) {
+	var deleted Pin
+	err := s.update(func(file *storeFile) error {
+		for i := range file.Pins {
+			if file.Pins[i].Cid == cid {
+				deleted = file.Pins[i]
+				file.Pins = append(file.Pins[:i], file.Pins[i+1:]...)
+				return nil
+			}
+		}
+		return ErrPinNotFound
+	})
+	return deleted, err
+}
+
+// update changes the content of the store file under its lock.
+func (s *Store) update(change func(*storeFile) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := fs.LockFile(s.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// The file is parsed again, so a failed change does not show in the cache
+	file, _, err := readFile(s.path)
+	if err != nil {
+		return err
+	}
+	if err := change(file); err != nil {
+		return err
+	}
+	file.prune(s.retention, time.Now().UTC())
+	file.Generation++
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fs.WriteFileAtomic(s.path, data, 0644); err != nil {
+		return err
+	}
+	// The written content is the new cache, the next load does not parse it again
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.cache, s.info = file, info
+	return nil
+}
+
+// load returns the content of the store file. The file is only parsed again
+// when it changed since the last read. Every write replaces the file and
+// increments its generation, so the cache is still current if the file is
+// the same, has the same size and starts with the same generation. The
+// generation tells a new file apart from the old one if the file system
+// reused the inode of the old one.
+func (s *Store) load() (*storeFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cache != nil && s.info != nil && s.unchanged() {
+		return s.cache, nil
+	}
+	file, info, err := readFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	s.cache, s.info = file, info
+	return file, nil
+}
+
+// unchanged reports whether the store file is still the one the cache was
+// read from. It only reads the first bytes of the file.
+func (s *Store) unchanged() bool {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !os.SameFile(info, s.info) || info.Size() != s.info.Size() {
+		return false
+	}
+	generation, ok := readGeneration(io.LimitReader(f, generationPrefixSize))
+	return ok && generation == s.cache.Generation
+}
+
+// readGeneration returns the generation at the start of the store file. It
+// reports false for files without a generation, which were written before
+// the store had one.
+func readGeneration(r io.Reader) (uint64, bool) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	for _, want := range []json.Token{json.Delim('{'), "generation"} {
+		if token, err := decoder.Token(); err != nil || token != want {
+			return 0, false
+		}
+	}
+	token, err := decoder.Token()
+	if err != nil {
+		return 0, false
+	}
+	number, ok := token.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	generation, err := strconv.ParseUint(number.String(), 10, 64)
+	return generation, err == nil
+}
+
+// readFile reads and parses the store file. A missing file is an empty
+// store, its info is nil.
+func readFile(path string) (*storeFile, os.FileInfo, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &storeFile{}, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := parse(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, info, nil
+}
+
+// parse decodes the content of the store file.
+func parse(data []byte) (*storeFile, error) {
+	var file storeFile
+	if len(data) == 0 {
+		return &file, nil
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
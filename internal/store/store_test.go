@@ -0,0 +1,423 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akakream/MultiPlatform2IPFS/internal/ipfs"
+	registry "github.com/akakream/MultiPlatform2IPFS/internal/registry"
+)
+
+func openTestStore(t *testing.T, path string, retention time.Duration) *Store {
+	t.Helper()
+	s, err := Open(path, retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store", "store.json")
+	s := openTestStore(t, path, 0)
+
+	createdAt := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	job := Job{
+		ID:        "job1",
+		Name:      "docker.io/library/busybox",
+		Tag:       "latest",
+		Reference: "docker.io/library/busybox:latest",
+		Options:   JobOptions{Platforms: []registry.Platform{{OS: "linux", Architecture: "amd64"}}, Format: registry.FormatFlat},
+		State:     JobQueued,
+		Pid:       42,
+		CreatedAt: createdAt,
+		UpdatedAt: createdAt,
+	}
+	if err := s.PutJob(job); err != nil {
+		t.Fatal(err)
+	}
+	image := Image{Name: job.Name, Tag: job.Tag, Reference: job.Reference, SourceDigest: "sha256:a", Cid: "bafy", CopiedAt: createdAt}
+	if err := s.PutImage(image); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutPin(Pin{Cid: "bafy", Recursive: true, State: PinPinned, CreatedAt: createdAt, UpdatedAt: createdAt}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second store of the same file stands for another process
+	other := openTestStore(t, path, 0)
+	gotJob, err := other.Job("job1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotJob.Reference != job.Reference || gotJob.State != JobQueued || gotJob.Pid != 42 ||
+		!gotJob.CreatedAt.Equal(createdAt) || len(gotJob.Options.Platforms) != 1 {
+		t.Errorf("Job() = %+v, want %+v", gotJob, job)
+	}
+	gotImage, err := other.Image(image.Name, image.Tag)
+	if err != nil || gotImage.Cid != "bafy" {
+		t.Errorf("Image() = %+v, %v, want CID bafy", gotImage, err)
+	}
+	if pin, err := other.Pin("bafy"); err != nil || pin.State != PinPinned || !pin.Recursive {
+		t.Errorf("Pin() = %+v, %v, want a recursive pinned pin", pin, err)
+	}
+
+	updated, err := other.UpdateJob("job1", func(job *Job) error {
+		job.State = JobDone
+		job.Cid = "bafy"
+		return nil
+	})
+	if err != nil || updated.State != JobDone {
+		t.Fatalf("UpdateJob() = %+v, %v", updated, err)
+	}
+	// The first store sees the write of the other one
+	if gotJob, err := s.Job("job1"); err != nil || gotJob.State != JobDone || gotJob.Cid != "bafy" {
+		t.Errorf("Job() after an update of another store = %+v, %v, want done", gotJob, err)
+	}
+
+	changeErr := errors.New("rejected")
+	if _, err := s.UpdateJob("job1", func(job *Job) error {
+		job.State = JobFailed
+		return changeErr
+	}); !errors.Is(err, changeErr) {
+		t.Errorf("UpdateJob() error = %v, want %v", err, changeErr)
+	}
+	if gotJob, _ := other.Job("job1"); gotJob.State != JobDone {
+		t.Errorf("UpdateJob() wrote the change of a failed update: %s", gotJob.State)
+	}
+
+	if _, err := s.Job("nope"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("Job() error = %v, want ErrJobNotFound", err)
+	}
+	if _, err := s.UpdateJob("nope", func(*Job) error { return nil }); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("UpdateJob() error = %v, want ErrJobNotFound", err)
+	}
+	if _, err := s.DeleteImage(image.Name, image.Tag); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Image(image.Name, image.Tag); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("Image() after DeleteImage() error = %v, want ErrImageNotFound", err)
+	}
+}
+
+func TestStoreEmpty(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "store.json"), 0)
+	jobs, err := s.Jobs()
+	if err != nil || len(jobs) != 0 {
+		t.Errorf("Jobs() of a new store = %v, %v, want none", jobs, err)
+	}
+}
+
+func TestStoreCacheSeesContentChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	s := openTestStore(t, path, 0)
+	if err := s.PutJob(Job{ID: "job1", State: JobQueued}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Jobs(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file of another write has the same inode, size and modification
+	// time, only its generation tells it apart
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := bytes.Replace(data, []byte(`"job1"`), []byte(`"job2"`), 1)
+	changed = bytes.Replace(changed, []byte(`"generation": 1,`), []byte(`"generation": 2,`), 1)
+	if err := os.WriteFile(path, changed, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Job("job2"); err != nil {
+		t.Errorf("Job() after a change of the file error = %v", err)
+	}
+}
+
+func TestStoreConcurrentUpdates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	stores := []*Store{openTestStore(t, path, 0), openTestStore(t, path, 0)}
+
+	const jobs = 20
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			job := Job{ID: string(rune('a' + i)), State: JobQueued}
+			if err := stores[i%len(stores)].PutJob(job); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	got, err := stores[0].Jobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != jobs {
+		t.Errorf("Jobs() = %d jobs, want %d, a write was lost", len(got), jobs)
+	}
+}
+
+func TestStoreRetention(t *testing.T) {
+	now := time.Now().UTC()
+	at := func(age time.Duration) *time.Time {
+		finishedAt := now.Add(-age)
+		return &finishedAt
+	}
+
+	tests := []struct {
+		name      string
+		retention time.Duration
+		job       Job
+		kept      bool
+	}{
+		{name: "recent done job", retention: time.Hour, job: Job{State: JobDone, FinishedAt: at(time.Minute)}, kept: true},
+		{name: "old done job", retention: time.Hour, job: Job{State: JobDone, FinishedAt: at(2 * time.Hour)}},
+		{name: "old failed job", retention: time.Hour, job: Job{State: JobFailed, FinishedAt: at(2 * time.Hour)}},
+		{name: "old cancelled job", retention: time.Hour, job: Job{State: JobCancelled, FinishedAt: at(2 * time.Hour)}},
+		{name: "finished job without finish time", retention: time.Hour, job: Job{State: JobDone, UpdatedAt: now.Add(-2 * time.Hour)}},
+		{name: "old queued job", retention: time.Hour, job: Job{State: JobQueued, UpdatedAt: now.Add(-2 * time.Hour)}, kept: true},
+		{name: "old interrupted job", retention: time.Hour, job: Job{State: JobInterrupted, UpdatedAt: now.Add(-2 * time.Hour)}, kept: true},
+		{name: "no retention", retention: 0, job: Job{State: JobDone, FinishedAt: at(1000 * time.Hour)}, kept: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := openTestStore(t, filepath.Join(t.TempDir(), "store.json"), tt.retention)
+			tt.job.ID = "old"
+			if err := s.PutJob(tt.job); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.PutJob(Job{ID: "new", State: JobQueued, UpdatedAt: now}); err != nil {
+				t.Fatal(err)
+			}
+			_, err := s.Job("old")
+			if kept := err == nil; kept != tt.kept {
+				t.Errorf("job kept = %v, want %v (error %v)", kept, tt.kept, err)
+			}
+		})
+	}
+}
+
+func TestStorePinRetention(t *testing.T) {
+	now := time.Now().UTC()
+	s := openTestStore(t, filepath.Join(t.TempDir(), "store.json"), time.Hour)
+	pins := []struct {
+		pin  Pin
+		kept bool
+	}{
+		{pin: Pin{Cid: "old-failed", State: PinFailed, UpdatedAt: now.Add(-2 * time.Hour)}},
+		{pin: Pin{Cid: "recent-failed", State: PinFailed, UpdatedAt: now.Add(-time.Minute)}, kept: true},
+		{pin: Pin{Cid: "old-pinned", State: PinPinned, UpdatedAt: now.Add(-2 * time.Hour)}, kept: true},
+		{pin: Pin{Cid: "old-pinning", State: PinPinning, UpdatedAt: now.Add(-2 * time.Hour)}, kept: true},
+	}
+	for _, tt := range pins {
+		if err := s.PutPin(tt.pin); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range pins {
+		_, err := s.Pin(tt.pin.Cid)
+		if kept := err == nil; kept != tt.kept {
+			t.Errorf("pin %s kept = %v, want %v (error %v)", tt.pin.Cid, kept, tt.kept, err)
+		}
+	}
+}
+
+func TestStoreReadsFileWithoutGeneration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	if err := os.WriteFile(path, []byte(`{"jobs":[{"id":"job1","state":"done"}],"images":[],"pins":[]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := openTestStore(t, path, 0)
+	if _, err := s.Job("job1"); err != nil {
+		t.Fatalf("Job() of a file without generation error = %v", err)
+	}
+	if err := s.PutJob(Job{ID: "job2", State: JobQueued}); err != nil {
+		t.Fatal(err)
+	}
+	other := openTestStore(t, path, 0)
+	if jobs, err := other.Jobs(); err != nil || len(jobs) != 2 {
+		t.Errorf("Jobs() after the first write = %v, %v, want 2 jobs", jobs, err)
+	}
+}
+
+func TestReadGeneration(t *testing.T) {
+	tests := []struct {
+		content string
+		want    uint64
+		wantOK  bool
+	}{
+		{`{"generation": 42, "jobs": []}`, 42, true},
+		{"{\n  \"generation\": 0,\n  \"jobs\": null\n}", 0, true},
+		{`{"jobs": [], "generation": 42}`, 0, false},
+		{`{"generation": "42"}`, 0, false},
+		{`{"generation": -1}`, 0, false},
+		{``, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.content, func(t *testing.T) {
+			got, ok := readGeneration(strings.NewReader(tt.content))
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("readGeneration(%q) = %d, %v, want %d, %v", tt.content, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestDefaultRetention(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", defaultRetention, false},
+		{"24h", 24 * time.Hour, false},
+		{"0", 0, false},
+		{"-1h", 0, true},
+		{"week", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("JOB_RETENTION", tt.value)
+			got, err := DefaultRetention()
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("DefaultRetention() = %s, %v, want %s, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSameImage(t *testing.T) {
+	amd64 := registry.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := registry.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+	rawLeaves := ipfs.DefaultAddOptions
+	rawLeaves.RawLeaves = false
+
+	tests := []struct {
+		name  string
+		a, b  JobOptions
+		equal bool
+	}{
+		{name: "no options", equal: true},
+		{
+			name:  "platforms in another order",
+			a:     JobOptions{Platforms: []registry.Platform{amd64, arm64}},
+			b:     JobOptions{Platforms: []registry.Platform{arm64, amd64}},
+			equal: true,
+		},
+		{
+			name: "other platforms",
+			a:    JobOptions{Platforms: []registry.Platform{amd64}},
+			b:    JobOptions{Platforms: []registry.Platform{arm64}},
+		},
+		{
+			name: "a subset of the platforms",
+			a:    JobOptions{Platforms: []registry.Platform{amd64}},
+			b:    JobOptions{Platforms: []registry.Platform{amd64, arm64}},
+		},
+		{
+			name: "every platform and a single one",
+			b:    JobOptions{Platforms: []registry.Platform{amd64}},
+		},
+		{
+			name: "other format",
+			a:    JobOptions{Format: registry.FormatFlat},
+			b:    JobOptions{Format: registry.FormatPlatform},
+		},
+		{
+			name:  "default add options and a record without them",
+			a:     JobOptions{Add: &ipfs.DefaultAddOptions},
+			equal: true,
+		},
+		{
+			name: "other add options",
+			a:    JobOptions{Add: &rawLeaves},
+		},
+		{
+			name:  "options that do not change the image",
+			a:     JobOptions{Concurrency: 4, Credentials: true, Force: true},
+			b:     JobOptions{OnlyHash: true},
+			equal: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.sameImage(tt.b); got != tt.equal {
+				t.Errorf("sameImage() = %v, want %v", got, tt.equal)
+			}
+			if got := tt.b.sameImage(tt.a); got != tt.equal {
+				t.Errorf("sameImage() of the other options = %v, want %v", got, tt.equal)
+			}
+		})
+	}
+}
+
+func TestStoreLookup(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "store.json"), 0)
+	amd64 := registry.Platform{OS: "linux", Architecture: "amd64"}
+	copiedAt := time.Now().Add(-time.Hour)
+	images := []Image{
+		{Name: "docker.io/library/busybox", Tag: "latest", SourceDigest: "sha256:a", Cid: "bafy-all", CopiedAt: copiedAt},
+		{
+			Name: "docker.io/library/busybox", Tag: "1.36", SourceDigest: "sha256:a", Cid: "bafy-amd64", CopiedAt: copiedAt,
+			Options:   JobOptions{Platforms: []registry.Platform{amd64}},
+			Manifests: []registry.PlatformManifest{{Platform: amd64, Digest: "sha256:m", Size: 10}},
+		},
+		// The later copy of the same image under another tag wins
+		{Name: "docker.io/library/busybox", Tag: "stable", SourceDigest: "sha256:a", Cid: "bafy-later", CopiedAt: copiedAt.Add(time.Minute)},
+	}
+	for _, image := range images {
+		if err := s.PutImage(image); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		digest  string
+		options JobOptions
+		wantCid string
+	}{
+		{name: "latest copy", digest: "sha256:a", wantCid: "bafy-later"},
+		{name: "copy of the platforms", digest: "sha256:a", options: JobOptions{Platforms: []registry.Platform{amd64}}, wantCid: "bafy-amd64"},
+		{name: "other format", digest: "sha256:a", options: JobOptions{Format: registry.FormatPlatform}},
+		{name: "unknown digest", digest: "sha256:b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := s.Lookup(tt.options)(tt.digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantCid == "" {
+				if result != nil {
+					t.Errorf("Lookup() = %+v, want no image", result)
+				}
+				return
+			}
+			if result == nil || result.Cid != tt.wantCid || result.SourceDigest != tt.digest {
+				t.Fatalf("Lookup() = %+v, want the image %s", result, tt.wantCid)
+			}
+			if len(result.Platforms) != len(tt.options.Platforms) {
+				t.Errorf("Lookup() platforms = %v, want %v", result.Platforms, tt.options.Platforms)
+			}
+		})
+	}
+}
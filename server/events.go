@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/akakream/MultiPlatform2IPFS/internal/store"
+)
+
+// keepAliveInterval is how often an idle event stream sends a comment, so
+// proxies do not close it.
+const keepAliveInterval = 15 * time.Second
+
+// handleJobEvents streams the progress of the job as Server-Sent Events. The
+// stream starts with a job event with the current state of the job, followed
+// by phase, download, blob and upload events with the progress of the copy.
+// It ends with a result event with the finished job. The stream of a job that
+// is already finished only has the result event.
+func (s *Server) handleJobEvents(w http.ResponseWriter, r *http.Request) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return apiError{Err: "streaming is not supported", Status: http.StatusInternalServerError}
+	}
+	id := chi.URLParam(r, "id")
+
+	live, events, unsubscribe := s.jobs.subscribe(id)
+	defer unsubscribe()
+	if live == nil {
+		job, err := s.jobs.get(id)
+		if errors.Is(err, store.ErrJobNotFound) {
+			return apiError{Err: err.Error(), Status: http.StatusNotFound}
+		}
+		if err != nil {
+			return err
+		}
+		startEventStream(w)
+		return writeEvent(w, flusher, "result", job)
+	}
+
+	startEventStream(w)
+	if err := writeEvent(w, flusher, "job", s.jobs.snapshot(live)); err != nil {
+		return nil
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-events:
+			if err := writeEvent(w, flusher, event.name, event.data); err != nil {
+				return nil
+			}
+		case <-live.done:
+			for len(events) > 0 {
+				event := <-events
+				if err := writeEvent(w, flusher, event.name, event.data); err != nil {
+					return nil
+				}
+			}
+			// An interrupted job is not finished, its stream ends without a result
+			job, err := s.jobs.get(id)
+			if err == nil && job.Finished() {
+				writeEvent(w, flusher, "result", job)
+			}
+			return nil
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+			flusher.Flush()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// startEventStream sends the headers of an event stream.
+func startEventStream(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeEvent sends a single event with data as JSON.
+func writeEvent(w http.ResponseWriter, flusher http.Flusher, name string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, payload); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
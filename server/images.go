@@ -0,0 +1,299 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/akakream/MultiPlatform2IPFS/internal/ipfs"
+	registry "github.com/akakream/MultiPlatform2IPFS/internal/registry"
+	"github.com/akakream/MultiPlatform2IPFS/internal/store"
+)
+
+const (
+	// defaultImagesLimit is the page size of GET /images without a limit.
+	defaultImagesLimit = 100
+	// maxImagesLimit is the largest page size of GET /images.
+	maxImagesLimit = 1000
+)
+
+// imageResponse is an image of the catalog.
+type imageResponse struct {
+	store.Image
+	// Size is the size of all manifests, configs and layers in bytes.
+	Size int64 `json:"size"`
+}
+
+func newImageResponse(image store.Image) imageResponse {
+	return imageResponse{Image: image, Size: image.Size()}
+}
+
+// imagesResponse is a page of the catalog.
+type imagesResponse struct {
+	Images []imageResponse `json:"images"`
+	// Total is the number of images that match the filters.
+	Total  int `json:"total"`
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+}
+
+// tagsResponse lists the copied tags of an image.
+type tagsResponse struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// handleImages returns a page of the copied images. They can be filtered by
+// a part of their name and by platform.
+func (s *Server) handleImages(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	limit, err := queryInt(query.Get("limit"), defaultImagesLimit)
+	if err != nil || limit <= 0 || limit > maxImagesLimit {
+		return apiError{Err: fmt.Sprintf("limit must be between 1 and %d", maxImagesLimit), Status: http.StatusBadRequest}
+	}
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		return apiError{Err: "offset must not be negative", Status: http.StatusBadRequest}
+	}
+	var platform *registry.Platform
+	if value := query.Get("platform"); value != "" {
+		parsed, err := registry.ParsePlatform(value)
+		if err != nil {
+			return apiError{Err: err.Error(), Status: http.StatusBadRequest}
+		}
+		platform = &parsed
+	}
+
+	images, err := s.options.Store.Images()
+	if err != nil {
+		return err
+	}
+	var matching []imageResponse
+	for _, image := range images {
+		if !strings.Contains(image.Name, query.Get("name")) {
+			continue
+		}
+		if platform != nil && !hasPlatform(image, *platform) {
+			continue
+		}
+		matching = append(matching, newImageResponse(image))
+	}
+
+	page := imagesResponse{Images: []imageResponse{}, Total: len(matching), Limit: limit, Offset: offset}
+	if offset < len(matching) {
+		end := offset + limit
+		if end > len(matching) {
+			end = len(matching)
+		}
+		page.Images = matching[offset:end]
+	}
+	return writeJSON(w, http.StatusOK, page)
+}
+
+// handleImage answers GET /images/{name}/{tag} with the image and
+// GET /images/{name}/tags with its tags. The name may contain slashes. The
+// tag of an image that is literally tagged "tags" is served instead of the
+// tags of its name, which are listed by GET /images?name= as well.
+func (s *Server) handleImage(w http.ResponseWriter, r *http.Request) error {
+	path := chi.URLParam(r, "*")
+	name, tag, err := parseImagePath(path)
+	if err != nil {
+		return err
+	}
+	image, err := s.options.Store.Image(name, tag)
+	if errors.Is(err, store.ErrImageNotFound) {
+		if tag == "tags" {
+			return s.handleTags(w, strings.TrimSuffix(path, "/tags"))
+		}
+		return apiError{Err: err.Error(), Status: http.StatusNotFound}
+	}
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, newImageResponse(image))
+}
+
+// handleTags returns the copied tags of the image with the name.
+func (s *Server) handleTags(w http.ResponseWriter, name string) error {
+	name, err := parseImageName(name)
+	if err != nil {
+		return err
+	}
+	images, err := s.options.Store.Images()
+	if err != nil {
+		return err
+	}
+	tags := tagsResponse{Name: name, Tags: []string{}}
+	for _, image := range images {
+		if image.Name == name {
+			tags.Tags = append(tags.Tags, image.Tag)
+		}
+	}
+	if len(tags.Tags) == 0 {
+		return apiError{Err: store.ErrImageNotFound.Error(), Status: http.StatusNotFound}
+	}
+	return writeJSON(w, http.StatusOK, tags)
+}
+
+// handleDeleteImage unpins the image and removes it from the catalog.
+func (s *Server) handleDeleteImage(w http.ResponseWriter, r *http.Request) error {
+	name, tag, err := parseImagePath(chi.URLParam(r, "*"))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+	image, err := s.deleteImage(ctx, name, tag)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, newImageResponse(image))
+}
+
+// deleteImage unpins the image and removes it from the catalog. The CID
+// stays pinned while another tag of the catalog has the same content or it
+// was pinned with the pin API.
+func (s *Server) deleteImage(ctx context.Context, name string, tag string) (store.Image, error) {
+	image, err := s.options.Store.Image(name, tag)
+	if errors.Is(err, store.ErrImageNotFound) {
+		return store.Image{}, apiError{Err: err.Error(), Status: http.StatusNotFound}
+	}
+	if err != nil {
+		return store.Image{}, err
+	}
+
+	images, err := s.options.Store.Images()
+	if err != nil {
+		return store.Image{}, err
+	}
+	shared := false
+	for _, other := range images {
+		if other.Cid == image.Cid && (other.Name != image.Name || other.Tag != image.Tag) {
+			shared = true
+			break
+		}
+	}
+	if _, err := s.options.Store.Pin(image.Cid); err == nil {
+		shared = true
+	} else if !errors.Is(err, store.ErrPinNotFound) {
+		return store.Image{}, err
+	}
+	if !shared {
+		if err := s.options.IPFS.Unpin(ctx, image.Cid); err != nil && !errors.Is(err, ipfs.ErrNotPinned) {
+			return store.Image{}, apiError{Err: fmt.Sprintf("unpinning %s: %v", image.Cid, err), Status: http.StatusBadGateway}
+		}
+	}
+
+	image, err = s.options.Store.DeleteImage(name, tag)
+	if errors.Is(err, store.ErrImageNotFound) {
+		return store.Image{}, apiError{Err: err.Error(), Status: http.StatusNotFound}
+	}
+	return image, err
+}
+
+// imageExpiryInterval is how often the images that were not copied again
+// for ImageRetention are removed.
+const imageExpiryInterval = time.Hour
+
+// expireImages removes the images that were not copied again for
+// ImageRetention from the catalog and unpins them, like DELETE does, until
+// the server shuts down. It does nothing without a retention.
+func (s *Server) expireImages() {
+	if s.options.ImageRetention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(imageExpiryInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.expireImagesOnce(time.Now()); err != nil {
+			log.Printf("Can not expire the images: %v", err)
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expireImagesOnce removes the images that were copied longer than
+// ImageRetention before now.
+func (s *Server) expireImagesOnce(now time.Time) error {
+	images, err := s.options.Store.Images()
+	if err != nil {
+		return err
+	}
+	for _, image := range images {
+		if now.Sub(image.CopiedAt) <= s.options.ImageRetention {
+			continue
+		}
+		_, err := s.deleteImage(s.ctx, image.Name, image.Tag)
+		if isNotFound(err) {
+			// The image was deleted in the meantime
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("expiring %s:%s: %w", image.Name, image.Tag, err)
+		}
+		log.Printf("Expired the image %s:%s copied at %s", image.Name, image.Tag, image.CopiedAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// isNotFound reports whether err is an apiError with status 404.
+func isNotFound(err error) bool {
+	var e apiError
+	return errors.As(err, &e) && e.Status == http.StatusNotFound
+}
+
+// parseImagePath splits the name and the tag of /images/{name}/{tag}. The
+// name is normalized, so busybox and docker.io/library/busybox are the same
+// image.
+func parseImagePath(path string) (string, string, error) {
+	i := strings.LastIndex(path, "/")
+	if i <= 0 || i == len(path)-1 {
+		return "", "", apiError{Err: "the path must be /images/{name}/{tag}", Status: http.StatusBadRequest}
+	}
+	name, err := parseImageName(path[:i])
+	if err != nil {
+		return "", "", err
+	}
+	return name, path[i+1:], nil
+}
+
+// parseImageName normalizes the name of an image.
+func parseImageName(name string) (string, error) {
+	ref, err := registry.ParseReference(name)
+	if err == nil && (ref.Digest != "" || strings.HasSuffix(name, ":"+ref.Tag)) {
+		err = fmt.Errorf("%w: %q is not an image name", registry.ErrInvalidReference, name)
+	}
+	if err != nil {
+		return "", apiError{Err: err.Error(), Status: http.StatusBadRequest}
+	}
+	return ref.Name(), nil
+}
+
+// hasPlatform reports whether a manifest of the image matches the platform.
+func hasPlatform(image store.Image, platform registry.Platform) bool {
+	for _, manifest := range image.Manifests {
+		if platform.Matches(manifest.Platform) {
+			return true
+		}
+	}
+	return false
+}
+
+// queryInt parses a query parameter, an empty value is fallback.
+func queryInt(value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akakream/MultiPlatform2IPFS/internal/store"
+)
+
+func TestHandleImageTags(t *testing.T) {
+	s := newTestServer(t, "http://127.0.0.1:1")
+	for _, image := range []store.Image{
+		{Name: "docker.io/library/busybox", Tag: "latest", Cid: "bafylatest"},
+		{Name: "docker.io/library/busybox", Tag: "1.36", Cid: "bafy136"},
+		{Name: "ghcr.io/org/app", Tag: "tags", Cid: "bafytags"},
+	} {
+		if err := s.options.Store.PutImage(image); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantTags   []string
+		wantCid    string
+	}{
+		{name: "tags of a name", path: "/images/busybox/tags", wantStatus: http.StatusOK, wantTags: []string{"1.36", "latest"}},
+		{name: "tags of a normalized name", path: "/images/docker.io/library/busybox/tags", wantStatus: http.StatusOK, wantTags: []string{"1.36", "latest"}},
+		{name: "image tagged tags", path: "/images/ghcr.io/org/app/tags", wantStatus: http.StatusOK, wantCid: "bafytags"},
+		{name: "image", path: "/images/busybox/latest", wantStatus: http.StatusOK, wantCid: "bafylatest"},
+		{name: "tags of an unknown name", path: "/images/nginx/tags", wantStatus: http.StatusNotFound},
+		{name: "unknown tag", path: "/images/busybox/nope", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("GET %s status = %d, want %d: %s", tt.path, w.Code, tt.wantStatus, w.Body)
+			}
+			var body struct {
+				Tags []string `json:"tags"`
+				Cid  string   `json:"cid"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantTags != nil && !reflect.DeepEqual(body.Tags, tt.wantTags) {
+				t.Errorf("GET %s tags = %v, want %v", tt.path, body.Tags, tt.wantTags)
+			}
+			if body.Cid != tt.wantCid {
+				t.Errorf("GET %s cid = %q, want %q", tt.path, body.Cid, tt.wantCid)
+			}
+		})
+	}
+}
+
+func TestExpireImages(t *testing.T) {
+	var mu sync.Mutex
+	var unpinned []string
+	ipfsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v0/pin/rm" {
+			t.Errorf("request to %s, want only /api/v0/pin/rm", r.URL.Path)
+		}
+		mu.Lock()
+		unpinned = append(unpinned, r.URL.Query().Get("arg"))
+		mu.Unlock()
+		fmt.Fprintf(w, `{"Pins":[%q]}`, r.URL.Query().Get("arg"))
+	}))
+	defer ipfsServer.Close()
+
+	s := newTestServer(t, ipfsServer.URL)
+	s.options.ImageRetention = time.Hour
+	now := time.Now().UTC()
+	images := []struct {
+		image store.Image
+		kept  bool
+	}{
+		{image: store.Image{Name: "docker.io/library/old", Tag: "1", Cid: "bafyold", CopiedAt: now.Add(-2 * time.Hour)}},
+		// The content of the expired tag is still in the catalog with another tag
+		{image: store.Image{Name: "docker.io/library/shared", Tag: "1", Cid: "bafyshared", CopiedAt: now.Add(-2 * time.Hour)}},
+		{image: store.Image{Name: "docker.io/library/shared", Tag: "2", Cid: "bafyshared", CopiedAt: now}, kept: true},
+		// The content was pinned with the pin API as well
+		{image: store.Image{Name: "docker.io/library/pinned", Tag: "1", Cid: "bafypinned", CopiedAt: now.Add(-2 * time.Hour)}},
+		{image: store.Image{Name: "docker.io/library/recent", Tag: "1", Cid: "bafyrecent", CopiedAt: now}, kept: true},
+	}
+	for _, tt := range images {
+		if err := s.options.Store.PutImage(tt.image); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.options.Store.PutPin(store.Pin{Cid: "bafypinned", State: store.PinPinned}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.expireImagesOnce(now); err != nil {
+		t.Fatalf("expireImagesOnce() error = %v", err)
+	}
+	for _, tt := range images {
+		_, err := s.options.Store.Image(tt.image.Name, tt.image.Tag)
+		if kept := err == nil; kept != tt.kept {
+			t.Errorf("image %s:%s kept = %v, want %v (error %v)", tt.image.Name, tt.image.Tag, kept, tt.kept, err)
+		}
+	}
+	if want := []string{"bafyold"}; !reflect.DeepEqual(unpinned, want) {
+		t.Errorf("expireImagesOnce() unpinned %v, want %v", unpinned, want)
+	}
+}
@@ -0,0 +1,674 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akakream/MultiPlatform2IPFS/internal/ipfs"
+	registry "github.com/akakream/MultiPlatform2IPFS/internal/registry"
+	"github.com/akakream/MultiPlatform2IPFS/internal/store"
+)
+
+// defaultJobWorkers is the number of copies that run at the same time when
+// no worker count is configured.
+const defaultJobWorkers = 2
+
+// maxQueuedJobs limits the jobs that wait for a worker.
+const maxQueuedJobs = 1024
+
+var (
+	// errQueueFull is error for when no more jobs can be queued
+	errQueueFull = errors.New("the job queue is full")
+	// errNotResumable is error for when a job can not be resumed after a restart
+	errNotResumable = errors.New("the job was interrupted and can not be resumed because its credentials are not stored")
+	// errJobTaken is error for when another process resumed the job
+	errJobTaken = errors.New("the job is run by another process")
+	// errShuttingDown is error for when the server shuts down
+	errShuttingDown = errors.New("the server is shutting down")
+	// errJobCancelled is error for when the job was cancelled through the API
+	errJobCancelled = errors.New("the job was cancelled")
+	// errJobFinished is error for when a job that is already finished is cancelled
+	errJobFinished = errors.New("the job is already finished")
+)
+
+// copyRequest is a validated POST /image request.
+type copyRequest struct {
+	name string
+	tag  string
+	ref  registry.Reference
+	opts registry.CopyOptions
+}
+
+// liveJob is a job of this process that is queued or running. Its progress
+// is kept in memory and only its state changes are written to the store.
+type liveJob struct {
+	job     store.Job
+	request *copyRequest
+	// key identifies the copies the job does, see coalesceKey.
+	key string
+	// done is closed when the job ends. result and err are set before.
+	done   chan struct{}
+	result *registry.CopyResult
+	err    error
+	// subscribers receive the progress events of the job.
+	subscribers map[chan jobEvent]struct{}
+	// cancel stops the copy of the job while it runs. cancelled is set when
+	// the job is cancelled, a queued job is then never started.
+	cancel    context.CancelFunc
+	cancelled bool
+	// unlock releases the lock of the job in the store, which tells other
+	// processes that this process owns the job. It is called when the job ends.
+	unlock func()
+}
+
+// jobEvent is a progress event of a job. name is a registry.ProgressEvent
+// and data is the registry.Progress of the update.
+type jobEvent struct {
+	name string
+	data any
+}
+
+// subscriberBuffer is the number of events a subscriber may fall behind.
+// Further events are dropped until it catches up.
+const subscriberBuffer = 256
+
+// jobQueue runs the submitted copies with a fixed number of workers and
+// records them in the store. The copies are cancelled with the context of
+// the queue.
+type jobQueue struct {
+	ctx   context.Context
+	store *store.Store
+	ipfs  *ipfs.Client
+	mu    sync.Mutex
+	live  map[string]*liveJob
+	// inflight are the live jobs by their key. A copy that is requested again
+	// while its job is queued or running joins the job.
+	inflight map[string]*liveJob
+	pending  chan *liveJob
+	// closed is set by drain, after which no job is submitted or started.
+	// stopped is closed at the same time to stop the workers.
+	closed  bool
+	stopped chan struct{}
+	// running counts the jobs the workers run.
+	running sync.WaitGroup
+}
+
+func newJobQueue(ctx context.Context, jobStore *store.Store, client *ipfs.Client, workers int) *jobQueue {
+	if workers <= 0 {
+		workers = defaultJobWorkers
+	}
+	q := &jobQueue{
+		ctx:      ctx,
+		store:    jobStore,
+		ipfs:     client,
+		live:     map[string]*liveJob{},
+		inflight: map[string]*liveJob{},
+		pending:  make(chan *liveJob, maxQueuedJobs),
+		stopped:  make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// submit records and queues the copy and returns its job. If the same copy
+// is already queued or running, its job is returned instead of a new one.
+func (q *jobQueue) submit(request *copyRequest) (*liveJob, error) {
+	key := coalesceKey(request.ref, request.opts)
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil, errShuttingDown
+	}
+	if live, ok := q.inflight[key]; ok {
+		q.mu.Unlock()
+		log.Printf("Joining job %s of %s", live.job.ID, request.ref)
+		return live, nil
+	}
+	q.mu.Unlock()
+
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	job := store.Job{
+		ID:        id,
+		Name:      request.name,
+		Tag:       request.tag,
+		Reference: request.ref.String(),
+		Options:   store.NewJobOptions(request.opts),
+		State:     store.JobQueued,
+		Pid:       os.Getpid(),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, errShuttingDown
+	}
+	// Another request may have submitted the same copy in the meantime
+	if live, ok := q.inflight[key]; ok {
+		return live, nil
+	}
+	if len(q.pending) == cap(q.pending) {
+		return nil, errQueueFull
+	}
+	unlock, locked, err := q.store.LockJob(id)
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, fmt.Errorf("the lock of the new job %s is held", id)
+	}
+	if err := q.store.PutJob(job); err != nil {
+		unlock()
+		return nil, err
+	}
+	live := &liveJob{job: job, request: request, key: key, done: make(chan struct{}), unlock: unlock}
+	q.enqueue(live)
+	return live, nil
+}
+
+// enqueue hands the job to the workers. The caller holds q.mu and made sure
+// the queue has room.
+func (q *jobQueue) enqueue(live *liveJob) {
+	q.live[live.job.ID] = live
+	q.inflight[live.key] = live
+	q.pending <- live
+}
+
+// finish removes the ended job from the live jobs and wakes up its waiters.
+func (q *jobQueue) finish(live *liveJob, result *registry.CopyResult, err error) {
+	q.mu.Lock()
+	delete(q.live, live.job.ID)
+	if q.inflight[live.key] == live {
+		delete(q.inflight, live.key)
+	}
+	q.mu.Unlock()
+	if live.unlock != nil {
+		live.unlock()
+	}
+	live.result, live.err = result, err
+	close(live.done)
+}
+
+// subscribe returns the live job with the id and a channel with its progress
+// events. unsubscribe must be called when the events are no longer read. It
+// returns a nil job if the job is not queued or running.
+func (q *jobQueue) subscribe(id string) (live *liveJob, events <-chan jobEvent, unsubscribe func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	live, ok := q.live[id]
+	if !ok {
+		return nil, nil, func() {}
+	}
+	ch := make(chan jobEvent, subscriberBuffer)
+	if live.subscribers == nil {
+		live.subscribers = map[chan jobEvent]struct{}{}
+	}
+	live.subscribers[ch] = struct{}{}
+	return live, ch, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		delete(live.subscribers, ch)
+	}
+}
+
+// publish sends the event to the subscribers of the job without blocking the
+// copy. The caller holds q.mu.
+func (q *jobQueue) publish(live *liveJob, event jobEvent) {
+	for ch := range live.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// snapshot returns the current state of the live job.
+func (q *jobQueue) snapshot(live *liveJob) store.Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return live.job
+}
+
+// get returns the job with the id.
+func (q *jobQueue) get(id string) (store.Job, error) {
+	q.mu.Lock()
+	live, ok := q.live[id]
+	if ok {
+		job := live.job
+		q.mu.Unlock()
+		return job, nil
+	}
+	q.mu.Unlock()
+	return q.store.Job(id)
+}
+
+// list returns every job, the oldest first.
+func (q *jobQueue) list() ([]store.Job, error) {
+	jobs, err := q.store.Jobs()
+	if err != nil {
+		return nil, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, job := range jobs {
+		if live, ok := q.live[job.ID]; ok {
+			jobs[i] = live.job
+		}
+	}
+	return jobs, nil
+}
+
+func (q *jobQueue) work() {
+	for {
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-q.stopped:
+			return
+		case live := <-q.pending:
+			q.mu.Lock()
+			closed := q.closed
+			cancelled := live.cancelled
+			if !closed && !cancelled {
+				q.running.Add(1)
+			}
+			q.mu.Unlock()
+			if cancelled {
+				// The job was finished when it was cancelled
+				continue
+			}
+			if closed {
+				q.interrupt(live, errShuttingDown)
+				continue
+			}
+			q.run(live)
+			q.running.Done()
+		}
+	}
+}
+
+// drain stops the queue when the server shuts down. New jobs are rejected,
+// queued jobs are not started and running jobs have the grace period to
+// finish before cancel is called to stop them. The jobs that did not finish
+// are recorded as interrupted, so the next start resumes them.
+func (q *jobQueue) drain(grace time.Duration, cancel context.CancelFunc) {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	close(q.stopped)
+
+	running := make(chan struct{})
+	go func() {
+		q.running.Wait()
+		close(running)
+	}()
+	select {
+	case <-running:
+	case <-time.After(grace):
+		log.Printf("Cancelling the running jobs after the grace period of %s", grace)
+		cancel()
+		<-running
+	}
+
+	for {
+		select {
+		case live := <-q.pending:
+			q.mu.Lock()
+			cancelled := live.cancelled
+			q.mu.Unlock()
+			if !cancelled {
+				q.interrupt(live, errShuttingDown)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// interrupt records the job as interrupted and ends it.
+func (q *jobQueue) interrupt(live *liveJob, err error) {
+	log.Printf("Job %s was interrupted: %v", live.job.ID, err)
+	q.record(live.job.ID, func(job *store.Job) {
+		job.State = store.JobInterrupted
+	})
+	q.mu.Lock()
+	live.job.State = store.JobInterrupted
+	q.mu.Unlock()
+	q.finish(live, nil, err)
+}
+
+// cancel cancels the job with the id. A queued job is finished right away,
+// the copy of a running job is stopped and the job is finished once its
+// transfers are aborted. It returns the job as it is recorded.
+func (q *jobQueue) cancel(id string) (store.Job, error) {
+	q.mu.Lock()
+	live, ok := q.live[id]
+	if !ok {
+		q.mu.Unlock()
+		job, err := q.store.Job(id)
+		if err != nil {
+			return store.Job{}, err
+		}
+		if job.Finished() {
+			return job, errJobFinished
+		}
+		return q.cancelOrphan(job)
+	}
+	if live.cancelled {
+		job := live.job
+		q.mu.Unlock()
+		return job, nil
+	}
+	live.cancelled = true
+	running := live.cancel != nil
+	if running {
+		live.cancel()
+		job := live.job
+		q.mu.Unlock()
+		log.Printf("Cancelling job %s", id)
+		return job, nil
+	}
+	q.mu.Unlock()
+
+	log.Printf("Job %s was cancelled before it started", id)
+	q.cancelled(live)
+	return q.snapshot(live), nil
+}
+
+// cancelOrphan cancels an unfinished job that is not live in this process.
+// It returns errJobTaken if another running process owns the job. A job
+// whose process died is recorded as cancelled, so the next start does not
+// resume it.
+func (q *jobQueue) cancelOrphan(job store.Job) (store.Job, error) {
+	unlock, locked, err := q.store.LockJob(job.ID)
+	if err != nil {
+		return job, err
+	}
+	if !locked {
+		return job, errJobTaken
+	}
+	defer unlock()
+
+	log.Printf("Job %s of a stopped process was cancelled", job.ID)
+	return q.store.UpdateJob(job.ID, func(job *store.Job) error {
+		if job.Finished() {
+			return errJobFinished
+		}
+		job.UpdatedAt = time.Now().UTC()
+		job.State = store.JobCancelled
+		job.Error = errJobCancelled.Error()
+		job.FinishedAt = &job.UpdatedAt
+		return nil
+	})
+}
+
+// cancelled records the job as cancelled and ends it.
+func (q *jobQueue) cancelled(live *liveJob) {
+	finishedAt := time.Now().UTC()
+	q.record(live.job.ID, func(job *store.Job) {
+		job.State = store.JobCancelled
+		job.Error = errJobCancelled.Error()
+		job.FinishedAt = &finishedAt
+	})
+	q.mu.Lock()
+	live.job.State = store.JobCancelled
+	live.job.Error = errJobCancelled.Error()
+	live.job.FinishedAt = &finishedAt
+	q.mu.Unlock()
+	q.finish(live, nil, errJobCancelled)
+}
+
+// run copies the image of the job and records the result.
+func (q *jobQueue) run(live *liveJob) {
+	ctx, cancel := context.WithCancel(q.ctx)
+	defer cancel()
+	q.mu.Lock()
+	if live.cancelled {
+		// The job was cancelled before it started, cancel finishes it
+		q.mu.Unlock()
+		return
+	}
+	live.cancel = cancel
+	q.mu.Unlock()
+
+	opts := live.request.opts
+	opts.Progress = func(progress registry.Progress) {
+		event := jobEvent{name: string(progress.Event), data: progress}
+		// Only the latest blob event has a blob
+		progress.Blob = nil
+		q.mu.Lock()
+		changed := live.job.State != store.JobState(progress.Phase)
+		live.job.State = store.JobState(progress.Phase)
+		live.job.Progress = progress
+		live.job.UpdatedAt = time.Now().UTC()
+		q.publish(live, event)
+		q.mu.Unlock()
+		if changed {
+			q.record(live.job.ID, func(job *store.Job) {
+				job.State = store.JobState(progress.Phase)
+				job.Progress = progress
+			})
+		}
+	}
+
+	result, err := registry.CopyImage(ctx, q.ipfs, live.request.ref, opts)
+	q.mu.Lock()
+	cancelled := live.cancelled
+	q.mu.Unlock()
+	if err != nil && cancelled {
+		log.Printf("Job %s was cancelled: %v", live.job.ID, err)
+		q.cancelled(live)
+		return
+	}
+	if err != nil && q.ctx.Err() != nil {
+		// The server shuts down, the job is resumed by the next start
+		q.interrupt(live, err)
+		return
+	}
+
+	finishedAt := time.Now().UTC()
+	// An image that was only hashed is not published
+	if err == nil && !opts.OnlyHash {
+		image := store.NewImage(live.request.ref, live.request.opts, result, live.job.ID, finishedAt)
+		if err := q.store.PutImage(image); err != nil {
+			log.Printf("Can not record the image of job %s: %v", live.job.ID, err)
+		}
+	}
+
+	q.mu.Lock()
+	progress := live.job.Progress
+	q.mu.Unlock()
+	defer q.finish(live, result, err)
+	q.record(live.job.ID, func(job *store.Job) {
+		job.FinishedAt = &finishedAt
+		job.Progress = progress
+		if err != nil {
+			log.Printf("Job %s failed: %v", job.ID, err)
+			job.State = store.JobFailed
+			job.Error = err.Error()
+			job.ErrorStatus = copyErrorStatus(err)
+			return
+		}
+		job.State = store.JobDone
+		job.Cid = result.Cid
+		job.Reused = result.Reused
+		job.SourceDigest = result.SourceDigest
+		job.Digest = result.IndexDigest
+		job.Manifests = result.Manifests
+	})
+}
+
+// record changes the job in the store.
+func (q *jobQueue) record(id string, change func(*store.Job)) {
+	_, err := q.store.UpdateJob(id, func(job *store.Job) error {
+		change(job)
+		job.UpdatedAt = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		log.Printf("Can not record job %s: %v", id, err)
+	}
+}
+
+// resume queues the jobs that were interrupted when their process stopped,
+// either by a shutdown or because the process died. A job belongs to a
+// running process as long as the process holds its lock. Jobs that were
+// given credentials can not be resumed and fail instead.
+func (q *jobQueue) resume(keepStaging bool) error {
+	jobs, err := q.store.Jobs()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if job.Finished() {
+			continue
+		}
+		unlock, locked, err := q.store.LockJob(job.ID)
+		if err != nil {
+			return err
+		}
+		if !locked {
+			// The job is queued or running in another process
+			continue
+		}
+		resumed, err := q.store.UpdateJob(job.ID, func(job *store.Job) error {
+			if job.Finished() {
+				return errJobTaken
+			}
+			job.UpdatedAt = time.Now().UTC()
+			if job.Options.Credentials {
+				job.State = store.JobFailed
+				job.Error = errNotResumable.Error()
+				job.ErrorStatus = copyErrorStatus(errNotResumable)
+				job.FinishedAt = &job.UpdatedAt
+				return nil
+			}
+			job.State = store.JobQueued
+			job.Progress = registry.Progress{}
+			job.Pid = os.Getpid()
+			return nil
+		})
+		if errors.Is(err, errJobTaken) {
+			unlock()
+			continue
+		}
+		if err != nil {
+			unlock()
+			return err
+		}
+		if resumed.State != store.JobQueued {
+			unlock()
+			log.Printf("Job %s failed: %v", resumed.ID, errNotResumable)
+			continue
+		}
+
+		if err := q.requeue(resumed, keepStaging, unlock); err != nil {
+			log.Printf("Job %s can not be resumed: %v", resumed.ID, err)
+			q.record(resumed.ID, func(job *store.Job) {
+				finishedAt := time.Now().UTC()
+				job.FinishedAt = &finishedAt
+				job.State = store.JobFailed
+				job.Error = err.Error()
+				job.ErrorStatus = copyErrorStatus(err)
+			})
+			unlock()
+			continue
+		}
+		log.Printf("Resuming job %s of %s", resumed.ID, resumed.Reference)
+	}
+	return nil
+}
+
+// requeue queues a stored job again. unlock releases the lock of the job,
+// which the caller holds, once the job ends.
+func (q *jobQueue) requeue(job store.Job, keepStaging bool, unlock func()) error {
+	ref, err := registry.ParseReference(job.Reference)
+	if err != nil {
+		return err
+	}
+	request := &copyRequest{
+		name: job.Name,
+		tag:  job.Tag,
+		ref:  ref,
+		opts: registry.CopyOptions{
+			Platforms:   job.Options.Platforms,
+			Format:      job.Options.Format,
+			Concurrency: job.Options.Concurrency,
+			KeepStaging: keepStaging,
+			Lookup:      q.store.Lookup(job.Options),
+			Force:       job.Options.Force,
+			OnlyHash:    job.Options.OnlyHash,
+		},
+	}
+	add := job.Options.AddOptions()
+	request.opts.Add = &add
+
+	live := &liveJob{job: job, request: request, key: coalesceKey(ref, request.opts), done: make(chan struct{}), unlock: unlock}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == cap(q.pending) {
+		return errQueueFull
+	}
+	q.enqueue(live)
+	return nil
+}
+
+// coalesceKey identifies the copies that produce the same result: copies of
+// the same resolved reference with the same platforms, format, add options
+// and credentials. The credentials are hashed, so a copy only joins a job that
+// was given the same ones.
+func coalesceKey(ref registry.Reference, opts registry.CopyOptions) string {
+	platforms := make([]string, 0, len(opts.Platforms))
+	for _, platform := range opts.Platforms {
+		platforms = append(platforms, platform.String())
+	}
+	sort.Strings(platforms)
+
+	addKey := ""
+	if opts.Add != nil {
+		addKey = fmt.Sprintf("%+v", *opts.Add)
+	}
+
+	credentials := ""
+	if opts.Credentials != nil && !opts.Credentials.IsEmpty() {
+		creds := opts.Credentials
+		sum := sha256.Sum256([]byte(creds.Username + "\x00" + creds.Password + "\x00" + creds.IdentityToken))
+		credentials = hex.EncodeToString(sum[:])
+	}
+	return strings.Join([]string{
+		ref.String(),
+		string(opts.Format),
+		strings.Join(platforms, ","),
+		strconv.FormatBool(opts.Force),
+		addKey,
+		strconv.FormatBool(opts.OnlyHash),
+		credentials,
+	}, "|")
+}
+
+// newJobID returns a random job ID.
+func newJobID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,337 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akakream/MultiPlatform2IPFS/internal/ipfs"
+	registry "github.com/akakream/MultiPlatform2IPFS/internal/registry"
+	"github.com/akakream/MultiPlatform2IPFS/internal/store"
+)
+
+func TestCoalesceKey(t *testing.T) {
+	parse := func(s string) registry.Reference {
+		ref, err := registry.ParseReference(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ref
+	}
+	platforms := func(s ...string) []registry.Platform {
+		parsed, err := registry.ParsePlatforms(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	cidV0 := ipfs.DefaultAddOptions
+	cidV0.CidVersion = 0
+	cidV0.RawLeaves = false
+
+	base := registry.CopyOptions{Platforms: platforms("linux/amd64", "linux/arm64"), Format: registry.FormatFlat}
+	tests := []struct {
+		name string
+		ref  string
+		opts registry.CopyOptions
+		same bool
+	}{
+		{name: "same copy", ref: "nginx", opts: base, same: true},
+		{name: "normalized reference", ref: "docker.io/library/nginx:latest", opts: base, same: true},
+		{name: "platforms in another order", ref: "nginx", opts: registry.CopyOptions{Platforms: platforms("linux/arm64", "linux/amd64"), Format: registry.FormatFlat}, same: true},
+		{name: "progress callback is ignored", ref: "nginx", opts: registry.CopyOptions{Platforms: base.Platforms, Format: base.Format, Progress: func(registry.Progress) {}}, same: true},
+		{name: "empty credentials are none", ref: "nginx", opts: registry.CopyOptions{Platforms: base.Platforms, Format: base.Format, Credentials: &registry.Credentials{}}, same: true},
+		{name: "another tag", ref: "nginx:1.25", opts: base},
+		{name: "other platforms", ref: "nginx", opts: registry.CopyOptions{Platforms: platforms("linux/amd64"), Format: registry.FormatFlat}},
+		{name: "other format", ref: "nginx", opts: registry.CopyOptions{Platforms: base.Platforms, Format: registry.FormatPlatform}},
+		{name: "forced", ref: "nginx", opts: registry.CopyOptions{Platforms: base.Platforms, Format: base.Format, Force: true}},
+		{name: "other add options", ref: "nginx", opts: registry.CopyOptions{Platforms: base.Platforms, Format: base.Format, Add: &cidV0}},
+		{name: "only hash", ref: "nginx", opts: registry.CopyOptions{Platforms: base.Platforms, Format: base.Format, OnlyHash: true}},
+		{name: "credentials", ref: "nginx", opts: registry.CopyOptions{Platforms: base.Platforms, Format: base.Format, Credentials: &registry.Credentials{Username: "u", Password: "p"}}},
+	}
+	key := coalesceKey(parse("nginx"), base)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := coalesceKey(parse(tt.ref), tt.opts); (got == key) != tt.same {
+				t.Errorf("coalesceKey(%q) = %q, same as %q is %v, want %v", tt.ref, got, key, got == key, tt.same)
+			}
+		})
+	}
+}
+
+func TestCoalesceKeyHidesCredentials(t *testing.T) {
+	ref, err := registry.ParseReference("ghcr.io/org/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := coalesceKey(ref, registry.CopyOptions{Credentials: &registry.Credentials{Username: "user", Password: "secret"}})
+	b := coalesceKey(ref, registry.CopyOptions{Credentials: &registry.Credentials{Username: "user", Password: "other"}})
+	if a == b {
+		t.Errorf("coalesceKey() is the same for different passwords: %q", a)
+	}
+	for _, secret := range []string{"user", "secret"} {
+		if strings.Contains(a, secret) {
+			t.Errorf("coalesceKey() = %q contains the credential %q", a, secret)
+		}
+	}
+}
+
+// newTestQueue returns a queue of a new store without workers, so the
+// queued jobs stay pending.
+func newTestQueue(t *testing.T) *jobQueue {
+	t.Helper()
+	jobStore, err := store.Open(filepath.Join(t.TempDir(), "store.json"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &jobQueue{
+		ctx:      context.Background(),
+		store:    jobStore,
+		live:     map[string]*liveJob{},
+		inflight: map[string]*liveJob{},
+		pending:  make(chan *liveJob, maxQueuedJobs),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// putTestJob records a job of busybox with the id.
+func putTestJob(t *testing.T, jobStore *store.Store, id string, job store.Job) {
+	t.Helper()
+	job.ID = id
+	job.Name = "docker.io/library/busybox"
+	job.Tag = "latest"
+	if job.Reference == "" {
+		job.Reference = "docker.io/library/busybox:latest"
+	}
+	if err := jobStore.PutJob(job); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJobQueueResume(t *testing.T) {
+	// deadPid is above the pid limit of Linux, so no process has it
+	const deadPid = 1 << 30
+	alivePid := os.Getppid()
+
+	tests := []struct {
+		name string
+		job  store.Job
+		// locked means another running process holds the lock of the job
+		locked      bool
+		wantState   store.JobState
+		wantResumed bool
+	}{
+		{name: "queued job of a dead process", job: store.Job{State: store.JobQueued, Pid: deadPid}, wantState: store.JobQueued, wantResumed: true},
+		{name: "running job of a dead process", job: store.Job{State: store.JobDownloading, Pid: deadPid}, wantState: store.JobQueued, wantResumed: true},
+		{name: "running job of a live server", job: store.Job{State: store.JobUploading, Pid: alivePid}, locked: true, wantState: store.JobUploading},
+		{name: "queued job of a live server", job: store.Job{State: store.JobQueued, Pid: alivePid}, locked: true, wantState: store.JobQueued},
+		// The pid was reused by a process that is not a server
+		{name: "running job of a live pid that is not ours", job: store.Job{State: store.JobUploading, Pid: alivePid}, wantState: store.JobQueued, wantResumed: true},
+		{name: "interrupted job", job: store.Job{State: store.JobInterrupted, Pid: alivePid}, wantState: store.JobQueued, wantResumed: true},
+		// A restarted container runs with the pid of its previous run
+		{name: "running job of the same pid", job: store.Job{State: store.JobDownloading, Pid: os.Getpid()}, wantState: store.JobQueued, wantResumed: true},
+		{name: "job with credentials", job: store.Job{State: store.JobDownloading, Pid: deadPid, Options: store.JobOptions{Credentials: true}}, wantState: store.JobFailed},
+		{name: "invalid reference", job: store.Job{State: store.JobQueued, Pid: deadPid, Reference: "Not A Reference"}, wantState: store.JobFailed},
+		{name: "done job", job: store.Job{State: store.JobDone, Pid: deadPid}, wantState: store.JobDone},
+		{name: "cancelled job", job: store.Job{State: store.JobCancelled, Pid: deadPid}, wantState: store.JobCancelled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQueue(t)
+			job := tt.job
+			job.Progress = registry.Progress{Phase: "downloading"}
+			putTestJob(t, q.store, "job1", job)
+			if tt.locked {
+				unlock, locked, err := q.store.LockJob("job1")
+				if err != nil || !locked {
+					t.Fatalf("LockJob() = %v, %v", locked, err)
+				}
+				defer unlock()
+			}
+
+			if err := q.resume(false); err != nil {
+				t.Fatalf("resume() error = %v", err)
+			}
+
+			got, err := q.store.Job("job1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.State != tt.wantState {
+				t.Errorf("resume() state = %s, want %s", got.State, tt.wantState)
+			}
+			if resumed := len(q.pending) == 1; resumed != tt.wantResumed {
+				t.Fatalf("resume() queued the job = %v, want %v", resumed, tt.wantResumed)
+			}
+			_, lockable, err := q.store.LockJob("job1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.wantResumed {
+				if got.State == store.JobFailed && (got.Error == "" || got.ErrorStatus == 0 || got.FinishedAt == nil) {
+					t.Errorf("resume() failed the job without an error, its status or a finish time: %+v", got)
+				}
+				if !tt.locked && !lockable {
+					t.Error("resume() kept the lock of a job it did not resume")
+				}
+				return
+			}
+			if lockable {
+				t.Error("resume() did not take the lock of the resumed job")
+			}
+			if got.Pid != os.Getpid() {
+				t.Errorf("resume() pid = %d, want %d", got.Pid, os.Getpid())
+			}
+			if got.Progress != (registry.Progress{}) {
+				t.Errorf("resume() kept the progress %+v", got.Progress)
+			}
+			live := <-q.pending
+			if live.job.ID != "job1" || q.live["job1"] != live {
+				t.Fatalf("resume() queued %+v, want job1", live.job)
+			}
+			q.finish(live, nil, errShuttingDown)
+			if _, lockable, _ := q.store.LockJob("job1"); !lockable {
+				t.Error("finish() did not release the lock of the job")
+			}
+		})
+	}
+}
+
+func TestJobQueueCancelJobOfAnotherProcess(t *testing.T) {
+	tests := []struct {
+		name      string
+		state     store.JobState
+		locked    bool
+		wantErr   error
+		wantState store.JobState
+	}{
+		{name: "job of a live server", state: store.JobDownloading, locked: true, wantErr: errJobTaken, wantState: store.JobDownloading},
+		{name: "job of a process that died", state: store.JobDownloading, wantState: store.JobCancelled},
+		{name: "finished job", state: store.JobDone, wantErr: errJobFinished, wantState: store.JobDone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQueue(t)
+			putTestJob(t, q.store, "job1", store.Job{State: tt.state, Pid: os.Getppid()})
+			if tt.locked {
+				unlock, _, err := q.store.LockJob("job1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer unlock()
+			}
+
+			_, err := q.cancel("job1")
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("cancel() error = %v, want %v", err, tt.wantErr)
+			}
+			got, err := q.store.Job("job1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.State != tt.wantState {
+				t.Errorf("cancel() state = %s, want %s", got.State, tt.wantState)
+			}
+		})
+	}
+	if _, err := newTestQueue(t).cancel("nope"); !errors.Is(err, store.ErrJobNotFound) {
+		t.Errorf("cancel() of an unknown job error = %v, want ErrJobNotFound", err)
+	}
+}
+
+func TestJobQueueDrain(t *testing.T) {
+	t.Setenv("EXPORT_PATH", t.TempDir())
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	t.Setenv("TOKEN_CACHE_PATH", filepath.Join(t.TempDir(), "tokens.json"))
+
+	// The registry never answers, so the copy runs until it is cancelled
+	requested := make(chan struct{}, 1)
+	registryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		<-r.Context().Done()
+	}))
+	defer registryServer.Close()
+
+	jobStore, err := store.Open(filepath.Join(t.TempDir(), "store.json"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The copy never reaches IPFS
+	client, err := ipfs.NewClient(ipfs.Config{API: registryServer.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q := newJobQueue(ctx, jobStore, client, 1)
+
+	submit := func(tag string) *liveJob {
+		ref, err := registry.ParseReference(strings.TrimPrefix(registryServer.URL, "http://") + "/app:" + tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		live, err := q.submit(&copyRequest{name: ref.Name(), tag: tag, ref: ref})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return live
+	}
+	running := submit("running")
+	select {
+	case <-requested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the job did not start")
+	}
+	// The only worker runs the first job, the second one stays queued
+	queued := submit("queued")
+
+	q.drain(50*time.Millisecond, cancel)
+	for _, live := range []*liveJob{running, queued} {
+		<-live.done
+		if live.err == nil {
+			t.Errorf("job %s ended without an error", live.job.ID)
+		}
+		job, err := jobStore.Job(live.job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.State != store.JobInterrupted || job.FinishedAt != nil {
+			t.Errorf("job %s is %s after the shutdown, want it interrupted and not finished", job.ID, job.State)
+		}
+	}
+	if _, err := q.submit(&copyRequest{ref: running.request.ref}); !errors.Is(err, errShuttingDown) {
+		t.Errorf("submit() after the shutdown error = %v, want errShuttingDown", err)
+	}
+
+	// The next start of a server resumes both jobs
+	next := newTestQueue(t)
+	next.store = jobStore
+	if err := next.resume(false); err != nil {
+		t.Fatal(err)
+	}
+	if len(next.pending) != 2 {
+		t.Fatalf("resume() queued %d jobs, want 2", len(next.pending))
+	}
+	for _, live := range []*liveJob{running, queued} {
+		job, err := jobStore.Job(live.job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.State != store.JobQueued {
+			t.Errorf("job %s is %s after the restart, want it queued", job.ID, job.State)
+		}
+	}
+	for len(next.pending) > 0 {
+		live := <-next.pending
+		next.finish(live, nil, errShuttingDown)
+	}
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/akakream/MultiPlatform2IPFS/internal/ipfs"
+	"github.com/akakream/MultiPlatform2IPFS/internal/store"
+)
+
+// errPinRunning is error for when a pin that is still running is removed
+var errPinRunning = errors.New("the CID is still being pinned")
+
+// pinner pins CIDs in the background and records them in the store. The pins
+// are cancelled with the context of the pinner.
+type pinner struct {
+	ctx     context.Context
+	store   *store.Store
+	ipfs    *ipfs.Client
+	timeout time.Duration
+	mu      sync.Mutex
+	// running are the pins of this process that are not finished, by CID.
+	// The channel is closed when the pin is finished.
+	running map[string]chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newPinner(ctx context.Context, pinStore *store.Store, client *ipfs.Client, timeout time.Duration) *pinner {
+	return &pinner{ctx: ctx, store: pinStore, ipfs: client, timeout: timeout, running: map[string]chan struct{}{}}
+}
+
+// pin records the pin of the CID and starts it. It returns the record and a
+// channel that is closed when the pin is finished. If the CID is already
+// being pinned, the running pin is returned instead.
+func (p *pinner) pin(cid string, recursive bool) (store.Pin, <-chan struct{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if done, ok := p.running[cid]; ok {
+		pin, err := p.store.Pin(cid)
+		return pin, done, err
+	}
+	if p.ctx.Err() != nil {
+		return store.Pin{}, nil, errShuttingDown
+	}
+
+	now := time.Now().UTC()
+	pin, err := p.store.Pin(cid)
+	if errors.Is(err, store.ErrPinNotFound) {
+		pin = store.Pin{Cid: cid, CreatedAt: now}
+	} else if err != nil {
+		return store.Pin{}, nil, err
+	}
+	pin.Recursive = recursive
+	pin.State = store.PinPinning
+	pin.Error = ""
+	pin.UpdatedAt = now
+	if err := p.store.PutPin(pin); err != nil {
+		return store.Pin{}, nil, err
+	}
+	done := p.start(cid, recursive)
+	return pin, done, nil
+}
+
+// start runs the pin of the CID. The caller holds p.mu.
+func (p *pinner) start(cid string, recursive bool) chan struct{} {
+	done := make(chan struct{})
+	p.running[cid] = done
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() {
+			p.mu.Lock()
+			delete(p.running, cid)
+			p.mu.Unlock()
+			close(done)
+		}()
+		p.run(cid, recursive)
+	}()
+	return done
+}
+
+// run pins the CID and records the result. A pin that is cancelled because
+// the server shuts down stays pinning and is resumed by the next start.
+func (p *pinner) run(cid string, recursive bool) {
+	ctx, cancel := p.ctx, context.CancelFunc(func() {})
+	if p.timeout > 0 {
+		ctx, cancel = context.WithTimeout(p.ctx, p.timeout)
+	}
+	err := p.ipfs.Pin(ctx, cid, recursive)
+	cancel()
+	if err != nil && p.ctx.Err() != nil {
+		log.Printf("Pinning %s was interrupted: %v", cid, err)
+		return
+	}
+
+	_, updateErr := p.store.UpdatePin(cid, func(pin *store.Pin) error {
+		pin.UpdatedAt = time.Now().UTC()
+		if err != nil {
+			log.Printf("Pinning %s failed: %v", cid, err)
+			pin.State = store.PinFailed
+			pin.Error = err.Error()
+			return nil
+		}
+		pin.State = store.PinPinned
+		return nil
+	})
+	if updateErr != nil {
+		log.Printf("Can not record the pin of %s: %v", cid, updateErr)
+	}
+}
+
+// isRunning reports whether the CID is being pinned by this process.
+func (p *pinner) isRunning(cid string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.running[cid]
+	return ok
+}
+
+// resume starts the pins that were interrupted when their process stopped.
+func (p *pinner) resume() error {
+	pins, err := p.store.Pins()
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pin := range pins {
+		if pin.State != store.PinPinning {
+			continue
+		}
+		if _, ok := p.running[pin.Cid]; ok {
+			continue
+		}
+		log.Printf("Resuming the pin of %s", pin.Cid)
+		p.start(pin.Cid, pin.Recursive)
+	}
+	return nil
+}
+
+// wait waits until the running pins are finished or interrupted.
+func (p *pinner) wait() {
+	p.wg.Wait()
+}
+
+// handleCreatePin pins the CID in the background and answers with the pin.
+// ?recursive=false only pins the block of the CID. With ?wait=true it answers
+// once the pin is finished.
+func (s *Server) handleCreatePin(w http.ResponseWriter, r *http.Request) error {
+	cid, err := parseCid(chi.URLParam(r, "cid"))
+	if err != nil {
+		return err
+	}
+	recursive := true
+	if value := r.URL.Query().Get("recursive"); value != "" {
+		recursive, err = strconv.ParseBool(value)
+		if err != nil {
+			return apiError{Err: "recursive must be true or false", Status: http.StatusBadRequest}
+		}
+	}
+
+	pin, done, err := s.pins.pin(cid, recursive)
+	if errors.Is(err, errShuttingDown) {
+		return apiError{Err: err.Error(), Status: http.StatusServiceUnavailable}
+	}
+	if err != nil {
+		return err
+	}
+
+	if r.URL.Query().Get("wait") == "true" {
+		pin, ok, err := s.waitForPin(r, cid, done)
+		if !ok {
+			return err
+		}
+		status := http.StatusOK
+		if pin.State == store.PinFailed {
+			status = http.StatusBadGateway
+		}
+		return writeJSON(w, status, pin)
+	}
+	w.Header().Set("Location", "/pins/"+cid)
+	return writeJSON(w, http.StatusAccepted, pin)
+}
+
+// waitForPin returns the pin of the CID once done is closed. It returns false
+// if the client disconnected before. The pin keeps running in that case.
+func (s *Server) waitForPin(r *http.Request, cid string, done <-chan struct{}) (store.Pin, bool, error) {
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if s.ctx.Err() == nil {
+			return store.Pin{}, false, nil
+		}
+		return store.Pin{}, false, apiError{Err: errShuttingDown.Error(), Status: http.StatusServiceUnavailable}
+	}
+	pin, err := s.options.Store.Pin(cid)
+	if err == nil && pin.State == store.PinPinning {
+		// The pin was interrupted by the shutdown
+		return store.Pin{}, false, apiError{Err: errShuttingDown.Error(), Status: http.StatusServiceUnavailable}
+	}
+	return pin, err == nil, err
+}
+
+// handleGetPin returns the pin of the CID.
+func (s *Server) handleGetPin(w http.ResponseWriter, r *http.Request) error {
+	cid, err := parseCid(chi.URLParam(r, "cid"))
+	if err != nil {
+		return err
+	}
+	pin, err := s.options.Store.Pin(cid)
+	if errors.Is(err, store.ErrPinNotFound) {
+		return apiError{Err: err.Error(), Status: http.StatusNotFound}
+	}
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, pin)
+}
+
+// handlePins returns every pin of the service, the oldest first.
+func (s *Server) handlePins(w http.ResponseWriter, r *http.Request) error {
+	pins, err := s.options.Store.Pins()
+	if err != nil {
+		return err
+	}
+	if pins == nil {
+		pins = []store.Pin{}
+	}
+	return writeJSON(w, http.StatusOK, pins)
+}
+
+// handleDeletePin unpins the CID and removes its pin. The CID stays pinned
+// while an image of the catalog has it.
+func (s *Server) handleDeletePin(w http.ResponseWriter, r *http.Request) error {
+	cid, err := parseCid(chi.URLParam(r, "cid"))
+	if err != nil {
+		return err
+	}
+	pin, err := s.options.Store.Pin(cid)
+	if errors.Is(err, store.ErrPinNotFound) {
+		return apiError{Err: err.Error(), Status: http.StatusNotFound}
+	}
+	if err != nil {
+		return err
+	}
+	if s.pins.isRunning(cid) {
+		return apiError{Err: errPinRunning.Error(), Status: http.StatusConflict}
+	}
+
+	images, err := s.options.Store.Images()
+	if err != nil {
+		return err
+	}
+	shared := false
+	for _, image := range images {
+		if image.Cid == cid {
+			shared = true
+			break
+		}
+	}
+	if !shared && pin.State != store.PinFailed {
+		ctx, cancel := s.requestContext(r)
+		defer cancel()
+		if err := s.options.IPFS.Unpin(ctx, cid); err != nil && !errors.Is(err, ipfs.ErrNotPinned) {
+			return apiError{Err: fmt.Sprintf("unpinning %s: %v", cid, err), Status: http.StatusBadGateway}
+		}
+	}
+
+	pin, err = s.options.Store.DeletePin(cid)
+	if errors.Is(err, store.ErrPinNotFound) {
+		return apiError{Err: err.Error(), Status: http.StatusNotFound}
+	}
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, pin)
+}
+
+// handlePin answers POST /pin/{cid}, which is kept for the clients of the
+// first API. It pins the CID recursively and answers once the pin is finished.
+func (s *Server) handlePin(w http.ResponseWriter, r *http.Request) error {
+	cid, err := parseCid(chi.URLParam(r, "cid"))
+	if err != nil {
+		return err
+	}
+	_, done, err := s.pins.pin(cid, true)
+	if errors.Is(err, errShuttingDown) {
+		return apiError{Err: err.Error(), Status: http.StatusServiceUnavailable}
+	}
+	if err != nil {
+		return err
+	}
+	pin, ok, err := s.waitForPin(r, cid, done)
+	if !ok {
+		return err
+	}
+
+	resp := struct {
+		Status string `json:"status"`
+		Cid    string `json:"cid"`
+		Error  string `json:"error,omitempty"`
+	}{
+		Status: "OK",
+		Cid:    cid,
+	}
+	if pin.State == store.PinFailed {
+		resp.Status = "NOT OK"
+		resp.Error = pin.Error
+		return writeJSON(w, http.StatusBadGateway, resp)
+	}
+	return writeJSON(w, http.StatusOK, resp)
+}
+
+// parseCid validates the CID of a pin path.
+func parseCid(value string) (string, error) {
+	cid, err := ipfs.ParseCid(value)
+	if err != nil {
+		return "", apiError{Err: err.Error(), Status: http.StatusBadRequest}
+	}
+	return cid, nil
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/akakream/MultiPlatform2IPFS/internal/store"
+)
+
+const (
+	testCid       = "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi"
+	testFailedCid = "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"
+	testSlowCid   = "QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG"
+)
+
+// fakeKubo answers the pin requests of the IPFS API. testFailedCid can not be
+// pinned and the pin of testSlowCid waits until release is closed.
+type fakeKubo struct {
+	release chan struct{}
+
+	mu       sync.Mutex
+	unpinned []string
+}
+
+func newFakeKubo(t *testing.T) (*fakeKubo, *httptest.Server) {
+	t.Helper()
+	kubo := &fakeKubo{release: make(chan struct{})}
+	server := httptest.NewServer(kubo)
+	t.Cleanup(server.Close)
+	t.Cleanup(kubo.releasePins)
+	return kubo, server
+}
+
+func (k *fakeKubo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cid := r.URL.Query().Get("arg")
+	switch r.URL.Path {
+	case "/api/v0/pin/add":
+		if cid == testFailedCid {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"Message":"block was not found locally","Code":0,"Type":"error"}`)
+			return
+		}
+		if cid == testSlowCid {
+			select {
+			case <-k.release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	case "/api/v0/pin/rm":
+		k.mu.Lock()
+		k.unpinned = append(k.unpinned, cid)
+		k.mu.Unlock()
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	fmt.Fprintf(w, `{"Pins":[%q]}`, cid)
+}
+
+func (k *fakeKubo) releasePins() {
+	select {
+	case <-k.release:
+	default:
+		close(k.release)
+	}
+}
+
+func (k *fakeKubo) unpinnedCids() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return append([]string(nil), k.unpinned...)
+}
+
+func TestHandleCreatePin(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantState  store.PinState
+		wantError  bool
+	}{
+		{name: "in the background", path: "/pins/" + testCid, wantStatus: http.StatusAccepted, wantState: store.PinPinning},
+		{name: "wait for the pin", path: "/pins/" + testCid + "?wait=true", wantStatus: http.StatusOK, wantState: store.PinPinned},
+		{name: "failed pin", path: "/pins/" + testFailedCid + "?wait=true", wantStatus: http.StatusBadGateway, wantState: store.PinFailed, wantError: true},
+		{name: "invalid recursive", path: "/pins/" + testCid + "?recursive=maybe", wantStatus: http.StatusBadRequest},
+		{name: "invalid CID", path: "/pins/not-a-cid", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, kubo := newFakeKubo(t)
+			s := newTestServer(t, kubo.URL)
+
+			w := httptest.NewRecorder()
+			s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("POST %s status = %d, want %d: %s", tt.path, w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantState == "" {
+				return
+			}
+			var pin store.Pin
+			if err := json.Unmarshal(w.Body.Bytes(), &pin); err != nil {
+				t.Fatal(err)
+			}
+			if pin.State != tt.wantState || (pin.Error != "") != tt.wantError || !pin.Recursive {
+				t.Errorf("POST %s pin = %+v, want a recursive pin in state %s with error %v", tt.path, pin, tt.wantState, tt.wantError)
+			}
+			if w.Code == http.StatusAccepted && w.Header().Get("Location") != "/pins/"+pin.Cid {
+				t.Errorf("POST %s Location = %q, want the pin", tt.path, w.Header().Get("Location"))
+			}
+			s.pins.wait()
+		})
+	}
+}
+
+func TestHandleDeletePin(t *testing.T) {
+	tests := []struct {
+		name string
+		cid  string
+		// pin is the recorded pin of the CID, if any
+		pin *store.Pin
+		// image is the CID of an image of the catalog, if any
+		image        string
+		running      bool
+		wantStatus   int
+		wantUnpinned bool
+	}{
+		{name: "pinned", cid: testCid, pin: &store.Pin{State: store.PinPinned}, wantStatus: http.StatusOK, wantUnpinned: true},
+		{name: "shared with an image", cid: testCid, pin: &store.Pin{State: store.PinPinned}, image: testCid, wantStatus: http.StatusOK},
+		{name: "image of another CID", cid: testCid, pin: &store.Pin{State: store.PinPinned}, image: testFailedCid, wantStatus: http.StatusOK, wantUnpinned: true},
+		{name: "failed pin", cid: testFailedCid, pin: &store.Pin{State: store.PinFailed}, wantStatus: http.StatusOK},
+		{name: "running pin", cid: testSlowCid, running: true, wantStatus: http.StatusConflict},
+		{name: "unknown pin", cid: testCid, wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kubo, server := newFakeKubo(t)
+			s := newTestServer(t, server.URL)
+			if tt.pin != nil {
+				pin := *tt.pin
+				pin.Cid = tt.cid
+				pin.Recursive = true
+				if err := s.options.Store.PutPin(pin); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.image != "" {
+				if err := s.options.Store.PutImage(store.Image{Name: "docker.io/library/busybox", Tag: "latest", Cid: tt.image}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.running {
+				if _, _, err := s.pins.pin(tt.cid, true); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			w := httptest.NewRecorder()
+			s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/pins/"+tt.cid, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("DELETE /pins/%s status = %d, want %d: %s", tt.cid, w.Code, tt.wantStatus, w.Body)
+			}
+			if unpinned := len(kubo.unpinnedCids()) > 0; unpinned != tt.wantUnpinned {
+				t.Errorf("DELETE /pins/%s unpinned %v, want %v", tt.cid, kubo.unpinnedCids(), tt.wantUnpinned)
+			}
+
+			_, err := s.options.Store.Pin(tt.cid)
+			if removed := errors.Is(err, store.ErrPinNotFound); removed != (tt.wantStatus != http.StatusConflict) {
+				t.Errorf("DELETE /pins/%s removed the pin = %v (error %v)", tt.cid, removed, err)
+			}
+			if tt.running {
+				kubo.releasePins()
+				s.pins.wait()
+				if pin, err := s.options.Store.Pin(tt.cid); err != nil || pin.State != store.PinPinned {
+					t.Errorf("pin after the conflict = %+v, %v, want it pinned", pin, err)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlePin(t *testing.T) {
+	tests := []struct {
+		name       string
+		cid        string
+		wantStatus int
+		want       string
+	}{
+		{
+			name:       "pinned",
+			cid:        testCid,
+			wantStatus: http.StatusOK,
+			want:       `{"status":"OK","cid":"` + testCid + `"}`,
+		},
+		{
+			name:       "failed pin",
+			cid:        testFailedCid,
+			wantStatus: http.StatusBadGateway,
+			want:       `{"status":"NOT OK","cid":"` + testFailedCid + `","error":"pin/add: block was not found locally"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, server := newFakeKubo(t)
+			s := newTestServer(t, server.URL)
+
+			w := httptest.NewRecorder()
+			s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/pin/"+tt.cid, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("POST /pin/%s status = %d, want %d: %s", tt.cid, w.Code, tt.wantStatus, w.Body)
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tt.want {
+				t.Errorf("POST /pin/%s body = %s, want %s", tt.cid, got, tt.want)
+			}
+		})
+	}
+}
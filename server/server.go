@@ -3,23 +3,61 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 
 	"github.com/akakream/MultiPlatform2IPFS/internal/ipfs"
 	registry "github.com/akakream/MultiPlatform2IPFS/internal/registry"
+	"github.com/akakream/MultiPlatform2IPFS/internal/store"
 )
 
+// Options configure the copies of a Server.
+type Options struct {
+	// KeepStaging keeps the staging directories of the copies for debugging.
+	KeepStaging bool
+	// Workers is the number of copies that run at the same time.
+	Workers int
+	// Store records the jobs and the copied images, so they survive restarts.
+	Store *store.Store
+	// IPFS is the client of the IPFS node the images are added to.
+	IPFS *ipfs.Client
+	// PinTimeout limits a single pin of the pin API, 0 for none.
+	PinTimeout time.Duration
+	// ShutdownGracePeriod is how long the running copies may take to finish
+	// when the server shuts down before they are cancelled.
+	ShutdownGracePeriod time.Duration
+	// ImageRetention is how long an image stays in the catalog and pinned
+	// after its last copy, 0 for ever.
+	ImageRetention time.Duration
+}
+
+// httpShutdownTimeout limits how long the server waits for the open requests
+// once the jobs are drained.
+const httpShutdownTimeout = 5 * time.Second
+
 type Server struct {
-	baseURL       string
-	quitch        chan struct{}
+	baseURL    string
+	options    Options
+	jobs       *jobQueue
+	pins       *pinner
+	httpServer *http.Server
+	quitch     chan struct{}
+	// ctx is cancelled by cancelContext when the server shuts down, which
+	// stops every copy that is still running.
+	ctx           context.Context
 	cancelContext context.CancelFunc
 }
 
@@ -34,6 +72,21 @@ type Image struct {
 	Name string `json:"name"`
 	Tag  string `json:"tag"`
 	Cid  string `json:"cid"`
+	// Credentials for private repositories. They are never part of a response.
+	Credentials *registry.Credentials `json:"credentials,omitempty"`
+	// Platforms select the platforms to copy, e.g. linux/amd64 or linux/arm*.
+	Platforms []string `json:"platforms,omitempty"`
+	// Format is the export format, flat or platform. It defaults to EXPORT_FORMAT.
+	Format string `json:"format,omitempty"`
+	// Concurrency limits the concurrent downloads of the copy. 0 uses MAX_CONCURRENT_DOWNLOADS.
+	Concurrency int `json:"concurrency,omitempty"`
+	// Force copies the image even if it was published before.
+	Force bool `json:"force,omitempty"`
+	// Add changes the options the image is added to IPFS with. Unset options
+	// are the ones of the IPFS_* settings.
+	Add *ipfs.AddOverrides `json:"add,omitempty"`
+	// OnlyHash computes the CID the image would have without storing it.
+	OnlyHash bool `json:"onlyHash,omitempty"`
 }
 
 type CrdtPair struct {
@@ -45,53 +98,158 @@ func (e apiError) Error() string {
 	return e.Err
 }
 
+// copyErrorStatus returns the status a failed copy is answered with, so
+// clients can tell a wrong image name from a registry outage. It is recorded
+// with the failed job as well.
+func copyErrorStatus(err error) int {
+	var statusErr *registry.StatusError
+	var verificationErr *registry.VerificationError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, registry.ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, registry.ErrDenied):
+		return http.StatusForbidden
+	case errors.Is(err, registry.ErrNameUnknown),
+		errors.Is(err, registry.ErrManifestUnknown),
+		errors.Is(err, registry.ErrBlobUnknown),
+		errors.Is(err, registry.ErrNoMatchingPlatform):
+		return http.StatusNotFound
+	case errors.Is(err, registry.ErrTooManyRequests):
+		return http.StatusTooManyRequests
+	case errors.Is(err, registry.ErrInvalidReference):
+		return http.StatusBadRequest
+	case errors.As(err, &statusErr), errors.As(err, &verificationErr), errors.As(err, &netErr):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
 func makeHTTPHandler(f apiFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if err := f(w, r); err != nil {
-			if e, ok := err.(apiError); ok {
-				writeJSON(w, e.Status, e)
-				return
+		rw := &responseWriter{ResponseWriter: w}
+		// A panic only fails its own request instead of the whole server
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				log.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, recovered, debug.Stack())
+				if rw.wroteHeader {
+					// The response already started, its client sees it end early
+					return
+				}
+				writeJSON(
+					rw,
+					http.StatusInternalServerError,
+					apiError{Err: "internal server error", Status: http.StatusInternalServerError},
+				)
 			}
-			writeJSON(
-				w,
-				http.StatusInternalServerError,
-				apiError{Err: "internal server error", Status: http.StatusInternalServerError},
-			)
+		}()
+
+		err := f(rw, r)
+		if err == nil {
+			return
+		}
+		e, ok := err.(apiError)
+		if !ok {
+			// The client only sees a generic error, the cause is in the log
+			log.Printf("error serving %s %s: %v", r.Method, r.URL.Path, err)
+			e = apiError{Err: "internal server error", Status: http.StatusInternalServerError}
 		}
+		if rw.wroteHeader {
+			if ok {
+				log.Printf("error serving %s %s after the response started: %v", r.Method, r.URL.Path, err)
+			}
+			return
+		}
+		writeJSON(rw, e.Status, e)
 	}
 }
 
-func NewServer(baseURL string) *Server {
+// responseWriter records whether the response was started, so an error of a
+// handler that already wrote its response is not written into its body.
+type responseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush flushes the response, which the events of a job need.
+func (w *responseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wroteHeader = true
+		flusher.Flush()
+	}
+}
+
+func NewServer(baseURL string, options Options) *Server {
 	ctx, cancel := context.WithCancel(context.Background())
-	_ = ctx
 
 	return &Server{
 		baseURL:       baseURL,
+		options:       options,
+		jobs:          newJobQueue(ctx, options.Store, options.IPFS, options.Workers),
+		pins:          newPinner(ctx, options.Store, options.IPFS, options.PinTimeout),
 		quitch:        make(chan struct{}),
+		ctx:           ctx,
 		cancelContext: cancel,
 	}
 }
 
-func (s *Server) Start() {
-	fmt.Printf("Starting the MultiPlatform2IPFS server at %s\n", s.baseURL)
+// routes returns the handler of the API.
+func (s *Server) routes() http.Handler {
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 	// Publish a message to a topic
 	r.Get("/health", makeHTTPHandler(s.handleHealth))
 	r.Post("/image", makeHTTPHandler(s.handleCopy))
+	r.Get("/jobs", makeHTTPHandler(s.handleJobs))
+	r.Get("/jobs/{id}", makeHTTPHandler(s.handleJob))
+	r.Delete("/jobs/{id}", makeHTTPHandler(s.handleCancelJob))
+	r.Get("/jobs/{id}/events", makeHTTPHandler(s.handleJobEvents))
+	r.Get("/images", makeHTTPHandler(s.handleImages))
+	r.Get("/images/*", makeHTTPHandler(s.handleImage))
+	r.Delete("/images/*", makeHTTPHandler(s.handleDeleteImage))
+	r.Get("/pins", makeHTTPHandler(s.handlePins))
+	r.Post("/pins/{cid}", makeHTTPHandler(s.handleCreatePin))
+	r.Get("/pins/{cid}", makeHTTPHandler(s.handleGetPin))
+	r.Delete("/pins/{cid}", makeHTTPHandler(s.handleDeletePin))
+	// Deprecated, use POST /pins/{cid}?wait=true
 	r.Post("/pin/{cid}", makeHTTPHandler(s.handlePin))
+	r.Get("/ratelimit", makeHTTPHandler(s.handleRateLimit))
+	return r
+}
+
+func (s *Server) Start() {
+	fmt.Printf("Starting the MultiPlatform2IPFS server at %s\n", s.baseURL)
 
 	go s.listenShutdown()
 
+	if err := s.jobs.resume(s.options.KeepStaging); err != nil {
+		log.Printf("Can not resume the interrupted jobs: %v", err)
+	}
+	if err := s.pins.resume(); err != nil {
+		log.Printf("Can not resume the interrupted pins: %v", err)
+	}
+	go s.expireImages()
+
+	s.httpServer = &http.Server{Addr: s.baseURL, Handler: s.routes()}
 	go func() {
-		if err := http.ListenAndServe(s.baseURL, r); err != http.ErrServerClosed {
+		if err := s.httpServer.ListenAndServe(); err != http.ErrServerClosed {
 			log.Fatalf("HTTP server ListenAndServe Error: %v", err)
 		}
 	}()
 
-	// Check if a local ipfs daeamon is running
-	if !ipfs.DeamonIsUp() {
-		fmt.Println("There is no local IPFS daemon is running! Uploads will fail!")
+	// Check if the ipfs daemon is running
+	if !s.options.IPFS.IsUp(s.ctx) {
+		fmt.Println("The IPFS API does not answer! Uploads will fail!")
 	}
 
 	fmt.Println("MultiPlatform2IPFS server started.")
@@ -99,6 +257,20 @@ func (s *Server) Start() {
 	<-s.quitch
 }
 
+// requestContext returns a context that is done when the client of the
+// request disconnects or the server shuts down.
+func (s *Server) requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(r.Context())
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodGet {
 		return apiError{Err: "invalid method", Status: http.StatusMethodNotAllowed}
@@ -106,74 +278,195 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) error {
 	return writeJSON(w, http.StatusOK, "OK")
 }
 
+// handleRateLimit returns the pull budget last reported by every registry.
+func (s *Server) handleRateLimit(w http.ResponseWriter, r *http.Request) error {
+	return writeJSON(w, http.StatusOK, registry.RateLimits())
+}
+
+// handleCopy queues the copy of the image and answers with the job. With
+// ?wait=true it answers with the result once the copy is finished. Requests
+// for a copy that is already queued or running join its job.
 func (s *Server) handleCopy(w http.ResponseWriter, r *http.Request) error {
+	request, err := s.parseCopyRequest(r)
+	if err != nil {
+		return err
+	}
+
+	live, err := s.jobs.submit(request)
+	if errors.Is(err, errQueueFull) || errors.Is(err, errShuttingDown) {
+		return apiError{Err: err.Error(), Status: http.StatusServiceUnavailable}
+	}
+	if err != nil {
+		return err
+	}
+
+	if r.URL.Query().Get("wait") == "true" {
+		return s.waitForJob(w, r, live)
+	}
+	job := s.jobs.snapshot(live)
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	return writeJSON(w, http.StatusAccepted, job)
+}
+
+// parseCopyRequest validates the body of POST /image.
+func (s *Server) parseCopyRequest(r *http.Request) (*copyRequest, error) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		return apiError{Err: "invalid body", Status: http.StatusBadRequest}
+		return nil, apiError{Err: "invalid body", Status: http.StatusBadRequest}
 	}
 	defer r.Body.Close()
 
 	var bodyJson Image
 	if err := json.Unmarshal(body, &bodyJson); err != nil {
 		log.Println(err)
-		return apiError{Err: "body must be json", Status: http.StatusBadRequest}
+		return nil, apiError{Err: "body must be json", Status: http.StatusBadRequest}
 	}
 
 	imageName := bodyJson.Name
 	if imageName == "" {
-		return apiError{Err: "empty image name", Status: http.StatusBadRequest}
+		return nil, apiError{Err: "empty image name", Status: http.StatusBadRequest}
 	}
 	imageTag := bodyJson.Tag
 	if imageTag == "" {
-		return apiError{Err: "empty image tag", Status: http.StatusBadRequest}
+		return nil, apiError{Err: "empty image tag", Status: http.StatusBadRequest}
 	}
 
-	// Logic
-	ctx := context.TODO()
-	cid, err := registry.CopyImage(ctx, imageName, imageTag)
+	separator := ":"
+	if strings.Contains(imageTag, ":") {
+		// The tag field also accepts a digest such as sha256:...
+		separator = "@"
+	}
+	ref, err := registry.ParseReference(imageName + separator + imageTag)
 	if err != nil {
-		// TODO: Gotta handle this properly on DistroMash
-		cid = ""
+		return nil, apiError{Err: err.Error(), Status: http.StatusBadRequest}
+	}
+	platforms, err := registry.ParsePlatforms(bodyJson.Platforms)
+	if err != nil {
+		return nil, apiError{Err: err.Error(), Status: http.StatusBadRequest}
+	}
+	format, err := registry.ParseExportFormat(bodyJson.Format)
+	if err != nil {
+		return nil, apiError{Err: err.Error(), Status: http.StatusBadRequest}
+	}
+	if bodyJson.Concurrency < 0 {
+		return nil, apiError{Err: "concurrency must not be negative", Status: http.StatusBadRequest}
+	}
+	add := s.options.IPFS.AddOptions()
+	if bodyJson.Add != nil {
+		add, err = add.With(*bodyJson.Add)
+		if err != nil {
+			return nil, apiError{Err: err.Error(), Status: http.StatusBadRequest}
+		}
+	}
+
+	opts := registry.CopyOptions{
+		Credentials: bodyJson.Credentials,
+		Platforms:   platforms,
+		Format:      format,
+		Concurrency: bodyJson.Concurrency,
+		KeepStaging: s.options.KeepStaging,
+		Force:       bodyJson.Force,
+		Add:         &add,
+		OnlyHash:    bodyJson.OnlyHash,
+	}
+	opts.Lookup = s.options.Store.Lookup(store.NewJobOptions(opts))
+	return &copyRequest{
+		name: imageName,
+		tag:  imageTag,
+		ref:  ref,
+		opts: opts,
+	}, nil
+}
+
+// waitForJob answers with the result of the job once it is finished. The
+// job keeps running when the client disconnects, since other requests may
+// have joined it.
+func (s *Server) waitForJob(w http.ResponseWriter, r *http.Request, live *liveJob) error {
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+	select {
+	case <-live.done:
+	case <-ctx.Done():
+		if s.ctx.Err() == nil {
+			// The client is gone
+			return nil
+		}
+		return apiError{Err: errShuttingDown.Error(), Status: http.StatusServiceUnavailable}
+	}
+	if live.err != nil && (s.ctx.Err() != nil || errors.Is(live.err, errShuttingDown)) {
+		return apiError{Err: errShuttingDown.Error(), Status: http.StatusServiceUnavailable}
+	}
+	if errors.Is(live.err, errJobCancelled) {
+		return apiError{Err: live.err.Error(), Status: http.StatusConflict}
+	}
+	if live.err != nil {
+		return apiError{Err: live.err.Error(), Status: copyErrorStatus(live.err)}
 	}
 
 	resp := struct {
-		Name string `json:"name"`
-		Tag  string `json:"tag"`
-		Cid  string `json:"cid"`
+		ID        string              `json:"id"`
+		Name      string              `json:"name"`
+		Tag       string              `json:"tag"`
+		Cid       string              `json:"cid"`
+		Digest    string              `json:"digest,omitempty"`
+		Platforms []registry.Platform `json:"platforms,omitempty"`
+		Reused    bool                `json:"reused,omitempty"`
+		Add       ipfs.AddOptions     `json:"add"`
+		OnlyHash  bool                `json:"onlyHash,omitempty"`
 	}{
-		Name: imageName,
-		Tag:  imageTag,
-		Cid:  cid,
+		ID:        live.job.ID,
+		Name:      live.request.name,
+		Tag:       live.request.tag,
+		Cid:       live.result.Cid,
+		Digest:    live.result.IndexDigest,
+		Platforms: live.result.Platforms,
+		Reused:    live.result.Reused,
+		Add:       live.job.Options.AddOptions(),
+		OnlyHash:  live.job.Options.OnlyHash,
 	}
 
 	return writeJSON(w, http.StatusOK, resp)
 }
 
-func (s *Server) handlePin(w http.ResponseWriter, r *http.Request) error {
-	cidParam := chi.URLParam(r, "cid")
-
-	// Logic
-	err := ipfs.Pin(cidParam)
+// handleJob returns the job with the id.
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) error {
+	job, err := s.jobs.get(chi.URLParam(r, "id"))
+	if errors.Is(err, store.ErrJobNotFound) {
+		return apiError{Err: err.Error(), Status: http.StatusNotFound}
+	}
 	if err != nil {
-		resp := struct {
-			Status string `json:"status"`
-			Cid    string `json:"cid"`
-		}{
-			Status: "OK",
-			Cid:    cidParam,
-		}
-		return writeJSON(w, http.StatusInternalServerError, resp)
+		return err
 	}
+	return writeJSON(w, http.StatusOK, job)
+}
 
-	resp := struct {
-		Status string `json:"status"`
-		Cid    string `json:"cid"`
-	}{
-		Status: "NOT OK",
-		Cid:    cidParam,
+// handleCancelJob cancels the job with the id. It answers 200 with the
+// cancelled job if it was queued, and 202 with the job if it runs, as its
+// transfers are aborted in the background. Requests that joined the job are
+// answered with the cancellation as well.
+func (s *Server) handleCancelJob(w http.ResponseWriter, r *http.Request) error {
+	job, err := s.jobs.cancel(chi.URLParam(r, "id"))
+	switch {
+	case errors.Is(err, store.ErrJobNotFound):
+		return apiError{Err: err.Error(), Status: http.StatusNotFound}
+	case errors.Is(err, errJobFinished), errors.Is(err, errJobTaken):
+		return apiError{Err: err.Error(), Status: http.StatusConflict}
+	case err != nil:
+		return err
+	}
+	if !job.Finished() {
+		return writeJSON(w, http.StatusAccepted, job)
 	}
+	return writeJSON(w, http.StatusOK, job)
+}
 
-	return writeJSON(w, http.StatusOK, resp)
+// handleJobs returns every job, the oldest first.
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) error {
+	jobs, err := s.jobs.list()
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, jobs)
 }
 
 /*
@@ -214,19 +507,39 @@ func postCid(imageName string, cid string) error {
 }
 */
 
+// gracefullyQuitServer drains the jobs, while the API still answers about
+// them and rejects new copies, and then stops the HTTP server.
 func (s *Server) gracefullyQuitServer() {
-	log.Println("Shutting down the server")
+	log.Printf("Shutting down the server, the running jobs have %s to finish", s.options.ShutdownGracePeriod)
 
-	// Shutdown services
+	s.jobs.drain(s.options.ShutdownGracePeriod, s.cancelContext)
 
-	// Cancel the context
+	// Cancel the context, which ends the waiting requests, the event streams
+	// and the pins
 	s.cancelContext()
+	s.pins.wait()
+
+	if s.httpServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		if err := s.httpServer.Shutdown(ctx); err != nil {
+			log.Printf("HTTP server Shutdown Error: %v", err)
+		}
+	}
+	log.Println("The server stopped")
 }
 
+// listenShutdown shuts the server down on SIGINT or SIGTERM. A second signal
+// cancels the running jobs without waiting for the grace period.
 func (s *Server) listenShutdown() {
-	sigint := make(chan os.Signal, 1)
-	signal.Notify(sigint, os.Interrupt)
-	<-sigint
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	go func() {
+		<-signals
+		log.Println("Cancelling the running jobs")
+		s.cancelContext()
+	}()
 	s.gracefullyQuitServer()
 	close(s.quitch)
 }
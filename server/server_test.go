@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/akakream/MultiPlatform2IPFS/internal/ipfs"
+	registry "github.com/akakream/MultiPlatform2IPFS/internal/registry"
+	"github.com/akakream/MultiPlatform2IPFS/internal/store"
+)
+
+// newTestServer returns a server of a new store whose IPFS client talks to
+// the API at ipfsURL.
+func newTestServer(t *testing.T, ipfsURL string) *Server {
+	t.Helper()
+	serverStore, err := store.Open(filepath.Join(t.TempDir(), "store.json"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ipfs.NewClient(ipfs.Config{API: ipfsURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer("127.0.0.1:0", Options{Store: serverStore, IPFS: client, Workers: 1})
+	t.Cleanup(s.cancelContext)
+	return s
+}
+
+func TestCopyErrorStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"unauthorized", &registry.StatusError{StatusCode: 401}, http.StatusUnauthorized},
+		{"denied", &registry.StatusError{StatusCode: 403}, http.StatusForbidden},
+		{"name unknown", &registry.StatusError{StatusCode: 404, Errors: []registry.ErrorDetail{{Code: "NAME_UNKNOWN"}}}, http.StatusNotFound},
+		{"manifest unknown", &registry.StatusError{URL: "https://r/v2/a/manifests/x", StatusCode: 404}, http.StatusNotFound},
+		{"no matching platform", fmt.Errorf("%w: windows", registry.ErrNoMatchingPlatform), http.StatusNotFound},
+		{"too many requests", &registry.StatusError{StatusCode: 429}, http.StatusTooManyRequests},
+		{"invalid reference", fmt.Errorf("%w: empty reference", registry.ErrInvalidReference), http.StatusBadRequest},
+		{"registry outage", &registry.StatusError{StatusCode: 503}, http.StatusBadGateway},
+		{"corrupt download", &registry.VerificationError{}, http.StatusBadGateway},
+		{"network error", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, http.StatusBadGateway},
+		{"wrapped", fmt.Errorf("copy: %w", &registry.StatusError{StatusCode: 401}), http.StatusUnauthorized},
+		{"other", errors.New("disk full"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := copyErrorStatus(tt.err); got != tt.want {
+				t.Errorf("copyErrorStatus(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMakeHTTPHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    apiFunc
+		wantStatus int
+		wantBody   string
+		wantLog    string
+	}{
+		{
+			name:       "response",
+			handler:    func(w http.ResponseWriter, r *http.Request) error { return writeJSON(w, http.StatusOK, "OK") },
+			wantStatus: http.StatusOK,
+			wantBody:   `"OK"`,
+		},
+		{
+			name: "api error",
+			handler: func(w http.ResponseWriter, r *http.Request) error {
+				return apiError{Err: "job not found", Status: http.StatusNotFound}
+			},
+			wantStatus: http.StatusNotFound,
+			wantBody:   `{"err":"job not found","status":404}`,
+		},
+		{
+			name:       "other error",
+			handler:    func(w http.ResponseWriter, r *http.Request) error { return errors.New("disk full") },
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   `{"err":"internal server error","status":500}`,
+			wantLog:    "error serving GET /jobs: disk full",
+		},
+		{
+			name: "error after the response started",
+			handler: func(w http.ResponseWriter, r *http.Request) error {
+				w.WriteHeader(http.StatusOK)
+				fmt.Fprint(w, "event: job")
+				return errors.New("connection reset")
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   "event: job",
+			wantLog:    "error serving GET /jobs: connection reset",
+		},
+		{
+			name:       "panic",
+			handler:    func(w http.ResponseWriter, r *http.Request) error { panic("boom") },
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   `{"err":"internal server error","status":500}`,
+			wantLog:    "panic serving GET /jobs: boom",
+		},
+		{
+			name: "panic after the response started",
+			handler: func(w http.ResponseWriter, r *http.Request) error {
+				w.WriteHeader(http.StatusOK)
+				fmt.Fprint(w, "event: job")
+				panic("boom")
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   "event: job",
+			wantLog:    "panic serving GET /jobs: boom",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			w := httptest.NewRecorder()
+			makeHTTPHandler(tt.handler)(w, httptest.NewRequest(http.MethodGet, "/jobs", nil))
+			if w.Code != tt.wantStatus || strings.TrimSpace(w.Body.String()) != tt.wantBody {
+				t.Errorf("response = %d %q, want %d %q", w.Code, w.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+			if !strings.Contains(logs.String(), tt.wantLog) || (tt.wantLog == "" && logs.Len() > 0) {
+				t.Errorf("log = %q, want %q", logs.String(), tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestMakeHTTPHandlerFlushes(t *testing.T) {
+	handler := makeHTTPHandler(func(w http.ResponseWriter, r *http.Request) error {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("the response writer of a handler is not a http.Flusher")
+		}
+		return nil
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/jobs/job1/events", nil))
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"errors"
+	"fmt"
 	"os"
 
 	"github.com/joho/godotenv"
@@ -17,7 +18,7 @@ var (
 )
 
 func InitSettings() error {
-	if err := godotenv.Load(); err != nil {
+	if err := LoadEnv(); err != nil {
 		return err
 	}
 
@@ -36,17 +37,22 @@ func InitSettings() error {
 	return nil
 }
 
+// LoadEnv loads the .env file into the environment. Variables that are
+// already set are kept. A missing .env file is not an error.
+func LoadEnv() error {
+	if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("loading the .env file: %w", err)
+	}
+	return nil
+}
+
+// GetEnv returns the value of the environment variable, or defaultValue if it is not set.
 func GetEnv(envVar string, defaultValue string) (string, error) {
 	value, exists := os.LookupEnv(envVar)
 	if !exists {
-		if defaultValue != "" {
-			return "", ErrEnvVarNotFound
-		} else {
-			return defaultValue, nil
-		}
-	} else {
-		return value, nil
+		return defaultValue, nil
 	}
+	return value, nil
 }
 
 func IsEnvDev() bool {